@@ -24,6 +24,7 @@ import (
 	"github.com/pquerna/distsync/common"
 	"github.com/pquerna/distsync/crypto"
 	"github.com/pquerna/distsync/notify"
+	"github.com/pquerna/distsync/release"
 	"github.com/pquerna/distsync/storage"
 
 	"flag"
@@ -46,6 +47,25 @@ type Daemon struct {
 	conf      *common.Conf
 	files     map[string]*storage.FileDownload
 	donefiles chan *storage.FileDownload
+	// highest index sequence number seen, by channel.
+	indexSeqs map[string]uint64
+	// when each channel was last listed to find files missing from its
+	// index.
+	indexListed map[string]time.Time
+	// hashes of local files, by path.
+	hashes map[string]*localHash
+	// local files replaced by queued downloads, by name, for hooks.
+	previous map[string]*localHash
+	// hooks run one at a time.
+	hookMtx sync.Mutex
+}
+
+// The SHA-256 of a local file, which is hashed again when its size or
+// modification time changes.
+type localHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
 }
 
 func (c *Daemon) Help() string {
@@ -95,6 +115,40 @@ func (c *Daemon) Run(args []string) int {
 		return 1
 	}
 
+	if c.conf.Release != nil {
+		_, err = path.Match(c.conf.Release.Pattern, "")
+		if err != nil {
+			c.Ui.Error("Configuration failure: invalid Release Pattern: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+	}
+
+	for _, channel := range c.conf.SubscribedChannels() {
+		err = common.ValidateChannel(channel)
+		if err != nil {
+			c.Ui.Error("Configuration failure: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+	}
+
+	err = c.conf.ValidateRouting()
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	for _, hook := range c.conf.Hooks {
+		err = hook.Validate()
+		if err != nil {
+			c.Ui.Error("Configuration failure: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+	}
+
 	c.dl, err = storage.NewPersistentDownloader(c.conf)
 	if err != nil {
 		c.Ui.Error("Error configuring downloader: " + err.Error())
@@ -128,7 +182,10 @@ func (c *Daemon) stop() {
 	c.dl.Stop()
 }
 
-func overwriteFile(name string, t time.Time) bool {
+// Returns true if the local file should be replaced with file. Files
+// with a content hash are compared by hash, so identical re-uploads and
+// skewed clocks don't matter. Others are compared by modification time.
+func (c *Daemon) overwriteFile(name string, file *storage.FileInfo) bool {
 	st, err := os.Stat(name)
 
 	if err != nil {
@@ -144,12 +201,30 @@ func overwriteFile(name string, t time.Time) bool {
 		return false
 	}
 
+	if file.Sha256 != "" {
+		sum, err := c.localSha256(name, st)
+		if err == nil {
+			if sum == file.Sha256 {
+				log.WithFields(log.Fields{
+					"name":   name,
+					"sha256": sum,
+				}).Debug("local file matches origin file, skipping.")
+				return false
+			}
+			return true
+		}
+
+		log.WithFields(log.Fields{
+			"name": name,
+			"err":  err,
+		}).Warn("error hashing local file, comparing modified times")
+	}
+
 	// unfortunately, some filesystems store better resolution,
 	// and some backends store shitty time resolutions...
 	// so we round to 1 second.
-	// TODO: expose hashing if the origin can export a hash at low cost.
 	localTime := st.ModTime().Truncate(time.Second)
-	originTime := t.Truncate(time.Second)
+	originTime := file.LastModified.Truncate(time.Second)
 
 	if localTime.After(originTime) || localTime.Equal(originTime) {
 		log.WithFields(log.Fields{
@@ -163,33 +238,105 @@ func overwriteFile(name string, t time.Time) bool {
 	return true
 }
 
-func (c *Daemon) updateFiles() error {
-	ec, err := crypto.NewFromConf(c.conf)
+// Returns the SHA-256 of a local file, from the cache if it hasn't changed.
+func (c *Daemon) localSha256(name string, st os.FileInfo) (string, error) {
+	lh, ok := c.hashes[name]
+	if ok && lh.size == st.Size() && lh.modTime.Equal(st.ModTime()) {
+		return lh.sum, nil
+	}
+
+	f, err := os.Open(name)
 	if err != nil {
-		return err
+		return "", err
+	}
+	defer f.Close()
+
+	sum, err := storage.ContentSha256(f)
+	if err != nil {
+		return "", err
 	}
 
+	c.hashes[name] = &localHash{
+		size:    st.Size(),
+		modTime: st.ModTime(),
+		sum:     sum,
+	}
+
+	return sum, nil
+}
+
+func (c *Daemon) updateFiles() error {
 	st, err := storage.NewFromConf(c.conf)
 	if err != nil {
 		return err
 	}
 
-	workDir, err := homedir.Expand(*c.conf.OutputDir)
+	ec, err := crypto.NewFromConf(c.conf)
 	if err != nil {
 		return err
 	}
 
-	files, err := st.List(ec)
-
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
 
+	files, err := c.listFiles(ec, st)
+	if err != nil {
+		// try again on the next change.
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to list files.")
+		return nil
+	}
+
+	// each release directory has its own pin.
+	pins := make(map[string]string)
 	count := 0
 
 	for _, file := range files {
-		fullname := path.Join(workDir, file.Name)
+		if !c.conf.Wanted(file.Name) {
+			log.WithFields(log.Fields{
+				"file": file.Name,
+			}).Debug("file is not included, skipping.")
+			continue
+		}
+
+		outputDir, err := homedir.Expand(c.conf.OutputDirFor(file.Name))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":  file.Name,
+				"error": err,
+			}).Error("Home directory expansion failed")
+			continue
+		}
+
+		fullname := path.Join(outputDir, file.Name)
+
+		if release.Matches(c.conf.Release, file.Name) {
+			pin, ok := pins[outputDir]
+			if !ok {
+				pin, err = release.Pinned(c.conf.Release, outputDir)
+				if err != nil {
+					// an unreadable pin could let a bad release through.
+					log.WithFields(log.Fields{
+						"file":    file.Name,
+						"workdir": outputDir,
+						"error":   err,
+					}).Error("Failed to read release pin.")
+					continue
+				}
+				pins[outputDir] = pin
+			}
+
+			if pin != "" && release.Version(file.Name) != pin {
+				log.WithFields(log.Fields{
+					"file": file.Name,
+					"pin":  pin,
+				}).Debug("release is not the pinned version, skipping.")
+				continue
+			}
+		}
 
-		if overwriteFile(fullname, file.LastModified) == false {
+		if c.overwriteFile(fullname, file) == false {
 			continue
 		}
 
@@ -204,6 +351,10 @@ func (c *Daemon) updateFiles() error {
 			}
 		}
 
+		if c.hasHooks(file.Name) {
+			c.previous[file.Name] = c.previousVersion(fullname)
+		}
+
 		log.WithFields(log.Fields{
 			"file": file.Name,
 		}).Info("Starting download of file")
@@ -220,8 +371,85 @@ func (c *Daemon) updateFiles() error {
 	return nil
 }
 
+// Lists files in every subscribed channel. A file in several channels
+// is downloaded from the one where it is newest.
+func (c *Daemon) listFiles(ec crypto.Cryptor, st storage.Storage) ([]*storage.FileInfo, error) {
+	positions := make(map[string]int)
+	rv := make([]*storage.FileInfo, 0)
+
+	for _, channel := range c.conf.SubscribedChannels() {
+		files, err := c.listChannel(ec, st, channel)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			i, ok := positions[file.Name]
+			if !ok {
+				positions[file.Name] = len(rv)
+				rv = append(rv, file)
+			} else if file.LastModified.After(rv[i].LastModified) {
+				rv[i] = file
+			}
+		}
+	}
+
+	return rv, nil
+}
+
+// Uploaders on different machines can drop each other's entry from the
+// index, so channels are also listed this often.
+const indexListInterval = time.Hour
+
+// Lists files from the index of channel, or lists the whole channel if
+// it doesn't have an index yet. An index that fails to verify is an
+// error, not a reason to list instead. An index older than one already
+// seen is refused, so a replayed index can't roll servers back. At
+// start and then every indexListInterval, files missing from the index
+// are added from a listing.
+func (c *Daemon) listChannel(ec crypto.Cryptor, st storage.Storage, channel string) ([]*storage.FileInfo, error) {
+	idx, err := storage.ReadChannelIndex(c.conf, ec, st, channel)
+	if err == storage.ErrNoIndex {
+		log.WithFields(log.Fields{
+			"channel": channel,
+		}).Warn("No bucket index, listing files instead.")
+		return st.ListChannel(ec, channel)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if idx.Seq < c.indexSeqs[channel] {
+		log.WithFields(log.Fields{
+			"channel":  channel,
+			"seq":      idx.Seq,
+			"seen_seq": c.indexSeqs[channel],
+		}).Error("Ignoring bucket index older than one already seen.")
+		return nil, nil
+	}
+
+	c.indexSeqs[channel] = idx.Seq
+
+	files := idx.FileInfos(ec)
+	if time.Since(c.indexListed[channel]) < indexListInterval {
+		return files, nil
+	}
+
+	listed, err := st.ListChannel(ec, channel)
+	if err != nil {
+		return nil, err
+	}
+	c.indexListed[channel] = time.Now()
+
+	return storage.MergeListing(files, listed), nil
+}
+
 func (c *Daemon) mainLoop() {
 	c.files = make(map[string]*storage.FileDownload)
+	c.hashes = make(map[string]*localHash)
+	c.previous = make(map[string]*localHash)
+	c.indexSeqs = make(map[string]uint64)
+	c.indexListed = make(map[string]time.Time)
 	c.donefiles = make(chan *storage.FileDownload)
 	c.dq = storage.NewDownloadQueue(c.dl)
 
@@ -258,6 +486,9 @@ func (c *Daemon) mainLoop() {
 				"file":          df.FileInfo.Name,
 				"transfer_rate": df.TransferRate(),
 			}).Info("Completed file")
+			if df.Error == nil && c.hasHooks(df.FileInfo.Name) {
+				go c.runHooks(df)
+			}
 		case <-nchan:
 			log.Info("Checking for new files")
 			go func() {
@@ -0,0 +1,159 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+	"github.com/pquerna/distsync/storage"
+
+	"errors"
+	"flag"
+	"strings"
+)
+
+type Delete struct {
+	Ui   cli.Ui
+	conf *common.Conf
+}
+
+func (c *Delete) Help() string {
+	helpText := `
+Usage: distsync delete [options] name ...
+
+  Deletes files from the configured storage area, and notifies
+  servers of the change. Servers keep their local copies.
+
+Options:
+
+  -conf=~/.distsync         Read specific configuration file.
+  -channel=default          Delete files from this channel.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Delete) Run(args []string) int {
+	var confFile string
+	var channel string
+
+	cmdFlags := flag.NewFlagSet("delete", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&confFile, "conf", "~/.distsync", "Configuration path.")
+	cmdFlags.StringVar(&channel, "channel", common.DefaultChannel, "Channel to delete from.")
+
+	err := cmdFlags.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	err = common.ValidateChannel(channel)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	names := cmdFlags.Args()
+	if len(names) == 0 {
+		c.Ui.Error("At least one file to delete must be specified.")
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.conf, err = common.ConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	s, err := storage.NewFromConf(c.conf)
+	if err != nil {
+		c.Ui.Error("Storage failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	ec, err := crypto.NewFromConf(c.conf)
+	if err != nil {
+		c.Ui.Error("Crypto failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	files, err := s.ListChannel(ec, channel)
+	if err != nil {
+		c.Ui.Error("Error listing files: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	byName := make(map[string]*storage.FileInfo, len(files))
+	for _, file := range files {
+		byName[file.Name] = file
+	}
+
+	// nothing is deleted unless every file exists.
+	doomed := make([]*storage.FileInfo, 0, len(names))
+	for _, name := range names {
+		file, ok := byName[name]
+		if !ok {
+			c.Ui.Error("File not found: " + name)
+			c.Ui.Error("")
+			return 1
+		}
+		doomed = append(doomed, file)
+	}
+
+	err = deleteFiles(c.Ui, s, doomed)
+	if err != nil {
+		c.Ui.Error("Delete failed: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	return 0
+}
+
+// Deletes files from s, with the older copies their listing hides,
+// stopping at the first failure. Older copies go first, so a failure
+// never brings an older version back.
+func deleteFiles(ui cli.Ui, s storage.Storage, files []*storage.FileInfo) error {
+	d, ok := s.(storage.Deleter)
+	if !ok {
+		return errors.New("The storage backend does not support deleting files.")
+	}
+
+	for _, file := range files {
+		ui.Info("Deleting " + file.Name)
+		names := append(append([]string{}, file.Older...), file.RemoteName)
+		for _, name := range names {
+			err := d.Delete(name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Delete) Synopsis() string {
+	return "Delete files from distsync"
+}
@@ -37,6 +37,7 @@ type Download struct {
 	dq        *storage.DownloadQueue
 	donefiles chan *storage.FileDownload
 	conf      *common.Conf
+	channel   string
 }
 
 func (c *Download) Help() string {
@@ -48,6 +49,7 @@ Usage: distsync download [options] file
 Options:
 
   -conf=~/.distsyncd         Read specific configuration file.
+  -channel=default           Download files from this channel.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -79,12 +81,20 @@ func (c *Download) Run(args []string) int {
 	cmdFlags := flag.NewFlagSet("download", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.StringVar(&confFile, "conf", "~/.distsyncd", "Configuration path.")
+	cmdFlags.StringVar(&c.channel, "channel", common.DefaultChannel, "Channel to download from.")
 
 	err := cmdFlags.Parse(args)
 	if err != nil {
 		return 1
 	}
 
+	err = common.ValidateChannel(c.channel)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
 	c.conf, err = common.ConfFromFile(confFile)
 	if err != nil {
 		c.Ui.Error("Configuration failure: " + err.Error())
@@ -193,17 +203,17 @@ func (c *Download) Run(args []string) int {
 }
 
 func (c *Download) getFilesToDownload(fnames []string) ([]*storage.FileInfo, error) {
-	ec, err := crypto.NewFromConf(c.conf)
+	s, err := storage.NewFromConf(c.conf)
 	if err != nil {
 		return nil, err
 	}
 
-	s, err := storage.NewFromConf(c.conf)
+	ec, err := crypto.NewFromConf(c.conf)
 	if err != nil {
 		return nil, err
 	}
 
-	storedFiles, err := s.List(ec)
+	storedFiles, err := s.ListChannel(ec, c.channel)
 	if err != nil {
 		return nil, err
 	}
@@ -23,6 +23,11 @@ import (
 
 func Factory(ui cli.Ui) map[string]cli.CommandFactory {
 	x := map[string]cli.CommandFactory{
+		"delete": func() (cli.Command, error) {
+			return &Delete{
+				Ui: ui,
+			}, nil
+		},
 		"download": func() (cli.Command, error) {
 			return &Download{
 				Ui: ui,
@@ -33,6 +38,26 @@ func Factory(ui cli.Ui) map[string]cli.CommandFactory {
 				Ui: ui,
 			}, nil
 		},
+		"list": func() (cli.Command, error) {
+			return &List{
+				Ui: ui,
+			}, nil
+		},
+		"pin": func() (cli.Command, error) {
+			return &Pin{
+				Ui: ui,
+			}, nil
+		},
+		"promote": func() (cli.Command, error) {
+			return &Promote{
+				Ui: ui,
+			}, nil
+		},
+		"prune": func() (cli.Command, error) {
+			return &Prune{
+				Ui: ui,
+			}, nil
+		},
 		"upload": func() (cli.Command, error) {
 			return &Upload{
 				Ui: ui,
@@ -43,6 +68,16 @@ func Factory(ui cli.Ui) map[string]cli.CommandFactory {
 				Ui: ui,
 			}, nil
 		},
+		"rollback": func() (cli.Command, error) {
+			return &Rollback{
+				Ui: ui,
+			}, nil
+		},
+		"rotate-key": func() (cli.Command, error) {
+			return &RotateKey{
+				Ui: ui,
+			}, nil
+		},
 	}
 	return x
 }
@@ -0,0 +1,212 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package command
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/storage"
+
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns true if any hook runs for the file name.
+func (c *Daemon) hasHooks(name string) bool {
+	for _, hook := range c.conf.Hooks {
+		if hook.Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the local file a download is about to replace, or nil if
+// there is none. Called with c.mtx held.
+func (c *Daemon) previousVersion(fullname string) *localHash {
+	st, err := os.Stat(fullname)
+	if err != nil {
+		return nil
+	}
+
+	sum, err := c.localSha256(fullname, st)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name": fullname,
+			"err":  err,
+		}).Warn("error hashing local file for hooks")
+	}
+
+	return &localHash{
+		size:    st.Size(),
+		modTime: st.ModTime(),
+		sum:     sum,
+	}
+}
+
+// Runs the hooks matching a downloaded file, in the order they are
+// configured. The file has already been renamed into place.
+func (c *Daemon) runHooks(df *storage.FileDownload) {
+	c.hookMtx.Lock()
+	defer c.hookMtx.Unlock()
+
+	name := df.FileInfo.Name
+	outputDir := c.conf.OutputDirFor(name)
+
+	workDir, err := homedir.Expand(outputDir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  outputDir,
+		}).Error("Home directory expansion failed")
+		return
+	}
+
+	fullname := path.Join(workDir, name)
+
+	c.mtx.Lock()
+	old := c.previous[name]
+	delete(c.previous, name)
+	sum := df.FileInfo.Sha256
+	if sum == "" {
+		st, err := os.Stat(fullname)
+		if err == nil {
+			sum, _ = c.localSha256(fullname, st)
+		}
+	}
+	c.mtx.Unlock()
+
+	env := []string{
+		"DISTSYNC_NAME=" + name,
+		"DISTSYNC_PATH=" + fullname,
+		"DISTSYNC_SHA256=" + sum,
+		"DISTSYNC_SIZE=" + strconv.FormatInt(df.FileInfo.Length, 10),
+		"DISTSYNC_LAST_MODIFIED=" + df.FileInfo.LastModified.UTC().Format(time.RFC3339),
+	}
+	if old != nil {
+		env = append(env,
+			"DISTSYNC_OLD_SHA256="+old.sum,
+			"DISTSYNC_OLD_LAST_MODIFIED="+old.modTime.UTC().Format(time.RFC3339))
+	}
+
+	for _, hook := range c.conf.Hooks {
+		if !hook.Matches(name) {
+			continue
+		}
+
+		err := runHook(hook, workDir, name, env)
+		if err != nil && hook.OnFailure == "stop" {
+			log.WithFields(log.Fields{
+				"file": name,
+				"hook": hook.Command,
+			}).Warn("Skipping remaining hooks for file")
+			return
+		}
+	}
+}
+
+// Runs hook, retrying it if configured to, and logs its output.
+func runHook(hook *common.Hook, dir string, name string, env []string) error {
+	var err error
+	for attempt := 1; attempt <= hook.Attempts(); attempt++ {
+		start := time.Now()
+
+		out := &hookOutput{
+			fields: log.Fields{
+				"file":    name,
+				"hook":    hook.Command,
+				"attempt": attempt,
+			},
+		}
+		err = hook.Run(dir, env, out)
+		out.flush()
+
+		fields := log.Fields{
+			"file":     name,
+			"hook":     hook.Command,
+			"attempt":  attempt,
+			"duration": time.Since(start),
+		}
+
+		if err == nil {
+			log.WithFields(fields).Info("Hook finished")
+			return nil
+		}
+
+		fields["error"] = err
+		log.WithFields(fields).Error("Hook failed")
+	}
+
+	return err
+}
+
+// Lines of hook output longer than this are logged in pieces.
+const maxHookLine = 4096
+
+// hookOutput logs the output of a hook a line at a time as it is
+// written, so a noisy command isn't held in memory.
+type hookOutput struct {
+	fields log.Fields
+	line   []byte
+}
+
+func (ho *hookOutput) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			i = len(p)
+		}
+
+		ho.line = append(ho.line, p[:i]...)
+		if i < len(p) || len(ho.line) >= maxHookLine {
+			ho.flush()
+		}
+
+		if i < len(p) {
+			i++
+		}
+		p = p[i:]
+	}
+	return n, nil
+}
+
+// Logs the rest of the output, which didn't end with a newline.
+func (ho *hookOutput) flush() {
+	for len(ho.line) > 0 {
+		n := len(ho.line)
+		if n > maxHookLine {
+			n = maxHookLine
+		}
+
+		line := strings.TrimRight(string(ho.line[:n]), "\r")
+		if line != "" {
+			fields := log.Fields{"output": line}
+			for k, v := range ho.fields {
+				fields[k] = v
+			}
+			log.WithFields(fields).Info("Hook output")
+		}
+		ho.line = ho.line[n:]
+	}
+}
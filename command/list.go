@@ -0,0 +1,217 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package command
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/mitchellh/cli"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+	"github.com/pquerna/distsync/storage"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type List struct {
+	Ui   cli.Ui
+	conf *common.Conf
+}
+
+func (c *List) Help() string {
+	helpText := `
+Usage: distsync list [options] [pattern ...]
+
+  Lists files in the configured storage area, with their decrypted
+  names. Patterns are shell globs, like 'app-*.tar', and only
+  matching files are listed.
+
+Options:
+
+  -conf=~/.distsync         Read specific configuration file.
+  -channel=default          List files in this channel.
+  -json                     Print the list as JSON, for scripts.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *List) Run(args []string) int {
+	var confFile string
+	var channel string
+	var asJson bool
+
+	cmdFlags := flag.NewFlagSet("list", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&confFile, "conf", "~/.distsync", "Configuration path.")
+	cmdFlags.StringVar(&channel, "channel", common.DefaultChannel, "Channel to list.")
+	cmdFlags.BoolVar(&asJson, "json", false, "Print JSON.")
+
+	err := cmdFlags.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	err = common.ValidateChannel(channel)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.conf, err = common.ConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	patterns := cmdFlags.Args()
+	err = checkPatterns(patterns)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	files, err := c.listFiles(channel, patterns)
+	if err != nil {
+		c.Ui.Error("Error listing files: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if asJson {
+		data, err := json.MarshalIndent(files, "", "  ")
+		if err != nil {
+			c.Ui.Error("Error encoding JSON: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+		c.Ui.Output(string(data))
+		return 0
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tUPLOADED\tSHA256")
+	for _, file := range files {
+		sum := file.Sha256
+		if sum == "" {
+			sum = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", file.Name, humanize.Bytes(uint64(file.Length)),
+			file.LastModified.UTC().Format(time.RFC3339), sum)
+	}
+	tw.Flush()
+
+	c.Ui.Output(strings.TrimSpace(buf.String()))
+	return 0
+}
+
+// Lists the files in channel matching any of patterns.
+func (c *List) listFiles(channel string, patterns []string) ([]*storage.FileInfo, error) {
+	s, err := storage.NewFromConf(c.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ec, err := crypto.NewFromConf(c.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return matchingFiles(c.conf, ec, s, channel, patterns)
+}
+
+// Lists channel, with content hashes from its index where it has them,
+// and returns the files matching any of patterns, by name.
+func matchingFiles(conf *common.Conf, ec crypto.Cryptor, s storage.Storage, channel string, patterns []string) ([]*storage.FileInfo, error) {
+	files, err := s.ListChannel(ec, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	idx, err := storage.ReadChannelIndex(conf, ec, s, channel)
+	if err == nil {
+		for _, fi := range idx.FileInfos(ec) {
+			hashes[fi.RemoteName] = fi.Sha256
+		}
+	} else if err != storage.ErrNoIndex {
+		return nil, err
+	}
+
+	rv := make([]*storage.FileInfo, 0, len(files))
+	for _, file := range files {
+		if !matchAny(patterns, file.Name) {
+			continue
+		}
+		file.Sha256 = hashes[file.RemoteName]
+		rv = append(rv, file)
+	}
+
+	sort.Sort(fileInfosByName(rv))
+
+	return rv, nil
+}
+
+// Returns an error for the first malformed pattern.
+func checkPatterns(patterns []string) error {
+	for _, p := range patterns {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return errors.New("Invalid pattern '" + p + "': " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Returns true if name matches one of patterns, or there are none.
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		ok, _ := path.Match(p, name)
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+type fileInfosByName []*storage.FileInfo
+
+func (f fileInfosByName) Len() int           { return len(f) }
+func (f fileInfosByName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f fileInfosByName) Less(i, j int) bool { return f[i].Name < f[j].Name }
+
+func (c *List) Synopsis() string {
+	return "List files in distsync"
+}
@@ -0,0 +1,197 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/release"
+
+	"flag"
+	"strings"
+)
+
+type Pin struct {
+	Ui   cli.Ui
+	conf *common.Conf
+}
+
+func (c *Pin) Help() string {
+	helpText := `
+Usage: distsync pin [options] [version]
+
+  Pins this server to a release version, like app-1 for
+  app-1.tar.gz. The daemon ignores uploads of other versions
+  matching the Release Pattern, and only activates releases of
+  the pinned version. An installed release of the version is
+  activated right away.
+
+  Without a version, prints the version this server is pinned to.
+  Groups of servers can be pinned with Pin in the Release section
+  of their configuration file instead.
+
+  Routed releases are pinned in the OutputDir of their route. When
+  several directories have releases installed, -clear needs a
+  version, and the pin of each directory is printed.
+
+Options:
+
+  -conf=~/.distsyncd         Read specific configuration file.
+  -clear                     Remove the pin set by pin or rollback.
+                             A Pin in the configuration file stays.
+                             Takes a version to pick its directory.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Pin) Run(args []string) int {
+	var confFile string
+	var clear bool
+
+	cmdFlags := flag.NewFlagSet("pin", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&confFile, "conf", "~/.distsyncd", "Configuration path.")
+	cmdFlags.BoolVar(&clear, "clear", false, "Remove the pin.")
+
+	err := cmdFlags.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	if len(cmdFlags.Args()) > 1 {
+		c.Ui.Error("pin takes one version.")
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.conf, err = common.ConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if !clear && len(cmdFlags.Args()) == 0 {
+		return c.printPins()
+	}
+
+	workDir, err := releaseWorkDir(c.conf, cmdFlags.Arg(0))
+	if err != nil {
+		c.Ui.Error("Error: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if clear {
+		err = release.ClearPin(workDir)
+		if err != nil {
+			c.Ui.Error("Error removing pin: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+		c.printPin(workDir)
+		c.Ui.Info("Newer uploads are downloaded on the next change, or when the daemon restarts.")
+		return 0
+	}
+
+	version := cmdFlags.Arg(0)
+	err = release.SetPin(workDir, version)
+	if err != nil {
+		c.Ui.Error("Error pinning release: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.Ui.Info("Pinned to " + version + ".")
+
+	releases, err := release.List(workDir)
+	if err != nil {
+		c.Ui.Error("Error listing releases: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	r := release.Find(releases, version)
+	if r == nil || r.Version != version {
+		c.Ui.Info("No release of " + version + " is installed, the daemon installs it when it is uploaded.")
+		return 0
+	}
+
+	if !r.Current {
+		err = release.Activate(workDir, r.Name)
+		if err != nil {
+			c.Ui.Error("Error activating release: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+		c.Ui.Info("Activated " + r.Name + ".")
+	}
+
+	return 0
+}
+
+// Prints the pin of each directory with installed releases.
+func (c *Pin) printPins() int {
+	if c.conf.OutputDir == nil {
+		c.Ui.Error("Error: must set OutputDir in configuration file.")
+		c.Ui.Error("")
+		return 1
+	}
+
+	dirs, err := installedReleaseDirs(c.conf)
+	if err != nil {
+		c.Ui.Error("Error listing releases: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if len(dirs) <= 1 {
+		workDir, err := releaseWorkDir(c.conf, "")
+		if err != nil {
+			c.Ui.Error("Error: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+		c.printPin(workDir)
+		return 0
+	}
+
+	for _, dir := range dirs {
+		c.Ui.Output(dir + ":")
+		c.printPin(dir)
+	}
+	return 0
+}
+
+func (c *Pin) printPin(workDir string) {
+	pin, err := release.Pinned(c.conf.Release, workDir)
+	if err != nil {
+		c.Ui.Error("Error reading pin: " + err.Error())
+		return
+	}
+
+	if pin == "" {
+		c.Ui.Output("Not pinned.")
+	} else {
+		c.Ui.Output("Pinned to " + pin + ".")
+	}
+}
+
+func (c *Pin) Synopsis() string {
+	return "Pin the server to a release version"
+}
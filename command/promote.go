@@ -0,0 +1,150 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+	"github.com/pquerna/distsync/storage"
+
+	"flag"
+	"strings"
+)
+
+type Promote struct {
+	Ui   cli.Ui
+	conf *common.Conf
+}
+
+func (c *Promote) Help() string {
+	helpText := `
+Usage: distsync promote [options] name from to
+
+  Copies a file from one channel to another inside the storage
+  area, without uploading it again, and notifies servers subscribed
+  to the destination channel. A file with the same name in the
+  destination channel is replaced.
+
+  The channel of files uploaded without -channel is 'default'.
+
+Options:
+
+  -conf=~/.distsync         Read specific configuration file.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Promote) Run(args []string) int {
+	var confFile string
+
+	cmdFlags := flag.NewFlagSet("promote", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&confFile, "conf", "~/.distsync", "Configuration path.")
+
+	err := cmdFlags.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	if len(cmdFlags.Args()) != 3 {
+		c.Ui.Error("promote takes a file name, and the channels to copy it from and to.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	name, from, to := cmdFlags.Arg(0), cmdFlags.Arg(1), cmdFlags.Arg(2)
+
+	for _, channel := range []string{from, to} {
+		err = common.ValidateChannel(channel)
+		if err != nil {
+			c.Ui.Error(err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+	}
+
+	if from == to {
+		c.Ui.Error("The source and destination channels are the same.")
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.conf, err = common.ConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	s, err := storage.NewFromConf(c.conf)
+	if err != nil {
+		c.Ui.Error("Storage failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	ec, err := crypto.NewFromConf(c.conf)
+	if err != nil {
+		c.Ui.Error("Crypto failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	p, ok := s.(storage.Promoter)
+	if !ok {
+		c.Ui.Error("The " + c.conf.Storage + " storage backend does not support promoting files.")
+		c.Ui.Error("")
+		return 1
+	}
+
+	files, err := s.ListChannel(ec, from)
+	if err != nil {
+		c.Ui.Error("Error listing files: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	var file *storage.FileInfo
+	for _, f := range files {
+		if f.Name == name {
+			file = f
+		}
+	}
+
+	if file == nil {
+		c.Ui.Error("File not found in channel '" + from + "': " + name)
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.Ui.Info("Promoting " + name + " from " + from + " to " + to)
+
+	err = p.Promote(file.RemoteName, to)
+	if err != nil {
+		c.Ui.Error("Promote failed: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	return 0
+}
+
+func (c *Promote) Synopsis() string {
+	return "Copy a file between channels"
+}
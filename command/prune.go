@@ -0,0 +1,250 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+	"github.com/pquerna/distsync/storage"
+
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Prune struct {
+	Ui   cli.Ui
+	conf *common.Conf
+}
+
+func (c *Prune) Help() string {
+	helpText := `
+Usage: distsync prune [options] [pattern ...]
+
+  Deletes old files from the configured storage area, and notifies
+  servers of the change. Patterns are shell globs, like 'app-*.tar',
+  and each one is a group of versions of the same file. Without
+  patterns, all files are one group.
+
+  A file is deleted when it is not one of the newest -keep files of
+  any group it matches, and is older than -older-than. At least one
+  of the two must be given.
+
+  Afterwards, chunks of deduplicated files that no manifest in any
+  channel refers to are deleted, once they are a day old.
+
+Options:
+
+  -conf=~/.distsync         Read specific configuration file.
+  -channel=default          Prune files in this channel.
+  -keep=N                   Keep the newest N files of each pattern.
+  -older-than=30d           Only delete files older than this, in
+                            days (30d) or as a duration (12h).
+  -dry-run                  Print the files that would be deleted.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Prune) Run(args []string) int {
+	var confFile string
+	var channel string
+	var keep int
+	var olderThan string
+	var dryRun bool
+
+	cmdFlags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&confFile, "conf", "~/.distsync", "Configuration path.")
+	cmdFlags.StringVar(&channel, "channel", common.DefaultChannel, "Channel to prune.")
+	cmdFlags.IntVar(&keep, "keep", 0, "Files to keep per pattern.")
+	cmdFlags.StringVar(&olderThan, "older-than", "", "Minimum age of deleted files.")
+	cmdFlags.BoolVar(&dryRun, "dry-run", false, "Don't delete anything.")
+
+	err := cmdFlags.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	err = common.ValidateChannel(channel)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if keep < 0 || (keep == 0 && olderThan == "") {
+		c.Ui.Error("prune needs -keep, -older-than, or both.")
+		c.Ui.Error("")
+		return 1
+	}
+
+	var cutoff time.Time
+	if olderThan != "" {
+		age, err := parseAge(olderThan)
+		if err != nil {
+			c.Ui.Error(err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	patterns := cmdFlags.Args()
+	err = checkPatterns(patterns)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.conf, err = common.ConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	s, err := storage.NewFromConf(c.conf)
+	if err != nil {
+		c.Ui.Error("Storage failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	ec, err := crypto.NewFromConf(c.conf)
+	if err != nil {
+		c.Ui.Error("Crypto failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	files, err := matchingFiles(c.conf, ec, s, channel, patterns)
+	if err != nil {
+		c.Ui.Error("Error listing files: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	doomed := pruneFiles(files, patterns, keep, cutoff)
+	if len(doomed) == 0 {
+		c.Ui.Info("Nothing to prune.")
+	} else if dryRun {
+		for _, file := range doomed {
+			c.Ui.Info("Would delete " + file.Name)
+		}
+	} else {
+		err = deleteFiles(c.Ui, s, doomed)
+		if err != nil {
+			c.Ui.Error("Prune failed: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+	}
+
+	// a dry run still counts the chunks of the files it would delete as
+	// referenced.
+	n, err := storage.CollectChunks(c.conf, ec, s, dryRun)
+	if err != nil {
+		c.Ui.Error("Collecting chunks failed: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if n > 0 {
+		if dryRun {
+			c.Ui.Info(fmt.Sprintf("Would delete %d unreferenced chunks.", n))
+		} else {
+			c.Ui.Info(fmt.Sprintf("Deleted %d unreferenced chunks.", n))
+		}
+	}
+
+	return 0
+}
+
+// Returns the files that are not among the newest keep files matching
+// any of patterns, and were modified before cutoff. A keep of zero or a
+// zero cutoff don't limit what is returned.
+func pruneFiles(files []*storage.FileInfo, patterns []string, keep int, cutoff time.Time) []*storage.FileInfo {
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+
+	kept := make(map[*storage.FileInfo]bool)
+	if keep > 0 {
+		for _, p := range patterns {
+			group := make([]*storage.FileInfo, 0)
+			for _, file := range files {
+				if matchAny([]string{p}, file.Name) {
+					group = append(group, file)
+				}
+			}
+
+			sort.Sort(sort.Reverse(fileInfosByTime(group)))
+			for i := 0; i < keep && i < len(group); i++ {
+				kept[group[i]] = true
+			}
+		}
+	}
+
+	rv := make([]*storage.FileInfo, 0)
+	for _, file := range files {
+		if kept[file] || !matchAny(patterns, file.Name) {
+			continue
+		}
+
+		if !cutoff.IsZero() && !file.LastModified.Before(cutoff) {
+			continue
+		}
+
+		rv = append(rv, file)
+	}
+
+	return rv
+}
+
+// Parses an age in days like "30d", or a duration like "12h".
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	} else {
+		age, err := time.ParseDuration(s)
+		if err == nil && age >= 0 {
+			return age, nil
+		}
+	}
+
+	return 0, errors.New("Invalid age '" + s + "', expected days like 30d or a duration like 12h.")
+}
+
+type fileInfosByTime []*storage.FileInfo
+
+func (f fileInfosByTime) Len() int           { return len(f) }
+func (f fileInfosByTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f fileInfosByTime) Less(i, j int) bool { return f[i].LastModified.Before(f[j].LastModified) }
+
+func (c *Prune) Synopsis() string {
+	return "Delete old files from distsync"
+}
@@ -0,0 +1,105 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package command
+
+import (
+	"github.com/pquerna/distsync/storage"
+
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneFiles(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	// app-N and web-N are N days old.
+	files := make([]*storage.FileInfo, 0)
+	for _, name := range []string{"app-1", "app-2", "app-3", "app-4", "web-0", "web-5"} {
+		days := time.Duration(name[len(name)-1]-'0') * day
+		files = append(files, &storage.FileInfo{Name: name, LastModified: now.Add(-days)})
+	}
+
+	for _, tc := range []struct {
+		patterns  []string
+		keep      int
+		olderThan time.Duration
+		expected  string
+	}{
+		// keep only.
+		{[]string{"app-*"}, 2, 0, "app-3 app-4"},
+		{[]string{"app-*"}, 4, 0, ""},
+		{[]string{"app-*"}, 10, 0, ""},
+		// age only.
+		{[]string{"app-*"}, 0, 2*day + time.Hour, "app-3 app-4"},
+		{[]string{"app-*"}, 0, 10 * day, ""},
+		// both: kept files and new files are never deleted.
+		{[]string{"app-*"}, 1, 3*day + time.Hour, "app-4"},
+		{[]string{"app-*"}, 3, day + time.Hour, "app-4"},
+		// no patterns is one group of every file.
+		{nil, 2, 0, "app-2 app-3 app-4 web-5"},
+		// each pattern is its own group.
+		{[]string{"app-*", "web-*"}, 1, 0, "app-2 app-3 app-4 web-5"},
+		// a file kept by any overlapping group is kept.
+		{[]string{"app-*", "*-4"}, 1, 0, "app-2 app-3"},
+		{[]string{"*", "web-*"}, 1, 0, "app-1 app-2 app-3 app-4 web-5"},
+		// files matching no pattern are never deleted.
+		{[]string{"db-*"}, 0, day, ""},
+	} {
+		var cutoff time.Time
+		if tc.olderThan != 0 {
+			cutoff = now.Add(-tc.olderThan)
+		}
+
+		names := make([]string, 0)
+		for _, file := range pruneFiles(files, tc.patterns, tc.keep, cutoff) {
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+
+		if strings.Join(names, " ") != tc.expected {
+			t.Fatalf("patterns %v keep %d older than %v: expected %q, got %q",
+				tc.patterns, tc.keep, tc.olderThan, tc.expected, strings.Join(names, " "))
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		age      string
+		expected time.Duration
+	}{
+		{"30d", 30 * 24 * time.Hour},
+		{"0d", 0},
+		{"12h", 12 * time.Hour},
+		{"90m", 90 * time.Minute},
+	} {
+		age, err := parseAge(tc.age)
+		if err != nil || age != tc.expected {
+			t.Fatalf("%s: expected %v, got %v (%v)", tc.age, tc.expected, age, err)
+		}
+	}
+
+	for _, age := range []string{"", "d", "30x", "-1d", "-5h", "1.5d", "thirty"} {
+		_, err := parseAge(age)
+		if err == nil {
+			t.Fatalf("expected error for %q", age)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package command
+
+import (
+	"github.com/mitchellh/cli"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/release"
+
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type Rollback struct {
+	Ui   cli.Ui
+	conf *common.Conf
+}
+
+func (c *Rollback) Help() string {
+	helpText := `
+Usage: distsync rollback [options] [release]
+
+  Activates an earlier release in the output directory, and pins
+  this server to its version, so the daemon ignores newer uploads
+  until 'distsync pin -clear' is run. Hooks are not run.
+
+  The release is a release directory name, or a version like
+  app-1 for the newest release of app-1.tar.gz. Without one, the
+  release installed before the current one is activated. Routed
+  releases are in the OutputDir of their route, a release must be
+  named when several directories have releases installed.
+
+Options:
+
+  -conf=~/.distsyncd         Read specific configuration file.
+  -list                      List installed releases.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *Rollback) Run(args []string) int {
+	var confFile string
+	var list bool
+
+	cmdFlags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&confFile, "conf", "~/.distsyncd", "Configuration path.")
+	cmdFlags.BoolVar(&list, "list", false, "List releases.")
+
+	err := cmdFlags.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	if len(cmdFlags.Args()) > 1 {
+		c.Ui.Error("rollback takes at most one release.")
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.conf, err = common.ConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	workDir, err := releaseWorkDir(c.conf, cmdFlags.Arg(0))
+	if err != nil {
+		c.Ui.Error("Error: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	releases, err := release.List(workDir)
+	if err != nil {
+		c.Ui.Error("Error listing releases: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if list {
+		c.listReleases(workDir, releases)
+		return 0
+	}
+
+	var target *release.Release
+	if len(cmdFlags.Args()) == 1 {
+		target = release.Find(releases, cmdFlags.Arg(0))
+		if target == nil {
+			c.Ui.Error("Release not found: " + cmdFlags.Arg(0))
+			c.Ui.Error("")
+			return 1
+		}
+	} else {
+		target = previousRelease(releases)
+		if target == nil {
+			c.Ui.Error("No earlier release to roll back to.")
+			c.Ui.Error("")
+			return 1
+		}
+	}
+
+	// pinned first, so the daemon doesn't activate another release
+	// in between.
+	err = release.SetPin(workDir, target.Version)
+	if err != nil {
+		c.Ui.Error("Error pinning release: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	err = release.Activate(workDir, target.Name)
+	if err != nil {
+		c.Ui.Error("Error activating release: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.Ui.Info("Activated " + target.Name + ", pinned to " + target.Version + ".")
+	c.Ui.Info("Run 'distsync pin -clear' to resume updates.")
+	return 0
+}
+
+func (c *Rollback) listReleases(workDir string, releases []*release.Release) {
+	buf := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tRELEASE\tVERSION\tINSTALLED")
+	for _, r := range releases {
+		marker := ""
+		if r.Current {
+			marker = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", marker, r.Name, r.Version, r.Installed.Format(time.RFC3339))
+	}
+	tw.Flush()
+
+	c.Ui.Output(strings.TrimRight(buf.String(), "\n"))
+
+	pin, err := release.Pinned(c.conf.Release, workDir)
+	if err == nil && pin != "" {
+		c.Ui.Output("")
+		c.Ui.Output("Pinned to " + pin)
+	}
+}
+
+// Returns the release installed before the current one, or nil.
+func previousRelease(releases []*release.Release) *release.Release {
+	for i, r := range releases {
+		if r.Current {
+			if i == 0 {
+				return nil
+			}
+			return releases[i-1]
+		}
+	}
+	return nil
+}
+
+// Returns the expanded output directory the releases of name are
+// installed in, see release.Dir. Without a name, returns the only
+// directory with installed releases.
+func releaseWorkDir(conf *common.Conf, name string) (string, error) {
+	if conf.OutputDir == nil {
+		return "", errors.New("must set OutputDir in configuration file.")
+	}
+
+	if name != "" {
+		return homedir.Expand(release.Dir(conf, name))
+	}
+
+	found, err := installedReleaseDirs(conf)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(found) {
+	case 0:
+		return homedir.Expand(*conf.OutputDir)
+	case 1:
+		return found[0], nil
+	}
+
+	return "", errors.New("releases are installed in " + strings.Join(found, ", ") + ", name a release or version.")
+}
+
+// Returns the expanded release directories with installed releases.
+func installedReleaseDirs(conf *common.Conf) ([]string, error) {
+	var rv []string
+	for _, dir := range release.Dirs(conf) {
+		workDir, err := homedir.Expand(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		releases, err := release.List(workDir)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(releases) > 0 {
+			rv = append(rv, workDir)
+		}
+	}
+	return rv, nil
+}
+
+func (c *Rollback) Synopsis() string {
+	return "Activate an earlier release, and pin the server to it"
+}
@@ -0,0 +1,489 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package command
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/mitchellh/cli"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+	"github.com/pquerna/distsync/storage"
+
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type RotateKey struct {
+	Ui      cli.Ui
+	conf    *common.Conf
+	channel string
+}
+
+func (c *RotateKey) Help() string {
+	helpText := `
+Usage: distsync rotate-key [options]
+
+  Generates a new shared secret and adds it to the keyring in the
+  configuration file.
+
+  Copy the new key into the configuration of your servers first,
+  then set ActiveKey (or use -activate) to encrypt new files with it.
+  Files encrypted with older keys can be read as long as their
+  keys stay in the keyring.
+
+Options:
+
+  -conf=~/.distsync         Read and update specific configuration file.
+  -activate                 Make the new key the active key.
+  -reencrypt                Don't generate a key, instead re-encrypt every
+                            file in the bucket that isn't encrypted with
+                            the active key. The old objects are deleted
+                            once their replacement is uploaded, with
+                            hidden older copies of the same file.
+                            Chunks of deduplicated files are stored
+                            again under the active key, and
+                            "distsync prune" deletes the old ones once
+                            no file in any channel refers to them.
+  -channel=default          Channel to re-encrypt with -reencrypt.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *RotateKey) Run(args []string) int {
+	var confFile string
+	var activate bool
+	var reencrypt bool
+
+	cmdFlags := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
+	cmdFlags.StringVar(&confFile, "conf", "~/.distsync", "Configuration path.")
+	cmdFlags.BoolVar(&activate, "activate", false, "Make the new key active.")
+	cmdFlags.BoolVar(&reencrypt, "reencrypt", false, "Re-encrypt files with the active key.")
+	cmdFlags.StringVar(&c.channel, "channel", common.DefaultChannel, "Channel to re-encrypt.")
+
+	err := cmdFlags.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	err = common.ValidateChannel(c.channel)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if len(cmdFlags.Args()) != 0 {
+		c.Ui.Error("rotate-key takes no arguments.")
+		c.Ui.Error("")
+		c.Ui.Error(c.Help())
+		return 1
+	}
+
+	c.conf, err = common.ConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Configuration failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	if reencrypt {
+		err = c.reencrypt()
+		if err != nil {
+			c.Ui.Error("Re-encrypt failed: " + err.Error())
+			c.Ui.Error("")
+			return 1
+		}
+		return 0
+	}
+
+	key, err := c.addKey(activate)
+	if err != nil {
+		c.Ui.Error("Error: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	// write the key to the file as it was read, without resolved secrets.
+	raw, err := common.RawConfFromFile(confFile)
+	if err != nil {
+		c.Ui.Error("Error: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	raw.Keys = append(raw.Keys, key)
+	raw.ActiveKey = c.conf.ActiveKey
+
+	err = raw.ToFile(confFile)
+	if err != nil {
+		c.Ui.Error("Error: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	snippet := bytes.Buffer{}
+	err = toml.NewEncoder(&snippet).Encode(struct{ Keys []*common.Key }{[]*common.Key{key}})
+	if err != nil {
+		c.Ui.Error("Error: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
+	c.Ui.Info("Added key " + key.Id + " to " + confFile)
+	c.Ui.Info("")
+	c.Ui.Info("Add it to the configuration of your servers (~/.distsyncd):")
+	c.Ui.Info("")
+	c.Ui.Info(snippet.String())
+	if !activate {
+		c.Ui.Info("Then set ActiveKey = \"" + key.Id + "\" in " + confFile)
+		c.Ui.Info("")
+	}
+	c.Ui.Info("Run `distsync rotate-key -reencrypt` to re-encrypt existing files.")
+
+	return 0
+}
+
+func (c *RotateKey) addKey(activate bool) (*common.Key, error) {
+	err := storage.LoadPassphraseKey(c.conf, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// pin the current active key, adding a key must not change it.
+	active, err := crypto.ActiveKeyId(c.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := crypto.RandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	c.conf.ActiveKey = active
+	c.conf.Keys = append(c.conf.Keys, key)
+
+	if activate {
+		c.conf.ActiveKey = key.Id
+	}
+
+	// make sure the result is a valid keyring.
+	_, err = crypto.NewFromConf(c.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (c *RotateKey) reencrypt() error {
+	s, err := storage.NewFromConf(c.conf)
+	if err != nil {
+		return err
+	}
+
+	ec, err := crypto.NewFromConf(c.conf)
+	if err != nil {
+		return err
+	}
+
+	d, ok := s.(storage.Deleter)
+	if !ok {
+		return errors.New("The storage backend does not support deleting files.")
+	}
+
+	// the bucket index also has content hashes, which are kept.
+	var files []*storage.FileInfo
+	idx, err := storage.ReadChannelIndex(c.conf, ec, s, c.channel)
+	if err == storage.ErrNoIndex {
+		files, err = s.ListChannel(ec, c.channel)
+	} else if err == nil {
+		files = idx.FileInfos(ec)
+	}
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, file := range files {
+		clearName := file.Name
+		if file.Chunked {
+			clearName = storage.ManifestName(file.Name)
+		}
+
+		remoteName, err := ec.EncryptName(clearName)
+		if err != nil {
+			return err
+		}
+
+		remoteName = common.ChannelPrefix(c.channel) + remoteName
+
+		var done bool
+		if file.Chunked {
+			done, err = c.reencryptChunked(ec, s, d, file, remoteName)
+		} else {
+			done, err = c.reencryptPlain(ec, s, d, file, remoteName)
+		}
+		if err != nil {
+			return err
+		}
+
+		if done {
+			count++
+		}
+
+		// hidden copies, like one uploaded with an earlier key
+		// before the file was replaced, are superseded as well. One
+		// may have been overwritten by the re-encrypted file.
+		for _, older := range file.Older {
+			if older == remoteName {
+				continue
+			}
+
+			err = d.Delete(older)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	c.Ui.Info("Re-encrypted " + strconv.Itoa(count) + " files.")
+
+	return nil
+}
+
+// Re-encrypts a file that isn't deduplicated as remoteName, unless it is
+// already stored there. Returns whether the file changed.
+func (c *RotateKey) reencryptPlain(ec crypto.Cryptor, s storage.Storage, d storage.Deleter, file *storage.FileInfo, remoteName string) (bool, error) {
+	// names and contents are encrypted with the same key, so a
+	// matching name means the file is up to date.
+	if remoteName == file.RemoteName {
+		return false, nil
+	}
+
+	c.Ui.Info("Re-encrypting " + file.Name)
+
+	err := reencryptFile(c.conf, ec, s, file, remoteName)
+	if err != nil {
+		return false, err
+	}
+
+	// the upload added the new object to the index, deleting the old
+	// one removes its entry.
+	return true, d.Delete(file.RemoteName)
+}
+
+// Stores the chunks of a deduplicated file under the active key, and
+// uploads a manifest referring to them as remoteName. A manifest
+// encrypted with the active key can still refer to chunks of an older
+// one, uploads reuse them. Returns whether the file changed.
+func (c *RotateKey) reencryptChunked(ec crypto.Cryptor, s storage.Storage, d storage.Deleter, file *storage.FileInfo, remoteName string) (bool, error) {
+	m, changed, err := storage.ReencryptChunks(c.conf, ec, s, file.RemoteName, file.Name)
+	if err != nil {
+		return false, err
+	}
+
+	if !changed && remoteName == file.RemoteName {
+		return false, nil
+	}
+
+	c.Ui.Info("Re-encrypted chunks of " + file.Name)
+
+	err = uploadManifest(c.conf, ec, s, remoteName, file.Name, m)
+	if err != nil {
+		return false, err
+	}
+
+	if remoteName == file.RemoteName {
+		return true, nil
+	}
+
+	return true, d.Delete(file.RemoteName)
+}
+
+func reencryptFile(conf *common.Conf, ec crypto.Cryptor, s storage.Storage, file *storage.FileInfo, remoteName string) error {
+	// files with a wrapped data key only need a new header, and are
+	// streamed from the old object to the new one.
+	rw, ok := ec.(crypto.Rewrapper)
+	rd, canRange := s.(storage.RangeDownloader)
+	if ok && canRange {
+		err := rewrapFile(conf, rw, s, rd, file, remoteName)
+		if err != crypto.ErrNotEnvelope {
+			return err
+		}
+	}
+
+	encFile, err := ioutil.TempFile("", ".distsync-e")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		encFile.Close()
+		os.Remove(encFile.Name())
+	}()
+
+	outFile, err := ioutil.TempFile("", ".distsync-e")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		outFile.Close()
+		os.Remove(outFile.Name())
+	}()
+
+	err = s.Download(file.RemoteName, encFile)
+	if err != nil {
+		return err
+	}
+
+	size, err := crypto.VerifyFile(conf, file.Name, encFile)
+	if err != nil {
+		return err
+	}
+
+	err = reencryptContents(ec, io.NewSectionReader(encFile, 0, size), outFile)
+	if err != nil {
+		return err
+	}
+
+	err = crypto.SignFile(conf, file.Name, outFile)
+	if err != nil {
+		return err
+	}
+
+	outSize, err := outFile.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+
+	_, err = outFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	return s.UploadStream(remoteName, outFile, outSize, &storage.UploadState{Sha256: file.Sha256})
+}
+
+// Streams the old object to remoteName with a rewrapped header, without
+// temporary files. Returns ErrNotEnvelope before uploading anything for
+// files without a wrapped data key.
+func rewrapFile(conf *common.Conf, rw crypto.Rewrapper, s storage.Storage, rd storage.RangeDownloader, file *storage.FileInfo, remoteName string) error {
+	// the upload length is needed up front, and depends on whether
+	// the old object is signed.
+	tailLen := crypto.MaxTrailerSize
+	if file.Length < tailLen {
+		tailLen = file.Length
+	}
+
+	tail := &bytes.Buffer{}
+	err := rd.RangeDownload(file.RemoteName, file.Length-tailLen, tailLen, tail)
+	if err != nil {
+		return err
+	}
+
+	sigSize, err := crypto.SignatureSize(conf)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(s.Download(file.RemoteName, pw))
+	}()
+
+	vr, err := crypto.NewVerifyingReader(conf, file.Name, pr)
+	if err != nil {
+		return err
+	}
+
+	header, oldLen, err := rw.RewrapHeader(vr)
+	if err != nil {
+		return err
+	}
+
+	length := file.Length - crypto.TrailerSize(tail.Bytes()) - oldLen + int64(len(header)) + sigSize
+
+	upr, upw := io.Pipe()
+	defer upr.Close()
+	go func() {
+		upw.CloseWithError(writeRewrapped(conf, file.Name, header, vr, upw))
+	}()
+
+	return s.UploadStream(remoteName, upr, length, &storage.UploadState{Sha256: file.Sha256})
+}
+
+// Writes the new header and the rest of the old file, and signs it once
+// the old file's signature has been checked.
+func writeRewrapped(conf *common.Conf, name string, header []byte, vr *crypto.VerifyingReader, w io.Writer) error {
+	sw, err := crypto.NewSigningWriter(conf, name, w)
+	if err != nil {
+		return err
+	}
+
+	_, err = sw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(sw, vr)
+	if err != nil {
+		return err
+	}
+
+	err = vr.Verify()
+	if err != nil {
+		return err
+	}
+
+	return sw.Close()
+}
+
+func reencryptContents(ec crypto.Cryptor, r io.Reader, w io.Writer) error {
+	clearFile, err := ioutil.TempFile("", ".distsync")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		clearFile.Close()
+		os.Remove(clearFile.Name())
+	}()
+
+	err = ec.Decrypt(r, clearFile)
+	if err != nil {
+		return err
+	}
+
+	_, err = clearFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	return ec.Encrypt(clearFile, w)
+}
+
+func (c *RotateKey) Synopsis() string {
+	return "Adds a new shared secret, and re-encrypts files with it."
+}
@@ -24,7 +24,12 @@ import (
 	"github.com/pquerna/distsync/crypto"
 	"github.com/pquerna/distsync/storage"
 
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -34,9 +39,10 @@ import (
 
 type Upload struct {
 	// bleh, should change this to use channels and shit.
-	stop error
-	conf *common.Conf
-	Ui   cli.Ui
+	stop    error
+	conf    *common.Conf
+	channel string
+	Ui      cli.Ui
 }
 
 func (c *Upload) Help() string {
@@ -48,6 +54,8 @@ Usage: distsync upload [options] file ...
 Options:
 
   -conf=~/.distsync         Read specific configuration file.
+  -channel=default          Upload to this channel. Only servers
+                            subscribed to it download the files.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -104,41 +112,57 @@ func (c *Upload) _uploadFile(filename string) error {
 
 	_, shortName := filepath.Split(fpath)
 
+	remoteName, err := c.remoteName(ec, shortName)
+	if err != nil {
+		return err
+	}
+
 	file, err := os.Open(fpath)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	if c.stop != nil {
 		return &stopError{}
 	}
 
-	tmpFile, err := ioutil.TempFile("", ".distsync")
+	st, err := file.Stat()
 	if err != nil {
 		return err
 	}
-	defer func() {
-		tmpFile.Close()
-		os.Remove(tmpFile.Name())
-	}()
 
-	if c.stop != nil {
-		return &stopError{}
+	if c.conf.Dedup {
+		return c.uploadChunks(ec, shortName, file, st.Size())
 	}
 
-	err = ec.Encrypt(file, tmpFile)
+	state, err := storage.LoadUploadState(c.conf, remoteName)
 	if err != nil {
 		return err
 	}
-	if c.stop != nil {
-		return &stopError{}
+
+	sum, err := storage.ContentSha256(io.LimitReader(file, st.Size()))
+	if err != nil {
+		return err
 	}
 
-	_, err = tmpFile.Seek(0, 0)
+	_, err = file.Seek(0, 0)
 	if err != nil {
 		return err
 	}
-	if c.stop != nil {
-		return &stopError{}
+
+	header, payload, err := uploadHeader(c.conf, ec, state, sum, file, st.Size())
+	if err != nil {
+		return err
+	}
+
+	size, err := ec.EncryptedSize(header, payload)
+	if err != nil {
+		return err
+	}
+
+	sigSize, err := crypto.SignatureSize(c.conf)
+	if err != nil {
+		return err
 	}
 
 	s, err := storage.NewFromConf(c.conf)
@@ -152,13 +176,201 @@ func (c *Upload) _uploadFile(filename string) error {
 	// TOOD: lock? bleh
 	c.Ui.Info("Uploading " + shortName)
 
+	// encrypted data is streamed straight to storage, the length is
+	// known ahead of time from the cleartext or compressed length.
+	pr, pw := io.Pipe()
+	encerr := make(chan error, 1)
+	go func() {
+		err := encryptFile(c.conf, ec, header, shortName, file, st.Size(), size, pw)
+		pw.CloseWithError(err)
+		encerr <- err
+	}()
+
 	// TODO: channel for cancellation of upload?
-	err = s.Upload(shortName, tmpFile)
+	err = s.UploadStream(remoteName, pr, size+sigSize, state)
+
+	// stops encrypting if the upload gave up early.
+	pr.Close()
+	eerr := <-encerr
+	if eerr != nil && eerr != io.ErrClosedPipe {
+		return eerr
+	}
+
+	return err
+}
+
+// Returns the object name of a file in the channel being uploaded to.
+func (c *Upload) remoteName(ec crypto.Encryptor, name string) (string, error) {
+	remoteName, err := ec.EncryptName(name)
+	if err != nil {
+		return "", err
+	}
+
+	return common.ChannelPrefix(c.channel) + remoteName, nil
+}
+
+// Uploads the chunks of file that are not in storage yet, followed by
+// the manifest listing all of them.
+func (c *Upload) uploadChunks(ec crypto.Encryptor, shortName string, file io.ReadSeeker, size int64) error {
+	s, err := storage.NewFromConf(c.conf)
+	if err != nil {
+		return err
+	}
+
+	cs, ok := s.(storage.ChunkStore)
+	if !ok {
+		return errors.New("Dedup is not supported by the " + c.conf.Storage + " storage backend.")
+	}
+
+	alg, err := crypto.Compression(c.conf, file)
+	if err != nil {
+		return err
+	}
+
+	c.Ui.Info("Uploading chunks of " + shortName)
+
+	m, uploaded, err := storage.UploadChunks(cs, ec, alg, io.LimitReader(file, size), c.conf.Multipart.WithDefaults().Parallel)
+	if err != nil {
+		return err
+	}
+
+	if m.Length != size {
+		return errors.New("File changed while uploading.")
+	}
+
+	c.Ui.Info(fmt.Sprintf("Uploaded %d of %d chunks of %s", uploaded, len(m.Chunks), shortName))
+
+	remoteName, err := c.remoteName(ec, storage.ManifestName(shortName))
+	if err != nil {
+		return err
+	}
+
+	return uploadManifest(c.conf, ec, s, remoteName, shortName, m)
+}
+
+// Encrypts and signs the manifest of the file name, and uploads it as
+// remoteName.
+func uploadManifest(conf *common.Conf, ec crypto.Encryptor, s storage.Storage, remoteName string, name string, m *storage.Manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	header, err := ec.NewHeader("")
+	if err != nil {
+		return err
+	}
+
+	encSize, err := ec.EncryptedSize(header, int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	sigSize, err := crypto.SignatureSize(conf)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	enc := &bytes.Buffer{}
+	err = encryptFile(conf, ec, header, name, bytes.NewReader(data), int64(len(data)), encSize, enc)
+	if err != nil {
+		return err
+	}
+
+	return s.UploadStream(remoteName, enc, encSize+sigSize, &storage.UploadState{Sha256: m.Sha256})
+}
+
+// Returns the file header saved by an interrupted upload of the same
+// file, identified by its SHA-256 sum, so the file encrypts to the same
+// bytes and finished parts can be reused, or a new one. Also returns the
+// length of the payload the header encrypts. Files that don't get
+// smaller when compressed are stored as they are.
+func uploadHeader(conf *common.Conf, ec crypto.Encryptor, state *storage.UploadState, sum string, file io.ReadSeeker, size int64) ([]byte, int64, error) {
+	if state.Header != nil && state.Sha256 == sum {
+		err := ec.EncryptWithHeader(state.Header, bytes.NewReader(nil), ioutil.Discard)
+		if err == nil {
+			payload, err := payloadSize(state.Header, file, size)
+			return state.Header, payload, err
+		}
+	}
+
+	alg, err := crypto.Compression(conf, file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	header, err := ec.NewHeader(alg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	payload, err := payloadSize(header, file, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if alg != "" && payload >= size {
+		header, err = ec.NewHeader("")
+		if err != nil {
+			return nil, 0, err
+		}
+		payload = size
+	}
+
+	state.Header = header
+	state.Sha256 = sum
+	return header, payload, nil
+}
+
+// Returns the length of the payload header encrypts for file, and seeks
+// back to its start.
+func payloadSize(header []byte, file io.ReadSeeker, size int64) (int64, error) {
+	payload, err := crypto.CompressedSize(header, file, size)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return payload, nil
+}
+
+// Encrypts and signs size bytes of file to w, which must come to
+// expected bytes before the signature.
+func encryptFile(conf *common.Conf, ec crypto.Encryptor, header []byte, name string, file io.Reader, size int64, expected int64, w io.Writer) error {
+	sw, err := crypto.NewSigningWriter(conf, name, w)
+	if err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: sw}
+
+	// files that grow while uploading are truncated to their size at the
+	// start, files that shrink produce less data than expected and fail.
+	err = ec.EncryptWithHeader(header, io.LimitReader(file, size), cw)
+	if err != nil {
+		return err
+	}
+
+	if cw.n != expected {
+		return errors.New("File changed while uploading.")
+	}
+
+	return sw.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
 }
 
 func (c *Upload) Run(args []string) int {
@@ -167,12 +379,20 @@ func (c *Upload) Run(args []string) int {
 	cmdFlags := flag.NewFlagSet("upload", flag.ContinueOnError)
 	cmdFlags.Usage = func() { c.Ui.Output(c.Help()) }
 	cmdFlags.StringVar(&confFile, "conf", "~/.distsync", "Configuration path.")
+	cmdFlags.StringVar(&c.channel, "channel", common.DefaultChannel, "Channel to upload to.")
 
 	err := cmdFlags.Parse(args)
 	if err != nil {
 		return 1
 	}
 
+	err = common.ValidateChannel(c.channel)
+	if err != nil {
+		c.Ui.Error(err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
 	c.conf, err = common.ConfFromFile(confFile)
 	if err != nil {
 		c.Ui.Error("Configuration failure: " + err.Error())
@@ -188,6 +408,14 @@ func (c *Upload) Run(args []string) int {
 		return 1
 	}
 
+	// the first upload to a bucket creates the passphrase salt.
+	err = storage.LoadPassphraseKey(c.conf, true)
+	if err != nil {
+		c.Ui.Error("Storage failure: " + err.Error())
+		c.Ui.Error("")
+		return 1
+	}
+
 	var wg sync.WaitGroup
 
 	for _, file := range files {
@@ -0,0 +1,126 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Returns the region to use for S3 requests. When an Endpoint is
+// configured, a custom region is built for S3-compatible servers
+// like MinIO or Ceph RGW, otherwise Region must be a known AWS region.
+func (creds *AwsCreds) S3Region() (aws.Region, error) {
+	if creds.Endpoint == "" {
+		r, ok := aws.Regions[creds.Region]
+		if !ok {
+			return aws.Region{}, errors.New("S3: Unknown region: '" + creds.Region + "'")
+		}
+		return r, nil
+	}
+
+	u, err := url.Parse(creds.Endpoint)
+	if err != nil {
+		return aws.Region{}, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return aws.Region{}, errors.New("S3: Endpoint must be a URL like https://host:port, got: '" + creds.Endpoint + "'")
+	}
+
+	name := creds.Region
+	if name == "" {
+		name = "us-east-1"
+	}
+
+	r := aws.Region{
+		Name:              name,
+		S3Endpoint:        u.Scheme + "://" + u.Host,
+		S3LowercaseBucket: true,
+	}
+
+	// goamz uses path-style requests (https://host/bucket/key) when
+	// S3BucketEndpoint is empty.
+	if !creds.PathStyle {
+		r.S3BucketEndpoint = u.Scheme + "://${bucket}." + u.Host
+	}
+
+	return r, nil
+}
+
+func (creds *AwsCreds) httpClient() (*http.Client, error) {
+	if !creds.InsecureSkipVerify && creds.CACert == "" {
+		return http.DefaultClient, nil
+	}
+
+	tc := &tls.Config{
+		InsecureSkipVerify: creds.InsecureSkipVerify,
+	}
+
+	if creds.CACert != "" {
+		pem, err := ioutil.ReadFile(creds.CACert)
+		if err != nil {
+			return nil, err
+		}
+
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("S3: No certificates found in CACert: '" + creds.CACert + "'")
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tc,
+		},
+	}, nil
+}
+
+// Creates an S3 client for these credentials, honoring
+// Endpoint, PathStyle and the TLS options.
+func (creds *AwsCreds) S3Client() (*s3.S3, error) {
+	a := aws.Auth{
+		AccessKey: creds.AccessKey,
+		SecretKey: creds.SecretKey,
+	}
+
+	r, err := creds.S3Region()
+	if err != nil {
+		return nil, err
+	}
+
+	hc, err := creds.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.New(a, r)
+	client.HTTPClient = func() *http.Client {
+		return hc
+	}
+
+	return client, nil
+}
@@ -0,0 +1,68 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"testing"
+)
+
+func TestS3RegionEndpoint(t *testing.T) {
+	creds := &AwsCreds{
+		Endpoint: "https://minio.example.com:9000",
+	}
+
+	r, err := creds.S3Region()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if r.S3Endpoint != "https://minio.example.com:9000" {
+		t.Fatalf("unexpected S3Endpoint: %s", r.S3Endpoint)
+	}
+
+	if r.S3BucketEndpoint != "https://${bucket}.minio.example.com:9000" {
+		t.Fatalf("unexpected S3BucketEndpoint: %s", r.S3BucketEndpoint)
+	}
+
+	creds.PathStyle = true
+	r, err = creds.S3Region()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if r.S3BucketEndpoint != "" {
+		t.Fatalf("expected path-style region, got S3BucketEndpoint: %s", r.S3BucketEndpoint)
+	}
+
+	creds.Endpoint = "minio.example.com"
+	_, err = creds.S3Region()
+	if err == nil {
+		t.Fatal("expected error from endpoint without scheme")
+	}
+}
+
+func TestS3RegionUnknown(t *testing.T) {
+	creds := &AwsCreds{
+		Region: "moon-west-1",
+	}
+
+	_, err := creds.S3Region()
+	if err == nil {
+		t.Fatal("expected error from unknown region")
+	}
+}
@@ -0,0 +1,54 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"regexp"
+)
+
+// The channel of files stored at the root of the bucket. Other channels
+// are prefixes in the bucket, like "staging/".
+const DefaultChannel = "default"
+
+var channelRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// ValidateChannel returns an error if name can't be used as a channel.
+func ValidateChannel(name string) error {
+	if !channelRe.MatchString(name) {
+		return errors.New("Invalid channel '" + name + "': use up to 64 letters, digits, '.', '_' or '-'.")
+	}
+	return nil
+}
+
+// ChannelPrefix returns the prefix of objects in channel.
+func ChannelPrefix(channel string) string {
+	if channel == "" || channel == DefaultChannel {
+		return ""
+	}
+	return channel + "/"
+}
+
+// SubscribedChannels returns the channels the daemon downloads files
+// from, the default channel if none are configured.
+func (c *Conf) SubscribedChannels() []string {
+	if len(c.Channels) == 0 {
+		return []string{DefaultChannel}
+	}
+	return c.Channels
+}
@@ -0,0 +1,62 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateChannel(t *testing.T) {
+	for _, name := range []string{"default", "staging", "prod-eu.1", "a_b"} {
+		err := ValidateChannel(name)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"", ".distsync", "..", "a/b", "-x", "white space", strings.Repeat("a", 65)} {
+		err := ValidateChannel(name)
+		if err == nil {
+			t.Fatalf("expected error for %q", name)
+		}
+	}
+}
+
+func TestChannelPrefix(t *testing.T) {
+	if ChannelPrefix("") != "" || ChannelPrefix(DefaultChannel) != "" {
+		t.Fatal("expected no prefix for the default channel")
+	}
+
+	if ChannelPrefix("staging") != "staging/" {
+		t.Fatalf("unexpected prefix: %q", ChannelPrefix("staging"))
+	}
+}
+
+func TestSubscribedChannels(t *testing.T) {
+	c := NewConf()
+	ch := c.SubscribedChannels()
+	if len(ch) != 1 || ch[0] != DefaultChannel {
+		t.Fatalf("unexpected default subscription: %v", ch)
+	}
+
+	c.Channels = []string{"staging", "production"}
+	ch = c.SubscribedChannels()
+	if len(ch) != 2 || ch[1] != "production" {
+		t.Fatalf("unexpected subscription: %v", ch)
+	}
+}
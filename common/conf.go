@@ -26,15 +26,70 @@ import (
 )
 
 type Conf struct {
-	SharedSecret  string
+	SharedSecret string
+	// Alternatives to SharedSecret, stretched with argon2id.
+	Passphrase     string
+	PassphraseFile string
+	// Derived at run time from the passphrase, and never written to file.
+	PassphraseKey []byte `toml:"-"`
+	Keys          []*Key
+	ActiveKey     string
+	// Ed25519 keys: the uploader signs files with SigningKey,
+	// servers only accept files signed by one of TrustedKeys.
+	SigningKey    string
+	TrustedKeys   []string
 	Encrypt       string
+	Compress      string
+	Dedup         bool
 	Notify        string
 	Storage       string
 	StorageBucket string
+	Channels      []string
 	OutputDir     *string
 	Aws           *AwsCreds
 	Rackspace     *RackspaceCreds
 	PeerDist      *PeerDist
+	Multipart     *Multipart
+	Download      *Download
+	Release       *Release
+	Hooks         []*Hook
+	Include       []string
+	Exclude       []string
+	Routes        []*Route
+}
+
+type Key struct {
+	Id     string
+	Secret string
+}
+
+type Multipart struct {
+	// Files larger than PartSize bytes are uploaded in parts.
+	PartSize int64
+	// Number of parts uploaded at the same time.
+	Parallel int
+	// Where to save interrupted uploads, so they can be resumed.
+	StateDir string
+}
+
+type Download struct {
+	// Files larger than RangeSize bytes are downloaded in byte ranges,
+	// and resumed after a restart. 0 disables ranged downloads.
+	RangeSize int64
+	// Number of ranges downloaded at the same time.
+	Parallel int
+}
+
+type Release struct {
+	// Shell glob of tarballs the daemon extracts as releases, like
+	// "app-*.tar.gz". Empty disables release mode.
+	Pattern string
+	// Number of releases kept, including the current one.
+	Keep int
+	// Version the servers using this configuration are pinned to, like
+	// "app-1" for app-1.tar.gz. Newer uploads are ignored until it is
+	// removed.
+	Pin string
 }
 
 type PeerDist struct {
@@ -47,6 +102,11 @@ type AwsCreds struct {
 	Region    string
 	AccessKey string
 	SecretKey string
+	// Optional, for S3-compatible servers like MinIO or Ceph RGW.
+	Endpoint           string
+	PathStyle          bool
+	CACert             string
+	InsecureSkipVerify bool
 }
 
 type RackspaceCreds struct {
@@ -55,6 +115,9 @@ type RackspaceCreds struct {
 	ApiKey   string
 }
 
+// Multipart, Download and Release are left nil, so they are not
+// written to file unless they were configured. Their defaults are
+// applied where they are used, see WithDefaults.
 func NewConf() *Conf {
 	return &Conf{
 		Encrypt: "AEAD_CHACHA20_POLY1305",
@@ -68,7 +131,94 @@ func NewConf() *Conf {
 	}
 }
 
+func NewMultipart() *Multipart {
+	return &Multipart{
+		PartSize: 16 * 1024 * 1024,
+		Parallel: 4,
+		StateDir: "~/.distsync-uploads",
+	}
+}
+
+func NewDownload() *Download {
+	return &Download{
+		RangeSize: 16 * 1024 * 1024,
+		Parallel:  4,
+	}
+}
+
+func NewRelease() *Release {
+	return &Release{
+		Keep: 5,
+	}
+}
+
+// WithDefaults returns a copy of mp with defaults for the fields that
+// are not set. mp may be nil.
+func (mp *Multipart) WithDefaults() *Multipart {
+	rv := NewMultipart()
+	if mp == nil {
+		return rv
+	}
+
+	if mp.PartSize != 0 {
+		rv.PartSize = mp.PartSize
+	}
+	if mp.Parallel != 0 {
+		rv.Parallel = mp.Parallel
+	}
+	if mp.StateDir != "" {
+		rv.StateDir = mp.StateDir
+	}
+	return rv
+}
+
+// WithDefaults returns a copy of dc with defaults for the fields that
+// are not set. A RangeSize of 0 disables ranged downloads, so it is
+// only defaulted when the section is missing, or by RawConfFromFile
+// when the section leaves it out.
+func (dc *Download) WithDefaults() *Download {
+	rv := NewDownload()
+	if dc == nil {
+		return rv
+	}
+
+	rv.RangeSize = dc.RangeSize
+	if dc.Parallel != 0 {
+		rv.Parallel = dc.Parallel
+	}
+	return rv
+}
+
+// WithDefaults returns a copy of r, or the defaults if r is nil. A
+// Keep of 0 keeps every release.
+func (r *Release) WithDefaults() *Release {
+	if r == nil {
+		return NewRelease()
+	}
+
+	rv := *r
+	return &rv
+}
+
+// Reads the configuration, and resolves references to secrets stored
+// elsewhere. See resolveSecret.
 func ConfFromFile(file string) (*Conf, error) {
+	c, err := RawConfFromFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.resolveSecrets()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reads the configuration without resolving secret references, for
+// commands that write the configuration back to file.
+func RawConfFromFile(file string) (*Conf, error) {
 	file, err := homedir.Expand(file)
 	if err != nil {
 		return nil, err
@@ -81,14 +231,38 @@ func ConfFromFile(file string) (*Conf, error) {
 
 	c := NewConf()
 
-	_, err = toml.Decode(string(data), c)
+	md, err := toml.Decode(string(data), c)
 	if err != nil {
 		return nil, err
 	}
 
+	// zero means off for these, so a section that leaves them out gets
+	// the default here instead of where they are used.
+	if c.Download != nil && !md.IsDefined("Download", "RangeSize") {
+		c.Download.RangeSize = NewDownload().RangeSize
+	}
+	if c.Release != nil && !md.IsDefined("Release", "Keep") {
+		c.Release.Keep = NewRelease().Keep
+	}
+
 	return c, nil
 }
 
+// Writes the configuration to file, readable only by the current user.
+func (c *Conf) ToFile(file string) error {
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.ToString()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, []byte(data), 0600)
+}
+
 func (c *Conf) ToString() (string, error) {
 	buf := bytes.Buffer{}
 	err := toml.NewEncoder(&buf).Encode(c)
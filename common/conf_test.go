@@ -18,6 +18,11 @@
 package common
 
 import (
+	"github.com/BurntSushi/toml"
+
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -25,3 +30,62 @@ func TestConf(t *testing.T) {
 	c := NewConf()
 	_, _ = c.ToString()
 }
+
+func TestConfMultipartDefaults(t *testing.T) {
+	c := NewConf()
+
+	_, err := toml.Decode("[Multipart]\n  Parallel = 8\n", c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	mp := c.Multipart.WithDefaults()
+	if mp.Parallel != 8 || mp.PartSize != 16*1024*1024 {
+		t.Fatalf("unexpected Multipart: %+v", mp)
+	}
+}
+
+func TestConfDefaultsNotWritten(t *testing.T) {
+	data, err := NewConf().ToString()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, section := range []string{"[Multipart]", "[Download]", "[Release]"} {
+		if strings.Contains(data, section) {
+			t.Fatalf("expected no %s section in:\n%s", section, data)
+		}
+	}
+
+	if NewConf().Download.WithDefaults().RangeSize != 16*1024*1024 {
+		t.Fatal("expected ranged downloads by default")
+	}
+}
+
+func TestConfPartialSections(t *testing.T) {
+	f, err := ioutil.TempFile("", "distsync-conf")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("[Download]\n  Parallel = 8\n[Release]\n  Pattern = \"app-*.tar.gz\"\n")
+	f.Close()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c, err := RawConfFromFile(f.Name())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// leaving out a setting where zero means off keeps the default.
+	if c.Download.RangeSize != 16*1024*1024 || c.Download.WithDefaults().Parallel != 8 {
+		t.Fatalf("unexpected Download: %+v", c.Download)
+	}
+
+	if c.Release.Keep != 5 {
+		t.Fatalf("unexpected Release: %+v", c.Release)
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+)
+
+const defaultHookTimeout = time.Minute
+
+// Hook is a command the daemon runs after it downloads a matching file.
+type Hook struct {
+	// Shell glob matched against the file name, like "app-*.tar.gz".
+	// Required, "*" runs the hook for every file.
+	Pattern string
+	// Run with /bin/sh -c in the directory of the file.
+	Command string
+	// Duration like "30s" after which the command is killed. Defaults
+	// to one minute.
+	Timeout string
+	// "continue", the default, logs a failure and runs the next hook.
+	// "stop" skips the remaining hooks for the file. "retry" runs the
+	// command up to Retries more times before continuing.
+	OnFailure string
+	Retries   int
+}
+
+// Validate returns an error if the hook can't be run.
+func (h *Hook) Validate() error {
+	if h.Command == "" {
+		return errors.New("Hook has no Command.")
+	}
+
+	if h.Pattern == "" {
+		return errors.New("Hook has no Pattern, use \"*\" to run it for every file.")
+	}
+
+	_, err := path.Match(h.Pattern, "")
+	if err != nil {
+		return errors.New("Invalid hook Pattern '" + h.Pattern + "': " + err.Error())
+	}
+
+	_, err = h.timeout()
+	if err != nil {
+		return errors.New("Invalid hook Timeout '" + h.Timeout + "': " + err.Error())
+	}
+
+	switch h.OnFailure {
+	case "", "continue", "stop":
+	case "retry":
+		if h.Retries < 1 {
+			return errors.New("Hook with OnFailure = \"retry\" needs Retries.")
+		}
+	default:
+		return errors.New("Unknown hook OnFailure: " + h.OnFailure)
+	}
+
+	return nil
+}
+
+// Matches returns true if the hook runs for the file name.
+func (h *Hook) Matches(name string) bool {
+	ok, _ := path.Match(h.Pattern, name)
+	return ok
+}
+
+func (h *Hook) timeout() (time.Duration, error) {
+	if h.Timeout == "" {
+		return defaultHookTimeout, nil
+	}
+
+	d, err := time.ParseDuration(h.Timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if d <= 0 {
+		return 0, errors.New("must be positive")
+	}
+
+	return d, nil
+}
+
+// Attempts returns how many times the command runs before it fails.
+func (h *Hook) Attempts() int {
+	if h.OnFailure == "retry" {
+		return h.Retries + 1
+	}
+	return 1
+}
+
+// Run runs the command once in dir with env added to the environment,
+// and writes its combined output to out. The command is killed after
+// the timeout.
+func (h *Hook) Run(dir string, env []string, out io.Writer) error {
+	timeout, err := h.timeout()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", h.Command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// children left running by a killed command keep the output open.
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return errors.New("Hook timed out after " + timeout.String())
+	}
+}
@@ -0,0 +1,93 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestHookValidate(t *testing.T) {
+	valid := []*Hook{
+		{Pattern: "*", Command: "true"},
+		{Pattern: "app-*.tar", Command: "true", Timeout: "5s", OnFailure: "stop"},
+		{Pattern: "app-*.tar", Command: "true", OnFailure: "retry", Retries: 2},
+	}
+	for _, h := range valid {
+		err := h.Validate()
+		if err != nil {
+			t.Fatalf("unexpected error for %+v: %v", h, err)
+		}
+	}
+
+	invalid := []*Hook{
+		{Pattern: "*"},
+		{Command: "true"},
+		{Pattern: "[", Command: "true"},
+		{Pattern: "*", Command: "true", Timeout: "soon"},
+		{Pattern: "*", Command: "true", Timeout: "-1s"},
+		{Pattern: "*", Command: "true", OnFailure: "retry"},
+		{Pattern: "*", Command: "true", OnFailure: "explode"},
+	}
+	for _, h := range invalid {
+		err := h.Validate()
+		if err == nil {
+			t.Fatalf("expected error for %+v", h)
+		}
+	}
+}
+
+func TestHookMatches(t *testing.T) {
+	h := &Hook{Pattern: "app-*.tar", Command: "true"}
+	if !h.Matches("app-1.tar") {
+		t.Fatal("expected app-1.tar to match")
+	}
+	if h.Matches("notes.txt") {
+		t.Fatal("expected notes.txt not to match")
+	}
+}
+
+func TestHookRun(t *testing.T) {
+	h := &Hook{Pattern: "*", Command: "echo $DISTSYNC_NAME; pwd; echo oops >&2"}
+	out := &bytes.Buffer{}
+	err := h.Run("/", []string{"DISTSYNC_NAME=app-1.tar"}, out)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if out.String() != "app-1.tar\n/\noops\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+
+	h = &Hook{Pattern: "*", Command: "echo failing; exit 3"}
+	out.Reset()
+	err = h.Run("/", nil, out)
+	if err == nil || out.String() != "failing\n" {
+		t.Fatalf("expected failure with output, got %q: %v", out, err)
+	}
+}
+
+func TestHookRunTimeout(t *testing.T) {
+	h := &Hook{Pattern: "*", Command: "sleep 10 & sleep 10", Timeout: "100ms"}
+	err := h.Run("/", nil, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+}
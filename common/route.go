@@ -0,0 +1,223 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package common
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Route sends the files matching it to their own output directory, with
+// their own mode and owner.
+type Route struct {
+	// Shell glob matched against the file name, like "web-*.tar.gz".
+	Pattern string
+	// Regular expression matched against the file name, instead of
+	// Pattern.
+	Regexp string
+	// Directory the files are downloaded to, created if it doesn't
+	// exist. Defaults to OutputDir.
+	OutputDir string
+	// Octal file mode like "0644". Defaults to 0600.
+	Mode string
+	// "user" or "user:group", as names or numeric IDs. Changing the
+	// owner generally needs root.
+	Owner string
+}
+
+// Validate returns an error if the route can't be used.
+func (r *Route) Validate() error {
+	if (r.Pattern == "") == (r.Regexp == "") {
+		return errors.New("Route needs one of Pattern or Regexp.")
+	}
+
+	_, err := path.Match(r.Pattern, "")
+	if err != nil {
+		return errors.New("Invalid route Pattern '" + r.Pattern + "': " + err.Error())
+	}
+
+	if r.Regexp != "" {
+		_, err = regexp.Compile(r.Regexp)
+		if err != nil {
+			return errors.New("Invalid route Regexp '" + r.Regexp + "': " + err.Error())
+		}
+	}
+
+	_, err = r.FileMode()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = r.Ownership()
+	return err
+}
+
+// Matches returns true if the route applies to the file name.
+func (r *Route) Matches(name string) bool {
+	if r.Regexp != "" {
+		ok, _ := regexp.MatchString(r.Regexp, name)
+		return ok
+	}
+
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+// FileMode returns the mode of routed files, 0 if it isn't set.
+func (r *Route) FileMode() (os.FileMode, error) {
+	if r.Mode == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(r.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.New("Invalid route Mode '" + r.Mode + "': use an octal mode like \"0644\".")
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// Ownership returns the user and group IDs of routed files, -1 for
+// either when it isn't set.
+func (r *Route) Ownership() (int, int, error) {
+	if r.Owner == "" {
+		return -1, -1, nil
+	}
+
+	owner, group := r.Owner, ""
+	i := strings.Index(r.Owner, ":")
+	if i >= 0 {
+		owner, group = r.Owner[:i], r.Owner[i+1:]
+	}
+
+	uid, gid := -1, -1
+	var err error
+
+	if owner != "" {
+		uid, err = lookupUid(owner)
+		if err != nil {
+			return -1, -1, errors.New("Invalid route Owner '" + r.Owner + "': " + err.Error())
+		}
+	}
+
+	if group != "" {
+		gid, err = lookupGid(group)
+		if err != nil {
+			return -1, -1, errors.New("Invalid route Owner '" + r.Owner + "': " + err.Error())
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// Returns a numeric user ID as it is, or looks up a user name.
+func lookupUid(name string) (int, error) {
+	id, err := strconv.Atoi(name)
+	if err == nil {
+		return id, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(u.Uid)
+}
+
+// Returns a numeric group ID as it is, or looks up a group name.
+func lookupGid(name string) (int, error) {
+	id, err := strconv.Atoi(name)
+	if err == nil {
+		return id, nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(g.Gid)
+}
+
+// ValidateRouting returns an error for the first malformed Include or
+// Exclude pattern or route.
+func (c *Conf) ValidateRouting() error {
+	for _, p := range append(append([]string{}, c.Include...), c.Exclude...) {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return errors.New("Invalid pattern '" + p + "': " + err.Error())
+		}
+	}
+
+	for _, r := range c.Routes {
+		err := r.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Wanted returns true if the daemon downloads the file name: it matches
+// one of Include, when set, and none of Exclude.
+func (c *Conf) Wanted(name string) bool {
+	if len(c.Include) > 0 && !matchAny(c.Include, name) {
+		return false
+	}
+
+	return !matchAny(c.Exclude, name)
+}
+
+// RouteFor returns the first route matching the file name, or nil.
+// Release tarballs are routed too: their releases, current symlink and
+// pin are kept in the route's OutputDir.
+func (c *Conf) RouteFor(name string) *Route {
+	for _, r := range c.Routes {
+		if r.Matches(name) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// OutputDirFor returns the directory the file name is downloaded to.
+func (c *Conf) OutputDirFor(name string) string {
+	r := c.RouteFor(name)
+	if r != nil && r.OutputDir != "" {
+		return r.OutputDir
+	}
+
+	return *c.OutputDir
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		ok, _ := path.Match(p, name)
+		if ok {
+			return true
+		}
+	}
+	return false
+}
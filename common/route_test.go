@@ -0,0 +1,128 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package common
+
+import (
+	"os/user"
+	"testing"
+)
+
+func TestRouteValidate(t *testing.T) {
+	valid := []*Route{
+		{Pattern: "web-*.tar.gz", OutputDir: "/srv/web"},
+		{Regexp: `^conf-.*\.json$`, Mode: "0640"},
+		{Pattern: "*", Owner: "1000:1000"},
+		{Pattern: "*", Owner: ":0"},
+	}
+	for _, r := range valid {
+		err := r.Validate()
+		if err != nil {
+			t.Fatalf("unexpected error for %+v: %v", r, err)
+		}
+	}
+
+	invalid := []*Route{
+		{OutputDir: "/srv/web"},
+		{Pattern: "*", Regexp: ".*"},
+		{Pattern: "["},
+		{Regexp: "("},
+		{Pattern: "*", Mode: "rw-r--r--"},
+		{Pattern: "*", Mode: "01777"},
+		{Pattern: "*", Owner: "no-such-user-distsync"},
+	}
+	for _, r := range invalid {
+		err := r.Validate()
+		if err == nil {
+			t.Fatalf("expected error for %+v", r)
+		}
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	r := &Route{Pattern: "web-*.tar.gz"}
+	if !r.Matches("web-1.tar.gz") || r.Matches("db-snapshot-1.gz") {
+		t.Fatal("unexpected glob match")
+	}
+
+	r = &Route{Regexp: `^conf-[0-9]+\.json$`}
+	if !r.Matches("conf-12.json") || r.Matches("conf-x.json") {
+		t.Fatal("unexpected regexp match")
+	}
+}
+
+func TestRouteOwnership(t *testing.T) {
+	r := &Route{Pattern: "*"}
+	uid, gid, err := r.Ownership()
+	if err != nil || uid != -1 || gid != -1 {
+		t.Fatalf("unexpected ownership: %d %d %v", uid, gid, err)
+	}
+
+	r.Owner = "1000:2000"
+	uid, gid, err = r.Ownership()
+	if err != nil || uid != 1000 || gid != 2000 {
+		t.Fatalf("unexpected ownership: %d %d %v", uid, gid, err)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+
+	r.Owner = u.Username
+	uid, gid, err = r.Ownership()
+	if err != nil || gid != -1 {
+		t.Fatalf("unexpected ownership: %d %d %v", uid, gid, err)
+	}
+}
+
+func TestConfRouting(t *testing.T) {
+	out := "/srv/out"
+	c := NewConf()
+	c.OutputDir = &out
+	c.Exclude = []string{"db-snapshot-*"}
+	c.Routes = []*Route{
+		{Pattern: "web-*", OutputDir: "/srv/web"},
+		{Pattern: "*.json", Mode: "0644"},
+	}
+
+	if !c.Wanted("web-1.tar.gz") || c.Wanted("db-snapshot-1.gz") {
+		t.Fatal("unexpected exclude")
+	}
+
+	c.Include = []string{"web-*", "*.json"}
+	if !c.Wanted("app.json") || c.Wanted("notes.txt") {
+		t.Fatal("unexpected include")
+	}
+
+	if c.OutputDirFor("web-1.tar.gz") != "/srv/web" {
+		t.Fatalf("unexpected output dir: %s", c.OutputDirFor("web-1.tar.gz"))
+	}
+
+	if c.OutputDirFor("app.json") != out || c.RouteFor("app.json") != c.Routes[1] {
+		t.Fatal("expected app.json in OutputDir with the second route")
+	}
+
+	c.Release = &Release{Pattern: "web-*.tar.gz"}
+	if c.RouteFor("web-1.tar.gz") != c.Routes[0] || c.OutputDirFor("web-1.tar.gz") != "/srv/web" {
+		t.Fatal("expected releases to be routed")
+	}
+
+	c.Exclude = []string{"["}
+	if c.ValidateRouting() == nil {
+		t.Fatal("expected error for invalid Exclude pattern")
+	}
+}
@@ -0,0 +1,165 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"github.com/mitchellh/go-homedir"
+
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const secretExecTimeout = 30 * time.Second
+
+// Resolves a secret field. Values may refer to a secret stored elsewhere:
+//
+//	env:NAME    the environment variable NAME.
+//	file:PATH   the contents of the file at PATH.
+//	exec:CMD    the output of CMD, split into arguments on spaces.
+//
+// Trailing newlines are removed from files and command output. Other
+// values are returned unchanged.
+func resolveSecret(field string, value string) (string, error) {
+	var rv string
+	var err error
+
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := value[len("env:"):]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New(field + ": environment variable " + name + " is not set.")
+		}
+		rv = v
+	case strings.HasPrefix(value, "file:"):
+		rv, err = readSecretFile(value[len("file:"):])
+		if err != nil {
+			return "", errors.New(field + ": " + err.Error())
+		}
+	case strings.HasPrefix(value, "exec:"):
+		rv, err = execSecret(value[len("exec:"):])
+		if err != nil {
+			return "", errors.New(field + ": " + err.Error())
+		}
+	default:
+		return value, nil
+	}
+
+	if rv == "" {
+		return "", errors.New(field + ": " + value + " is empty.")
+	}
+
+	return rv, nil
+}
+
+func readSecretFile(file string) (string, error) {
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func execSecret(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("exec: requires a command.")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(secretExecTimeout):
+		cmd.Process.Kill()
+		<-done
+		return "", errors.New(args[0] + " timed out.")
+	}
+
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return "", errors.New(args[0] + " failed: " + err.Error() + ": " + msg)
+		}
+		return "", errors.New(args[0] + " failed: " + err.Error())
+	}
+
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
+
+type secretField struct {
+	name  string
+	value *string
+}
+
+func (c *Conf) resolveSecrets() error {
+	fields := []secretField{
+		{"SharedSecret", &c.SharedSecret},
+		{"Passphrase", &c.Passphrase},
+		{"SigningKey", &c.SigningKey},
+	}
+
+	for _, k := range c.Keys {
+		fields = append(fields, secretField{"Keys." + k.Id + ".Secret", &k.Secret})
+	}
+
+	if c.Aws != nil {
+		fields = append(fields,
+			secretField{"Aws.AccessKey", &c.Aws.AccessKey},
+			secretField{"Aws.SecretKey", &c.Aws.SecretKey})
+	}
+
+	if c.Rackspace != nil {
+		fields = append(fields, secretField{"Rackspace.ApiKey", &c.Rackspace.ApiKey})
+	}
+
+	for _, f := range fields {
+		v, err := resolveSecret(f.name, *f.value)
+		if err != nil {
+			return err
+		}
+		*f.value = v
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	os.Setenv("DISTSYNC_TEST_SECRET", "from-env")
+	defer os.Unsetenv("DISTSYNC_TEST_SECRET")
+
+	f, err := ioutil.TempFile("", ".distsync-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte("from-file\n"))
+	f.Close()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for value, expected := range map[string]string{
+		"inline":                   "inline",
+		"env:DISTSYNC_TEST_SECRET": "from-env",
+		"file:" + f.Name():         "from-file",
+		"exec:echo from-exec":      "from-exec",
+	} {
+		v, err := resolveSecret("SharedSecret", value)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if v != expected {
+			t.Fatalf("resolved %s to %s, expected %s", value, v, expected)
+		}
+	}
+
+	for _, value := range []string{
+		"env:DISTSYNC_TEST_MISSING",
+		"file:/nonexistent/distsync",
+		"exec:/nonexistent/distsync",
+		"exec:false",
+		"exec:",
+	} {
+		_, err := resolveSecret("SharedSecret", value)
+		if err == nil {
+			t.Fatalf("expected error resolving %s", value)
+		}
+	}
+}
+
+func TestConfResolveSecrets(t *testing.T) {
+	os.Setenv("DISTSYNC_TEST_SECRET", "from-env")
+	defer os.Unsetenv("DISTSYNC_TEST_SECRET")
+
+	f, err := ioutil.TempFile("", ".distsync-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte(`
+SharedSecret = "env:DISTSYNC_TEST_SECRET"
+[Aws]
+  SecretKey = "exec:echo aws-secret"
+`))
+	f.Close()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c, err := ConfFromFile(f.Name())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if c.SharedSecret != "from-env" || c.Aws.SecretKey != "aws-secret" {
+		t.Fatalf("secrets not resolved: %s %s", c.SharedSecret, c.Aws.SecretKey)
+	}
+
+	raw, err := RawConfFromFile(f.Name())
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if raw.SharedSecret != "env:DISTSYNC_TEST_SECRET" {
+		t.Fatalf("raw secret was resolved: %s", raw.SharedSecret)
+	}
+}
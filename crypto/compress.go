@@ -0,0 +1,264 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"github.com/pquerna/distsync/common"
+
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Compression algorithms, as named in the configuration and recorded
+// in the header of compressed files.
+const (
+	CompressZstd = "zstd"
+	CompressGzip = "gzip"
+)
+
+// Magic numbers of formats that are already compressed, and don't
+// shrink when compressed again.
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	{'P', 'K', 0x03, 0x04},             // zip, jar
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7-zip
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+}
+
+// Returns the compression algorithm named by c.Compress, or "" if files
+// are not compressed.
+func compressionFromConf(c *common.Conf) (string, error) {
+	switch strings.ToLower(c.Compress) {
+	case "", "none":
+		return "", nil
+	case CompressZstd:
+		return CompressZstd, nil
+	case CompressGzip:
+		return CompressGzip, nil
+	}
+
+	return "", errors.New("Unknown compression: " + c.Compress)
+}
+
+func validCompression(alg string) bool {
+	return alg == "" || alg == CompressZstd || alg == CompressGzip
+}
+
+// Compression returns the algorithm to compress the file in r with, or
+// "" if compression is disabled or the file is already compressed.
+// r is left at its start.
+func Compression(c *common.Conf, r io.ReadSeeker) (string, error) {
+	alg, err := compressionFromConf(c)
+	if err != nil || alg == "" {
+		return alg, err
+	}
+
+	head := make([]byte, 8)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(head[:n], magic) {
+			return "", nil
+		}
+	}
+
+	return alg, nil
+}
+
+// CompressedSize returns the length of the payload EncryptWithHeader
+// encrypts for size bytes of cleartext from r: the compressed length if
+// header compresses the file, otherwise size. r is only read when the
+// file is compressed. Pass the result to EncryptedSize.
+func CompressedSize(header []byte, r io.Reader, size int64) (int64, error) {
+	alg, err := headerCompression(header)
+	if err != nil {
+		return 0, err
+	}
+
+	if alg == "" {
+		return size, nil
+	}
+
+	cr := newCompressReader(alg, io.LimitReader(r, size))
+	defer cr.Close()
+
+	return io.Copy(ioutil.Discard, cr)
+}
+
+// Returns the compression recorded in a file header, without needing
+// the keys to decrypt the file.
+func headerCompression(header []byte) (string, error) {
+	hr := bytes.NewReader(header)
+	cv, err := readContainerHeader(hr)
+	if err != nil {
+		return "", err
+	}
+
+	if !cv.headerFields {
+		return "", nil
+	}
+
+	_, err = hr.Seek(streamSaltSize, 1)
+	if err != nil {
+		return "", err
+	}
+
+	hf, _, err := readHeaderFields(hr)
+	if err != nil {
+		return "", err
+	}
+
+	return hf.compression, nil
+}
+
+// Compressors are set up so the same input always compresses to the
+// same output, which resuming uploads relies on.
+func newCompressor(alg string, w io.Writer) (io.WriteCloser, error) {
+	switch alg {
+	case CompressZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	}
+
+	return nil, errors.New("Unknown compression: " + alg)
+}
+
+func decompress(alg string, r io.Reader, w io.Writer) error {
+	switch alg {
+	case CompressZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		_, err = io.Copy(w, zr)
+		return err
+	case CompressGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(w, gr)
+		if err != nil {
+			return err
+		}
+		return gr.Close()
+	}
+
+	return errors.New("Unknown compression: " + alg)
+}
+
+// compressReader reads the compressed form of another reader. Close
+// must be called to stop compressing if the output isn't read to the end.
+type compressReader struct {
+	pr   *io.PipeReader
+	done chan error
+}
+
+func newCompressReader(alg string, r io.Reader) *compressReader {
+	pr, pw := io.Pipe()
+	cr := &compressReader{
+		pr:   pr,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		cw, err := newCompressor(alg, pw)
+		if err == nil {
+			_, err = io.Copy(cw, r)
+			cerr := cw.Close()
+			if err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+		cr.done <- err
+	}()
+
+	return cr
+}
+
+func (cr *compressReader) Read(p []byte) (int, error) {
+	return cr.pr.Read(p)
+}
+
+func (cr *compressReader) Close() error {
+	cr.pr.Close()
+	<-cr.done
+	return nil
+}
+
+// decompressWriter decompresses the data written to it into another
+// writer. Close waits for the decompressed data to be written.
+type decompressWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDecompressWriter(alg string, w io.Writer) *decompressWriter {
+	pr, pw := io.Pipe()
+	dw := &decompressWriter{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		err := decompress(alg, pr, w)
+		// fails any further writes if decompression stopped early.
+		pr.CloseWithError(err)
+		dw.done <- err
+	}()
+
+	return dw
+}
+
+func (dw *decompressWriter) Write(p []byte) (int, error) {
+	return dw.pw.Write(p)
+}
+
+func (dw *decompressWriter) Close() error {
+	dw.pw.Close()
+	return <-dw.done
+}
+
+// Stops decompressing after an error in the compressed data.
+func (dw *decompressWriter) abort(err error) {
+	dw.pw.CloseWithError(err)
+	<-dw.done
+}
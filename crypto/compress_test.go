@@ -0,0 +1,172 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func testCompressEncrypt(t *testing.T, ec Cryptor, alg string, cleartext []byte) ([]byte, []byte) {
+	header, err := ec.NewHeader(alg)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	payload, err := CompressedSize(header, bytes.NewReader(cleartext), int64(len(cleartext)))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	expected, err := ec.EncryptedSize(header, payload)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	dst := &bytes.Buffer{}
+	err = ec.EncryptWithHeader(header, bytes.NewReader(cleartext), dst)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if int64(dst.Len()) != expected {
+		t.Fatalf("EncryptedSize = %d, EncryptWithHeader wrote %d bytes", expected, dst.Len())
+	}
+
+	return header, dst.Bytes()
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	cleartext := []byte(strings.Repeat("hello world ", int(v1chunkSize)/4))
+
+	for _, alg := range []string{CompressZstd, CompressGzip} {
+		ec, err := NewChacha20poly1305(testSecret)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		header, b := testCompressEncrypt(t, ec, alg, cleartext)
+		if len(b) >= len(cleartext)/10 {
+			t.Fatalf("%s: expected compressed output, got %d bytes", alg, len(b))
+		}
+
+		// resumed uploads need the same output every time.
+		dst := &bytes.Buffer{}
+		err = ec.EncryptWithHeader(header, bytes.NewReader(cleartext), dst)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if !bytes.Equal(b, dst.Bytes()) {
+			t.Fatalf("%s: expected the same output for the same header and cleartext", alg)
+		}
+
+		roundtrip := &bytes.Buffer{}
+		err = ec.Decrypt(bytes.NewReader(b), roundtrip)
+		if err != nil {
+			t.Fatalf("%s: error: %v", alg, err)
+		}
+
+		if !bytes.Equal(roundtrip.Bytes(), cleartext) {
+			t.Fatalf("%s: Failed round trip.", alg)
+		}
+	}
+}
+
+func TestCompressTampered(t *testing.T) {
+	ec, err := NewAES128SHA256(testSecret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, b := testCompressEncrypt(t, ec, CompressGzip, []byte("hello world"))
+
+	// swapping the algorithm invalidates the wrapped data key.
+	i := bytes.Index(b, []byte(CompressGzip))
+	if i < 0 {
+		t.Fatal("expected compression in the header")
+	}
+	copy(b[i:], []byte("zstd"))
+
+	err = ec.Decrypt(bytes.NewReader(b), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected error from tampered compression field")
+	}
+}
+
+func TestCompressNeedsHeaderFields(t *testing.T) {
+	cv, err := containerByHeader([]byte("distsync03"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	ec, err := newEtmCryptorVersion(singleKeyring(testSecret), cv)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = ec.NewHeader(CompressZstd)
+	if err == nil {
+		t.Fatal("expected error compressing a file without header fields")
+	}
+
+	_, err = ec.NewHeader("lzma")
+	if err == nil {
+		t.Fatal("expected error from unknown compression")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	c := common.NewConf()
+
+	alg, err := Compression(c, bytes.NewReader([]byte("hello world")))
+	if err != nil || alg != "" {
+		t.Fatalf("expected no compression by default, got %q: %v", alg, err)
+	}
+
+	c.Compress = "ZSTD"
+	alg, err = Compression(c, bytes.NewReader([]byte("hello world")))
+	if err != nil || alg != CompressZstd {
+		t.Fatalf("expected zstd, got %q: %v", alg, err)
+	}
+
+	gz := &bytes.Buffer{}
+	gw := gzip.NewWriter(gz)
+	gw.Write([]byte("hello world"))
+	gw.Close()
+
+	r := bytes.NewReader(gz.Bytes())
+	alg, err = Compression(c, r)
+	if err != nil || alg != "" {
+		t.Fatalf("expected gzip input to be left alone, got %q: %v", alg, err)
+	}
+
+	if r.Len() != gz.Len() {
+		t.Fatal("expected reader to be back at its start")
+	}
+
+	c.Compress = "lzma"
+	_, err = Compression(c, bytes.NewReader(nil))
+	if err == nil {
+		t.Fatal("expected error from unknown compression")
+	}
+}
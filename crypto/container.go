@@ -0,0 +1,154 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/codahale/chacha20poly1305"
+	"github.com/codahale/etm"
+
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"strings"
+)
+
+const containerHeaderSize = 10
+
+var ErrBrokenContainer = errors.New("File was written by a broken version of distsync, and must be uploaded again.")
+
+// A version of the encrypted file format. The version is identified by
+// the header at the start of every encrypted file, so decryption always
+// uses the cipher the file was written with, no matter what the
+// current configuration says.
+type containerVersion struct {
+	header []byte
+	// Name of the cipher, as used by Conf.Encrypt.
+	cipher  string
+	newAEAD func(secret []byte) (cipher.AEAD, error)
+	// Prefix each chunk with the nonce used to seal it. etm includes
+	// its IV in the ciphertext, other AEADs need it stored separately.
+	explicitNonce bool
+	// Use the STREAM construction, see encryptStream.
+	stream bool
+	// Header fields follow the salt, see headerFields.
+	headerFields bool
+	// Chunks are encrypted with a random per-file data key, wrapped
+	// with the shared secret and stored in the header fields.
+	envelope bool
+	// Files with this header can't be decrypted, and return this error.
+	unreadable error
+}
+
+// Known container versions, oldest first. New files are written
+// with the newest version for the configured cipher.
+var containerVersions = []*containerVersion{
+	&containerVersion{
+		header:  []byte("distsync01"),
+		cipher:  "AEAD_AES_128_CBC_HMAC_SHA_256",
+		newAEAD: etm.NewAES128SHA256,
+	},
+	// Written without the nonce of each chunk, which can't be recovered.
+	&containerVersion{
+		header:     []byte("distsync02"),
+		cipher:     "AEAD_CHACHA20_POLY1305",
+		newAEAD:    chacha20poly1305.New,
+		unreadable: ErrBrokenContainer,
+	},
+	&containerVersion{
+		header:        []byte("distsync03"),
+		cipher:        "AEAD_CHACHA20_POLY1305",
+		newAEAD:       chacha20poly1305.New,
+		explicitNonce: true,
+		stream:        true,
+	},
+	&containerVersion{
+		header:  []byte("distsync04"),
+		cipher:  "AEAD_AES_128_CBC_HMAC_SHA_256",
+		newAEAD: etm.NewAES128SHA256,
+		stream:  true,
+	},
+	&containerVersion{
+		header:        []byte("distsync05"),
+		cipher:        "AEAD_CHACHA20_POLY1305",
+		newAEAD:       chacha20poly1305.New,
+		explicitNonce: true,
+		stream:        true,
+		headerFields:  true,
+	},
+	&containerVersion{
+		header:       []byte("distsync06"),
+		cipher:       "AEAD_AES_128_CBC_HMAC_SHA_256",
+		newAEAD:      etm.NewAES128SHA256,
+		stream:       true,
+		headerFields: true,
+	},
+	&containerVersion{
+		header:        []byte("distsync07"),
+		cipher:        "AEAD_CHACHA20_POLY1305",
+		newAEAD:       chacha20poly1305.New,
+		explicitNonce: true,
+		stream:        true,
+		headerFields:  true,
+		envelope:      true,
+	},
+	&containerVersion{
+		header:       []byte("distsync08"),
+		cipher:       "AEAD_AES_128_CBC_HMAC_SHA_256",
+		newAEAD:      etm.NewAES128SHA256,
+		stream:       true,
+		headerFields: true,
+		envelope:     true,
+	},
+}
+
+func containerByHeader(header []byte) (*containerVersion, error) {
+	for _, cv := range containerVersions {
+		if bytes.Equal(cv.header, header) {
+			if cv.unreadable != nil {
+				return nil, cv.unreadable
+			}
+			return cv, nil
+		}
+	}
+
+	return nil, errors.New("Unknown header in encrypted file.")
+}
+
+// Reads the header at the start of an encrypted file.
+func readContainerHeader(r io.Reader) (*containerVersion, error) {
+	header := make([]byte, containerHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return containerByHeader(header)
+}
+
+func containerByCipher(name string) (*containerVersion, error) {
+	name = strings.ToUpper(name)
+
+	for i := len(containerVersions) - 1; i >= 0; i-- {
+		if containerVersions[i].cipher == name {
+			return containerVersions[i], nil
+		}
+	}
+
+	return nil, errors.New("Unknown crypto backend: " + name)
+}
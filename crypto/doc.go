@@ -20,17 +20,28 @@ package crypto
 import (
 	"github.com/pquerna/distsync/common"
 
-	"errors"
 	"io"
-	"strings"
 )
 
 type Encryptor interface {
 	Encrypt(io.Reader, io.Writer) error
+	// Deterministically encrypts a file name for use as an object name.
+	EncryptName(string) (string, error)
+	// Returns a new file header for EncryptWithHeader, which compresses
+	// files with the named algorithm, or not at all for "".
+	NewHeader(string) ([]byte, error)
+	// Encrypts after the given header. The output only depends on
+	// the header and the cleartext.
+	EncryptWithHeader([]byte, io.Reader, io.Writer) error
+	// Returns the exact length EncryptWithHeader writes for a payload
+	// length. See CompressedSize.
+	EncryptedSize([]byte, int64) (int64, error)
 }
 
 type Decryptor interface {
 	Decrypt(io.Reader, io.Writer) error
+	// Decrypts an object name created by EncryptName.
+	DecryptName(string) (string, error)
 }
 
 type Cryptor interface {
@@ -38,20 +49,32 @@ type Cryptor interface {
 	Decryptor
 }
 
+// NameLookup finds object names created by EncryptName with any key of
+// the keyring, like the chunks of deduplicated files, which keep their
+// names when the active key changes.
+type NameLookup interface {
+	// Returns the name encrypted with each key, the active key first.
+	EncryptNames(string) ([]string, error)
+}
+
+// Rewrapper copies an encrypted file, re-encrypting only its data key with
+// the active key. Files without a data key return ErrNotEnvelope.
+type Rewrapper interface {
+	Rewrap(io.Reader, io.Writer) error
+	// Returns the rewrapped header of the file read from the reader, and
+	// the length of the header it replaces, for streaming a rewrap.
+	RewrapHeader(io.Reader) ([]byte, int64, error)
+}
+
 func NewFromConf(c *common.Conf) (Cryptor, error) {
 	// currently etm use a 32 byte secret.
 	// TODO: better abstraction / interface.
-	secret, err := decodeSecret(c.SharedSecret, 32)
+	keys, err := keyringFromConf(c)
 	if err != nil {
 		return nil, err
 	}
 
-	switch strings.ToUpper(c.Encrypt) {
-	case "AEAD_AES_128_CBC_HMAC_SHA_256":
-		return NewAES128SHA256(secret)
-	case "AEAD_CHACHA20_POLY1305":
-		return NewChacha20poly1305(secret)
-	}
-
-	return nil, errors.New("Unknown crypto backend: " + c.Encrypt)
+	// Encrypt only picks the cipher for new files, Decrypt uses
+	// the cipher recorded in each file's header.
+	return newEtmCryptor(keys, c.Encrypt)
 }
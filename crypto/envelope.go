@@ -0,0 +1,164 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+const dataKeySize = 32
+
+var ErrNotEnvelope = errors.New("Encrypted file does not have a wrapped data key.")
+
+// The wrapped key is authenticated with the container header, the salt
+// and every other header field, so none of them can be swapped between
+// files or altered.
+func wrapAD(cv *containerVersion, salt []byte, hf *headerFields) []byte {
+	ad := make([]byte, 0, len(cv.header)+len(salt)+64)
+	ad = append(ad, cv.header...)
+	ad = append(ad, salt...)
+	return append(ad, hf.marshalAuthenticated()...)
+}
+
+// Encrypts a per-file data key with a key derived from the shared secret,
+// using the file's cipher.
+func wrapDataKey(cv *containerVersion, secret []byte, salt []byte, hf *headerFields, dataKey []byte) ([]byte, error) {
+	c, err := cv.newAEAD(deriveKey(secret, "distsync key wrap"))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, c.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	var wrapped []byte
+	if cv.explicitNonce {
+		wrapped = append(wrapped, nonce...)
+	}
+
+	return c.Seal(wrapped, nonce, dataKey, wrapAD(cv, salt, hf)), nil
+}
+
+func unwrapDataKey(cv *containerVersion, secret []byte, salt []byte, hf *headerFields) ([]byte, error) {
+	if hf.wrappedKey == nil {
+		return nil, errors.New("Encrypted file is missing its data key.")
+	}
+
+	c, err := cv.newAEAD(deriveKey(secret, "distsync key wrap"))
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := hf.wrappedKey
+	nonce := make([]byte, c.NonceSize())
+	if cv.explicitNonce {
+		if len(wrapped) < len(nonce) {
+			return nil, errors.New("Encrypted file has a truncated data key.")
+		}
+		nonce = wrapped[:len(nonce)]
+		wrapped = wrapped[len(nonce):]
+	}
+
+	dataKey, err := c.Open(nil, nonce, wrapped, wrapAD(cv, salt, hf))
+	if err != nil {
+		return nil, errors.New("Data key failed authentication, is the shared secret correct?")
+	}
+
+	if len(dataKey) != dataKeySize {
+		return nil, errors.New("Encrypted file has an invalid data key.")
+	}
+
+	return dataKey, nil
+}
+
+// Rewrap copies an encrypted file from r to w, replacing its wrapped data
+// key with one wrapped by the active key. The encrypted chunks are copied
+// as they are, so rotating keys doesn't need the cleartext.
+func (e *EtmCryptor) Rewrap(r io.Reader, w io.Writer) error {
+	header, _, err := e.RewrapHeader(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// RewrapHeader reads the header of an encrypted file from r, and returns
+// it with the data key wrapped by the active key, and the length of the
+// header it replaces. The rest of r follows the new header unchanged.
+func (e *EtmCryptor) RewrapHeader(r io.Reader) ([]byte, int64, error) {
+	cv, err := readContainerHeader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !cv.envelope {
+		return nil, 0, ErrNotEnvelope
+	}
+
+	salt := make([]byte, streamSaltSize)
+	_, err = io.ReadFull(r, salt)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hf, raw, err := readHeaderFields(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	secret, err := e.secret(hf.keyId)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dataKey, err := unwrapDataKey(cv, secret, salt, hf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rewrapped := *hf
+	rewrapped.keyId = e.active
+	rewrapped.wrappedKey, err = wrapDataKey(cv, e.activeSecret(), salt, &rewrapped, dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(cv.header)
+	buf.Write(salt)
+	err = writeHeaderFields(buf, rewrapped.marshal())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	oldLen := int64(len(cv.header) + len(salt) + 2 + len(raw))
+	return buf.Bytes(), oldLen, nil
+}
@@ -0,0 +1,129 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnvelopeRewrap(t *testing.T) {
+	before, after, _ := testRotatedConfs(t)
+
+	oldEc, err := NewFromConf(before)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	newEc, err := NewFromConf(after)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	oldFile := testStreamEncrypt(t, oldEc, []byte("hello world"))
+
+	newFile := &bytes.Buffer{}
+	err = newEc.(Rewrapper).Rewrap(bytes.NewReader(oldFile), newFile)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// only the header changes, the chunks are copied as they are.
+	oldChunks := testStreamChunks(t, oldFile)
+	newChunks := testStreamChunks(t, newFile.Bytes())
+	if !bytes.Equal(oldFile[oldChunks[0]:], newFile.Bytes()[newChunks[0]:]) {
+		t.Fatal("expected rewrap to keep the encrypted chunks")
+	}
+
+	// streaming a rewrap needs the new length before writing it.
+	header, n, err := newEc.(Rewrapper).RewrapHeader(bytes.NewReader(oldFile))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if n != int64(oldChunks[0]) || len(header) != newChunks[0] {
+		t.Fatalf("expected header lengths %d and %d, got: %d and %d", oldChunks[0], newChunks[0], n, len(header))
+	}
+
+	roundtrip := &bytes.Buffer{}
+	err = newEc.Decrypt(bytes.NewReader(newFile.Bytes()), roundtrip)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if roundtrip.String() != "hello world" {
+		t.Fatal("Failed round trip.")
+	}
+
+	// servers without the new key can't unwrap it.
+	err = oldEc.Decrypt(bytes.NewReader(newFile.Bytes()), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected error from unknown key ID")
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	ec, err := NewChacha20poly1305(testSecret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b := testStreamEncrypt(t, ec, []byte("hello world"))
+
+	// last byte of the header fields is part of the wrapped key.
+	chunks := testStreamChunks(t, b)
+	b[chunks[0]-1] ^= 0x01
+
+	err = ec.Decrypt(bytes.NewReader(b), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected error from tampered data key")
+	}
+}
+
+func TestEnvelopeDataKeys(t *testing.T) {
+	ec, err := NewAES128SHA256(testSecret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	a := testStreamEncrypt(t, ec, []byte("hello world"))
+	b := testStreamEncrypt(t, ec, []byte("hello world"))
+
+	if bytes.Equal(a[testStreamChunks(t, a)[0]:], b[testStreamChunks(t, b)[0]:]) {
+		t.Fatal("expected each file to use its own data key")
+	}
+}
+
+func TestRewrapNotEnvelope(t *testing.T) {
+	cv, err := containerByHeader([]byte("distsync05"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	ec, err := newEtmCryptorVersion(singleKeyring(testSecret), cv)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b := testStreamEncrypt(t, ec, []byte("hello world"))
+
+	err = ec.Rewrap(bytes.NewReader(b), &bytes.Buffer{})
+	if err != ErrNotEnvelope {
+		t.Fatalf("expected ErrNotEnvelope, got: %v", err)
+	}
+}
@@ -18,11 +18,6 @@
 package crypto
 
 import (
-	"github.com/codahale/chacha20poly1305"
-	"github.com/codahale/etm"
-
-	"bytes"
-	"crypto/cipher"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -32,75 +27,93 @@ import (
 )
 
 type EtmCryptor struct {
-	ctype  string
-	secret []byte
-	c      cipher.AEAD
+	*keyring
+	// container version used by Encrypt.
+	version *containerVersion
 }
 
-// 32-byte secret
-func NewAES128SHA256(secret []byte) (Cryptor, error) {
-	e, err := etm.NewAES128SHA256(secret)
+func newEtmCryptor(keys *keyring, cipherName string) (*EtmCryptor, error) {
+	cv, err := containerByCipher(cipherName)
 	if err != nil {
 		return nil, err
 	}
 
-	return &EtmCryptor{
-		secret: secret,
-		c:      e,
-		ctype:  "AEAD_AES_128_CBC_HMAC_SHA_256",
-	}, nil
+	return newEtmCryptorVersion(keys, cv)
 }
 
-// 32-byte secret
-func NewChacha20poly1305(secret []byte) (Cryptor, error) {
-	e, err := chacha20poly1305.New(secret)
+func newEtmCryptorVersion(keys *keyring, cv *containerVersion) (*EtmCryptor, error) {
+	// check the secret works with this cipher.
+	_, err := cv.newAEAD(keys.activeSecret())
 	if err != nil {
 		return nil, err
 	}
 
 	return &EtmCryptor{
-		secret: secret,
-		c:      e,
-		ctype:  "AEAD_CHACHA20_POLY1305",
+		keyring: keys,
+		version: cv,
 	}, nil
 }
 
-var v1header = []byte("distsync01")
+// 32-byte secret
+func NewAES128SHA256(secret []byte) (Cryptor, error) {
+	return newEtmCryptor(singleKeyring(secret), "AEAD_AES_128_CBC_HMAC_SHA_256")
+}
+
+// 32-byte secret
+func NewChacha20poly1305(secret []byte) (Cryptor, error) {
+	return newEtmCryptor(singleKeyring(secret), "AEAD_CHACHA20_POLY1305")
+}
+
 var v1chunkSize = uint32(1000000)
 var v1maxChunkSize = uint32(v1chunkSize * 10)
 
-//
 // Encrypts an cleartext input Reader in 1 megabyte chunks.
 //
+// New files use the v5 STREAM format with a per-file data key, see
+// encryptStream and wrapDataKey.
+//
 // File Format:
 //
 // Header: 10 bytes for version and cipher identification.
-//		"distsync01": v1, AEAD_AES_128_CBC_HMAC_SHA_256.
-//		"distsync02": v2, AEAD_CHACHA20_POLY1305
-// Data block(s):
-// 		4-bytes chunk size. (PutUint32)
-// 		AEAD encrypted data. (up to `v1maxChunkSize`)
-// Trailing hash block:
-// 		0 byte data block, followed by:
-//		mac []byte: 32 byte HMAC of file's contents.
+//
+//	"distsync01": v1, AEAD_AES_128_CBC_HMAC_SHA_256.
+//	"distsync02": v2, AEAD_CHACHA20_POLY1305 without nonces, can't be decrypted.
+//	"distsync03": v3, AEAD_CHACHA20_POLY1305, STREAM.
+//	"distsync04": v3, AEAD_AES_128_CBC_HMAC_SHA_256, STREAM.
+//	"distsync05": v4, AEAD_CHACHA20_POLY1305, STREAM with header fields.
+//	"distsync06": v4, AEAD_AES_128_CBC_HMAC_SHA_256, STREAM with header fields.
+//	"distsync07": v5, AEAD_CHACHA20_POLY1305, STREAM with a wrapped data key.
+//	"distsync08": v5, AEAD_AES_128_CBC_HMAC_SHA_256, STREAM with a wrapped data key.
+//
+// v1 and v2 data block(s):
+//
+//	4-bytes chunk size. (PutUint32)
+//	AEAD encrypted data. (up to `v1maxChunkSize`)
+//
+// v1 and v2 trailing hash block:
+//
+//	0 byte data block, followed by:
+//	mac []byte: 32 byte HMAC of file's contents.
 func (e *EtmCryptor) Encrypt(r io.Reader, w io.Writer) error {
+	if e.version.stream {
+		return e.encryptStream(r, w)
+	}
+
+	secret := e.activeSecret()
+	c, err := e.version.newAEAD(secret)
+	if err != nil {
+		return err
+	}
+
 	buf := make([]byte, v1chunkSize)
-	nonce := make([]byte, e.c.NonceSize())
-	enbuf := make([]byte, cap(buf)+e.c.Overhead())
+	nonce := make([]byte, c.NonceSize())
+	enbuf := make([]byte, cap(buf)+c.Overhead())
 	lbuf := make([]byte, 4)
 	// TOOD: TeeWriter for HMAC?
-	mac := hmac.New(sha256.New, e.secret)
-
-	s := ""
-	switch e.ctype {
-	case "AEAD_AES_128_CBC_HMAC_SHA_256":
-		s = "distsync01"
-	case "AEAD_CHACHA20_POLY1305":
-		s = "distsync02"
-	}
+	mac := hmac.New(sha256.New, secret)
 
-	_, err := io.WriteString(w, s)
-	mac.Write([]byte(s))
+	_, err = w.Write(e.version.header)
+	mac.Write(e.version.header)
 
 	if err != nil {
 		return err
@@ -117,7 +130,7 @@ func (e *EtmCryptor) Encrypt(r io.Reader, w io.Writer) error {
 				return err
 			}
 
-			enbuf = e.c.Seal(enbuf, nonce, buf[:n], []byte{})
+			enbuf = c.Seal(enbuf, nonce, buf[:n], []byte{})
 
 			binary.BigEndian.PutUint32(lbuf, uint32(len(enbuf)))
 
@@ -158,18 +171,30 @@ func (e *EtmCryptor) Encrypt(r io.Reader, w io.Writer) error {
 }
 
 func (e *EtmCryptor) Decrypt(r io.Reader, w io.Writer) error {
-	header := make([]byte, 10)
+	header := make([]byte, containerHeaderSize)
 	lbuf := make([]byte, 4)
-	mac := hmac.New(sha256.New, e.secret)
 	_, err := io.ReadFull(r, header)
 	if err != nil {
 		return err
 	}
 
-	if bytes.Compare(v1header, header) != 0 {
-		return errors.New("Unknown header in encrypted file.")
+	cv, err := containerByHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if cv.stream {
+		return e.decryptStream(cv, r, w)
+	}
+
+	// v1 and v2 files don't record which key encrypted them.
+	secret := e.fallbackSecret()
+	c, err := cv.newAEAD(secret)
+	if err != nil {
+		return err
 	}
 
+	mac := hmac.New(sha256.New, secret)
 	mac.Write(header)
 
 	for {
@@ -211,7 +236,7 @@ func (e *EtmCryptor) Decrypt(r io.Reader, w io.Writer) error {
 
 		mac.Write(buf)
 
-		clearbuf, err = e.c.Open(clearbuf, nil, buf, []byte{})
+		clearbuf, err = c.Open(clearbuf, nil, buf, []byte{})
 
 		if err != nil {
 			return err
@@ -77,3 +77,95 @@ func TestTampered(t *testing.T) {
 	t.Fatalf("Missing error from tampered data: enreader:%v", enreader)
 
 }
+
+func TestRoundTripChacha20poly1305(t *testing.T) {
+	src := bytes.NewReader([]byte("hello world"))
+	dst := &bytes.Buffer{}
+	roundtrip := &bytes.Buffer{}
+
+	ec, err := NewChacha20poly1305([]byte("hellohelloworld1hellohelloworld1"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = ec.Encrypt(src, dst)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	cv, err := containerByHeader(dst.Bytes()[:containerHeaderSize])
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if cv.cipher != "AEAD_CHACHA20_POLY1305" {
+		t.Fatalf("unexpected header: %s", dst.Bytes()[:containerHeaderSize])
+	}
+
+	err = ec.Decrypt(bytes.NewReader(dst.Bytes()), roundtrip)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if roundtrip.String() != "hello world" {
+		t.Fatal("Failed round trip.")
+	}
+}
+
+func TestDecryptUsesFileHeader(t *testing.T) {
+	secret := []byte("hellohelloworld1hellohelloworld1")
+
+	aes, err := NewAES128SHA256(secret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	chacha, err := NewChacha20poly1305(secret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, pair := range [][]Cryptor{{aes, chacha}, {chacha, aes}} {
+		dst := &bytes.Buffer{}
+		roundtrip := &bytes.Buffer{}
+
+		err = pair[0].Encrypt(bytes.NewReader([]byte("hello world")), dst)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = pair[1].Decrypt(bytes.NewReader(dst.Bytes()), roundtrip)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if roundtrip.String() != "hello world" {
+			t.Fatal("Failed round trip.")
+		}
+	}
+}
+
+func TestUnknownHeader(t *testing.T) {
+	ec, err := NewAES128SHA256([]byte("hellohelloworld1hellohelloworld1"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = ec.Decrypt(bytes.NewReader([]byte("distsync99")), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("Missing error from unknown header")
+	}
+}
+
+func TestBrokenHeader(t *testing.T) {
+	ec, err := NewChacha20poly1305([]byte("hellohelloworld1hellohelloworld1"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// distsync02 files don't store their nonces.
+	err = ec.Decrypt(bytes.NewReader([]byte("distsync02\x00\x00\x00\x00")), &bytes.Buffer{})
+	if err != ErrBrokenContainer {
+		t.Fatalf("expected ErrBrokenContainer, got: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Header fields are stored after the salt in v4 files, as a 2-byte
+// total length followed by the fields. Each field is a 1-byte tag,
+// a 2-byte length and the value. In v4 files the fields are mixed into
+// the file key, so tampering with them makes every chunk fail to decrypt.
+// In v5 files they are authenticated when the data key is unwrapped.
+const (
+	fieldKeyId byte = 1
+	// The per-file data key, encrypted with the key named by fieldKeyId.
+	fieldWrappedKey byte = 2
+	// The algorithm the cleartext was compressed with before encryption.
+	fieldCompression byte = 3
+)
+
+const maxHeaderFieldsSize = 0xffff
+
+type headerFields struct {
+	keyId       string
+	wrappedKey  []byte
+	compression string
+}
+
+func appendHeaderField(b []byte, tag byte, value []byte) []byte {
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(value)))
+	b = append(b, tag)
+	b = append(b, l...)
+	return append(b, value...)
+}
+
+func (hf *headerFields) marshal() []byte {
+	b := hf.marshalAuthenticated()
+	if hf.wrappedKey != nil {
+		b = appendHeaderField(b, fieldWrappedKey, hf.wrappedKey)
+	}
+	return b
+}
+
+// Marshals every field except the wrapped key, which can't authenticate
+// itself. These bytes are the additional data when wrapping the data key.
+func (hf *headerFields) marshalAuthenticated() []byte {
+	b := make([]byte, 0, 128)
+	if hf.keyId != "" {
+		b = appendHeaderField(b, fieldKeyId, []byte(hf.keyId))
+	}
+	if hf.compression != "" {
+		b = appendHeaderField(b, fieldCompression, []byte(hf.compression))
+	}
+	return b
+}
+
+func parseHeaderFields(b []byte) (*headerFields, error) {
+	hf := &headerFields{}
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, errors.New("Truncated header field in encrypted file.")
+		}
+
+		tag := b[0]
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[3:]
+
+		if len(b) < l {
+			return nil, errors.New("Truncated header field in encrypted file.")
+		}
+
+		value := b[:l]
+		b = b[l:]
+
+		switch tag {
+		case fieldKeyId:
+			hf.keyId = string(value)
+		case fieldWrappedKey:
+			hf.wrappedKey = value
+		case fieldCompression:
+			hf.compression = string(value)
+			if hf.compression == "" || !validCompression(hf.compression) {
+				return nil, errors.New("Unknown compression in encrypted file, is distsync out of date?")
+			}
+		default:
+			return nil, errors.New("Unknown header field in encrypted file, is distsync out of date?")
+		}
+	}
+
+	return hf, nil
+}
+
+func writeHeaderFields(w io.Writer, raw []byte) error {
+	if len(raw) > maxHeaderFieldsSize {
+		return errors.New("Header fields are too large.")
+	}
+
+	l := make([]byte, 2)
+	binary.BigEndian.PutUint16(l, uint16(len(raw)))
+
+	_, err := w.Write(l)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(raw)
+	return err
+}
+
+// Returns the parsed header fields, and their raw bytes.
+func readHeaderFields(r io.Reader) (*headerFields, []byte, error) {
+	l := make([]byte, 2)
+	_, err := io.ReadFull(r, l)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw := make([]byte, binary.BigEndian.Uint16(l))
+	_, err = io.ReadFull(r, raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hf, err := parseHeaderFields(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hf, raw, nil
+}
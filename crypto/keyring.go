@@ -0,0 +1,219 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// A set of shared secrets identified by short key IDs. New files are
+// encrypted with the active key, and the key ID is stored in their header
+// so any key in the ring can decrypt them.
+type keyring struct {
+	secrets map[string][]byte
+	names   map[string]*nameCryptor
+	// key IDs in the order they were added.
+	ids    []string
+	active string
+	// key used for files written before key IDs were stored in the header.
+	fallback string
+}
+
+func newKeyring() *keyring {
+	return &keyring{
+		secrets: make(map[string][]byte),
+		names:   make(map[string]*nameCryptor),
+		ids:     make([]string, 0, 1),
+	}
+}
+
+func singleKeyring(secret []byte) *keyring {
+	kr := newKeyring()
+	id := keyId(secret)
+	kr.add(id, secret)
+	kr.active = id
+	kr.fallback = id
+	return kr
+}
+
+// Returns a short ID for a secret, used when the configuration
+// doesn't name a key.
+func keyId(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("distsync key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// Builds the keyring from SharedSecret (or Passphrase) and Keys. The
+// shared secret is the active key unless ActiveKey is set, and is used for
+// files that don't record a key ID. Without it, the first of Keys is used.
+func keyringFromConf(c *common.Conf) (*keyring, error) {
+	kr := newKeyring()
+
+	shared, err := sharedSecretFromConf(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if shared != nil {
+		kr.fallback = keyId(shared)
+		err = kr.add(kr.fallback, shared)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, k := range c.Keys {
+		secret, err := decodeSecret(k.Secret, 32)
+		if err != nil {
+			return nil, errors.New("Key '" + k.Id + "': " + err.Error())
+		}
+
+		id := k.Id
+		if id == "" {
+			id = keyId(secret)
+		}
+
+		err = kr.add(id, secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(kr.ids) == 0 {
+		return nil, errors.New("No SharedSecret, Passphrase or Keys in configuration.")
+	}
+
+	if kr.fallback == "" {
+		kr.fallback = kr.ids[0]
+	}
+
+	switch {
+	case c.ActiveKey != "":
+		_, err := kr.secret(c.ActiveKey)
+		if err != nil {
+			return nil, err
+		}
+		kr.active = c.ActiveKey
+	case shared != nil || len(kr.ids) == 1:
+		kr.active = kr.fallback
+	default:
+		return nil, errors.New("ActiveKey must be set when using more than one key.")
+	}
+
+	return kr, nil
+}
+
+// Returns the ID of the key new files are encrypted with.
+func ActiveKeyId(c *common.Conf) (string, error) {
+	kr, err := keyringFromConf(c)
+	if err != nil {
+		return "", err
+	}
+	return kr.active, nil
+}
+
+func (kr *keyring) add(id string, secret []byte) error {
+	if id == "" {
+		return errors.New("Key ID can not be empty.")
+	}
+
+	if len(id) > 255 {
+		return errors.New("Key ID is too long: '" + id + "'")
+	}
+
+	if _, ok := kr.secrets[id]; ok {
+		return errors.New("Duplicate key ID in keyring: '" + id + "'")
+	}
+
+	kr.secrets[id] = secret
+	kr.names[id] = newNameCryptor(secret)
+	kr.ids = append(kr.ids, id)
+	return nil
+}
+
+func (kr *keyring) secret(id string) ([]byte, error) {
+	secret, ok := kr.secrets[id]
+	if !ok {
+		return nil, errors.New("Unknown key ID '" + id + "', add it to Keys in the configuration file.")
+	}
+	return secret, nil
+}
+
+func (kr *keyring) activeSecret() []byte {
+	return kr.secrets[kr.active]
+}
+
+func (kr *keyring) fallbackSecret() []byte {
+	return kr.secrets[kr.fallback]
+}
+
+func (kr *keyring) EncryptName(name string) (string, error) {
+	return kr.names[kr.active].EncryptName(name)
+}
+
+// EncryptNames returns name encrypted with every key, starting with the
+// active one, for finding objects named with an earlier key.
+func (kr *keyring) EncryptNames(name string) ([]string, error) {
+	active, err := kr.EncryptName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{active}
+	for _, id := range kr.ids {
+		if id == kr.active {
+			continue
+		}
+
+		enc, err := kr.names[id].EncryptName(name)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, enc)
+	}
+
+	return rv, nil
+}
+
+// Names don't carry a key ID. The SIV authenticates them,
+// so each key is tried, starting with the active one.
+func (kr *keyring) DecryptName(name string) (string, error) {
+	rv, err := kr.names[kr.active].DecryptName(name)
+	if err == nil {
+		return rv, nil
+	}
+
+	for _, id := range kr.ids {
+		if id == kr.active {
+			continue
+		}
+
+		rv, nerr := kr.names[id].DecryptName(name)
+		if nerr == nil {
+			return rv, nil
+		}
+	}
+
+	return "", err
+}
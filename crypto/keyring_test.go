@@ -0,0 +1,170 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"bytes"
+	"testing"
+)
+
+func testRotatedConfs(t *testing.T) (*common.Conf, *common.Conf, *common.Key) {
+	sec, err := RandomSecret()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	key, err := RandomKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	before := common.NewConf()
+	before.SharedSecret = sec
+
+	after := common.NewConf()
+	after.SharedSecret = sec
+	after.Keys = []*common.Key{key}
+	after.ActiveKey = key.Id
+
+	return before, after, key
+}
+
+func TestKeyringRotation(t *testing.T) {
+	before, after, key := testRotatedConfs(t)
+
+	oldEc, err := NewFromConf(before)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	newEc, err := NewFromConf(after)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	id, err := ActiveKeyId(after)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if id != key.Id {
+		t.Fatalf("unexpected active key: %s", id)
+	}
+
+	oldFile := &bytes.Buffer{}
+	err = oldEc.Encrypt(bytes.NewReader([]byte("hello world")), oldFile)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	newFile := &bytes.Buffer{}
+	err = newEc.Encrypt(bytes.NewReader([]byte("hello world")), newFile)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// the new keyring decrypts files from both keys.
+	for _, b := range [][]byte{oldFile.Bytes(), newFile.Bytes()} {
+		roundtrip := &bytes.Buffer{}
+		err = newEc.Decrypt(bytes.NewReader(b), roundtrip)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if roundtrip.String() != "hello world" {
+			t.Fatal("Failed round trip.")
+		}
+	}
+
+	// servers without the new key can't.
+	err = oldEc.Decrypt(bytes.NewReader(newFile.Bytes()), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected error from unknown key ID")
+	}
+
+	oldName, err := oldEc.EncryptName("hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	newName, err := newEc.EncryptName("hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if oldName == newName {
+		t.Fatal("expected names encrypted with different keys to differ")
+	}
+
+	for _, n := range []string{oldName, newName} {
+		name, err := newEc.DecryptName(n)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if name != "hello.txt" {
+			t.Fatal("Failed name round trip.")
+		}
+	}
+}
+
+func TestKeyringActiveKey(t *testing.T) {
+	a, err := RandomKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b, err := RandomKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c := common.NewConf()
+	c.Keys = []*common.Key{a}
+
+	_, err = NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c.Keys = []*common.Key{a, b}
+	_, err = NewFromConf(c)
+	if err == nil {
+		t.Fatal("expected error without ActiveKey")
+	}
+
+	c.ActiveKey = "unknown"
+	_, err = NewFromConf(c)
+	if err == nil {
+		t.Fatal("expected error from unknown ActiveKey")
+	}
+
+	c.ActiveKey = b.Id
+	_, err = NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c.Keys = []*common.Key{a, a}
+	_, err = NewFromConf(c)
+	if err == nil {
+		t.Fatal("expected error from duplicate key ID")
+	}
+}
@@ -0,0 +1,136 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// Prefix of encrypted object names, used to tell them apart from
+// objects uploaded before file names were encrypted.
+const encryptedNamePrefix = "dsn1-"
+
+const nameSivSize = 16
+
+// nameCryptor encrypts file names deterministically, so the same name
+// always maps to the same object and re-uploads replace it.
+//
+// This is a SIV construction: the IV is an HMAC-SHA256 of the clear name,
+// truncated to 16 bytes, which is then used as the AES-256-CTR IV.
+// On decryption the IV is recomputed and compared, authenticating the name.
+//
+// Format: "dsn1-" + base64url(siv || ciphertext)
+type nameCryptor struct {
+	encKey []byte
+	macKey []byte
+}
+
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newNameCryptor(secret []byte) *nameCryptor {
+	return &nameCryptor{
+		encKey: deriveKey(secret, "distsync name encryption"),
+		macKey: deriveKey(secret, "distsync name authentication"),
+	}
+}
+
+func (nc *nameCryptor) siv(name []byte) []byte {
+	mac := hmac.New(sha256.New, nc.macKey)
+	mac.Write(name)
+	return mac.Sum(nil)[:nameSivSize]
+}
+
+func (nc *nameCryptor) ctr(iv []byte, dst []byte, src []byte) error {
+	block, err := aes.NewCipher(nc.encKey)
+	if err != nil {
+		return err
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(dst, src)
+	return nil
+}
+
+func (nc *nameCryptor) EncryptName(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("Cannot encrypt empty file name.")
+	}
+
+	clear := []byte(name)
+	iv := nc.siv(clear)
+
+	out := make([]byte, len(iv)+len(clear))
+	copy(out, iv)
+
+	err := nc.ctr(iv, out[len(iv):], clear)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedNamePrefix + base64.URLEncoding.EncodeToString(out), nil
+}
+
+func (nc *nameCryptor) DecryptName(name string) (string, error) {
+	if !IsEncryptedName(name) {
+		return "", errors.New("Not an encrypted file name: '" + name + "'")
+	}
+
+	buf, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(name, encryptedNamePrefix))
+	if err != nil {
+		return "", err
+	}
+
+	if len(buf) <= nameSivSize {
+		return "", errors.New("Encrypted file name is too short.")
+	}
+
+	iv := buf[:nameSivSize]
+	clear := make([]byte, len(buf)-nameSivSize)
+
+	err = nc.ctr(iv, clear, buf[nameSivSize:])
+	if err != nil {
+		return "", err
+	}
+
+	if !hmac.Equal(iv, nc.siv(clear)) {
+		return "", errors.New("File name authentication failed.")
+	}
+
+	return string(clear), nil
+}
+
+// Returns true if name was created by EncryptName: the prefix, followed
+// by the base64 of the SIV and ciphertext. Objects uploaded before file
+// name encryption have clear names, and return false, unless a clear
+// name happens to look like that.
+func IsEncryptedName(name string) bool {
+	if !strings.HasPrefix(name, encryptedNamePrefix) {
+		return false
+	}
+
+	buf, err := base64.URLEncoding.DecodeString(strings.TrimPrefix(name, encryptedNamePrefix))
+	return err == nil && len(buf) > nameSivSize
+}
@@ -0,0 +1,93 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"testing"
+)
+
+func TestNameRoundTrip(t *testing.T) {
+	nc := newNameCryptor([]byte("hellohelloworld1hellohelloworld1"))
+
+	en, err := nc.EncryptName("myapp-1.0.tar.gz")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !IsEncryptedName(en) {
+		t.Fatalf("expected encrypted name prefix: %s", en)
+	}
+
+	en2, err := nc.EncryptName("myapp-1.0.tar.gz")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if en != en2 {
+		t.Fatal("name encryption is not deterministic")
+	}
+
+	name, err := nc.DecryptName(en)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if name != "myapp-1.0.tar.gz" {
+		t.Fatal("Failed round trip.")
+	}
+}
+
+func TestNameTampered(t *testing.T) {
+	nc := newNameCryptor([]byte("hellohelloworld1hellohelloworld1"))
+
+	en, err := nc.EncryptName("myapp-1.0.tar.gz")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b := []byte(en)
+	if b[len(b)-5] == 'A' {
+		b[len(b)-5] = 'B'
+	} else {
+		b[len(b)-5] = 'A'
+	}
+
+	_, err = nc.DecryptName(string(b))
+	if err == nil {
+		t.Fatal("Missing error from tampered name")
+	}
+
+	other := newNameCryptor([]byte("worldworldhello1worldworldhello1"))
+	_, err = other.DecryptName(en)
+	if err == nil {
+		t.Fatal("Missing error from name encrypted with another secret")
+	}
+
+	_, err = nc.DecryptName("myapp-1.0.tar.gz")
+	if err == nil {
+		t.Fatal("Missing error from clear name")
+	}
+}
+
+func TestClearNameWithPrefix(t *testing.T) {
+	for _, name := range []string{"dsn1-app-1.0.tar.gz", "dsn1-", "dsn1-AAAA"} {
+		if IsEncryptedName(name) {
+			t.Fatalf("expected a clear name: %s", name)
+		}
+	}
+}
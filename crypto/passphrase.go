@@ -0,0 +1,128 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/mitchellh/go-homedir"
+	"github.com/pquerna/distsync/common"
+	"golang.org/x/crypto/argon2"
+
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const minPassphraseLength = 12
+
+// argon2id parameters, from the recommendations in RFC 9106.
+const (
+	passphraseTime    = 3
+	passphraseMemory  = 64 * 1024
+	passphraseThreads = 4
+)
+
+// Minimum length of the random salt stored in the bucket.
+const minPassphraseSaltSize = 16
+
+// Returns the decoded SharedSecret, or the key derived from Passphrase or
+// PassphraseFile by DerivePassphraseKey. Returns nil if none of them are
+// set.
+func sharedSecretFromConf(c *common.Conf) ([]byte, error) {
+	set := 0
+	for _, v := range []string{c.SharedSecret, c.Passphrase, c.PassphraseFile} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return nil, errors.New("Only one of SharedSecret, Passphrase or PassphraseFile can be set.")
+	}
+
+	switch {
+	case c.SharedSecret != "":
+		return decodeSecret(c.SharedSecret, 32)
+	case c.Passphrase != "" || c.PassphraseFile != "":
+		if c.PassphraseKey == nil {
+			return nil, errors.New("The passphrase salt has not been read from the bucket.")
+		}
+		return c.PassphraseKey, nil
+	}
+
+	return nil, nil
+}
+
+// UsesPassphrase returns true if the shared secret is derived from
+// Passphrase or PassphraseFile, see DerivePassphraseKey.
+func UsesPassphrase(c *common.Conf) bool {
+	return c.Passphrase != "" || c.PassphraseFile != ""
+}
+
+// DerivePassphraseKey stretches Passphrase or PassphraseFile with the
+// random salt stored in the bucket, and keeps the result in
+// c.PassphraseKey. Deriving the key takes a noticeable amount of time
+// and memory, so it is done once for each configuration.
+func DerivePassphraseKey(c *common.Conf, salt []byte) error {
+	passphrase := c.Passphrase
+	if c.PassphraseFile != "" {
+		var err error
+		passphrase, err = readPassphraseFile(c.PassphraseFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	secret, err := passphraseSecret(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	c.PassphraseKey = secret
+	return nil
+}
+
+func readPassphraseFile(file string) (string, error) {
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.New("Unable to read PassphraseFile: " + err.Error())
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Derives a 32 byte secret from a passphrase. The salt is random, and
+// stored in the bucket, so the passphrase and the bucket are all a
+// person needs to recover the key.
+func passphraseSecret(passphrase string, salt []byte) ([]byte, error) {
+	if len(passphrase) < minPassphraseLength {
+		return nil, errors.New("Passphrase must be at least " + strconv.Itoa(minPassphraseLength) + " characters.")
+	}
+
+	if len(salt) < minPassphraseSaltSize {
+		return nil, errors.New("The passphrase salt in the bucket is too short.")
+	}
+
+	return argon2.IDKey([]byte(passphrase), salt,
+		passphraseTime, passphraseMemory, passphraseThreads, 32), nil
+}
@@ -0,0 +1,139 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var testSalt = []byte("distsync test salt, 32 bytes....")
+
+func TestPassphrase(t *testing.T) {
+	a := common.NewConf()
+	a.Passphrase = "correct horse battery staple"
+
+	// the key is derived once, with the salt from the bucket.
+	_, err := NewFromConf(a)
+	if err == nil {
+		t.Fatal("expected error before the key is derived")
+	}
+
+	err = DerivePassphraseKey(a, testSalt)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	f, err := ioutil.TempFile("", ".distsync-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte(a.Passphrase + "\n"))
+	f.Close()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b := common.NewConf()
+	b.PassphraseFile = f.Name()
+
+	err = DerivePassphraseKey(b, testSalt)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	ecA, err := NewFromConf(a)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	ecB, err := NewFromConf(b)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	roundtrip := &bytes.Buffer{}
+	err = ecB.Decrypt(bytes.NewReader(testStreamEncrypt(t, ecA, []byte("hello world"))), roundtrip)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if roundtrip.String() != "hello world" {
+		t.Fatal("Failed round trip.")
+	}
+
+	other := common.NewConf()
+	other.Passphrase = a.Passphrase
+
+	err = DerivePassphraseKey(other, []byte("another distsync test salt value"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	idA, err := ActiveKeyId(a)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	idOther, err := ActiveKeyId(other)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if idA == idOther {
+		t.Fatal("expected different keys for different salts")
+	}
+}
+
+func TestPassphraseInvalid(t *testing.T) {
+	sec, err := RandomSecret()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		update func(c *common.Conf)
+		salt   []byte
+	}{
+		{func(c *common.Conf) { c.Passphrase = "short" }, testSalt},
+		{func(c *common.Conf) {}, []byte("short salt")},
+		{func(c *common.Conf) { c.SharedSecret = sec }, testSalt},
+		{func(c *common.Conf) {
+			c.Passphrase = ""
+			c.PassphraseFile = "/nonexistent/distsync"
+		}, testSalt},
+	} {
+		c := common.NewConf()
+		c.Passphrase = "correct horse battery staple"
+		tc.update(c)
+
+		err = DerivePassphraseKey(c, tc.salt)
+		if err == nil {
+			_, err = NewFromConf(c)
+		}
+		if err == nil {
+			t.Fatalf("expected error from conf: %+v", c)
+		}
+	}
+}
@@ -18,6 +18,8 @@
 package crypto
 
 import (
+	"github.com/pquerna/distsync/common"
+
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
@@ -33,23 +35,46 @@ func RandomThing(byteLength int, checksum bool) (string, error) {
 	}
 
 	if checksum {
-		crcbuf := make([]byte, 4)
+		return encodeSecret(buf), nil
+	}
 
-		crc := crc32.ChecksumIEEE(buf)
+	return base64.URLEncoding.EncodeToString(buf), nil
 
-		binary.BigEndian.PutUint32(crcbuf, crc)
+}
 
-		buf = append(buf, crcbuf...)
-	}
+// Encodes a secret with a CRC, in the format read by decodeSecret.
+func encodeSecret(buf []byte) string {
+	crcbuf := make([]byte, 4)
 
-	return base64.URLEncoding.EncodeToString(buf), nil
+	crc := crc32.ChecksumIEEE(buf)
+
+	binary.BigEndian.PutUint32(crcbuf, crc)
 
+	return base64.URLEncoding.EncodeToString(append(buf, crcbuf...))
 }
 
 func RandomSecret() (string, error) {
 	return RandomThing(32, true)
 }
 
+// Generates a new random key for the keyring.
+func RandomKey() (*common.Key, error) {
+	sec, err := RandomSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := decodeSecret(sec, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.Key{
+		Id:     keyId(secret),
+		Secret: sec,
+	}, nil
+}
+
 func decodeSecret(secin string, seclen int) ([]byte, error) {
 	if len(secin) != base64.URLEncoding.EncodedLen(seclen+4) {
 		return nil, errors.New("Invalid shared secret, length is wrong?")
@@ -0,0 +1,356 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/pquerna/distsync/common"
+	"golang.org/x/crypto/ed25519"
+
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// Signed files end with a trailer: the Ed25519 signature, followed by
+// signatureMagic. The signature covers the file's clear name and a
+// SHA-512 hash of everything before the trailer, so servers holding only
+// the shared secret can't forge or rename files.
+const signatureMagic = "distsyncs1"
+
+const signatureTrailerSize = ed25519.SignatureSize + len(signatureMagic)
+
+// Generates a new keypair, encoded for Conf.SigningKey and Conf.TrustedKeys.
+func RandomSigningKey() (string, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return encodeSecret(priv.Seed()), encodeSecret(pub), nil
+}
+
+func signingKeyFromConf(c *common.Conf) (ed25519.PrivateKey, error) {
+	if c.SigningKey == "" {
+		return nil, nil
+	}
+
+	seed, err := decodeSecret(c.SigningKey, ed25519.SeedSize)
+	if err != nil {
+		return nil, errors.New("Invalid SigningKey: " + err.Error())
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func trustedKeysFromConf(c *common.Conf) ([]ed25519.PublicKey, error) {
+	keys := make([]ed25519.PublicKey, 0, len(c.TrustedKeys)+1)
+
+	for _, k := range c.TrustedKeys {
+		pub, err := decodeSecret(k, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, errors.New("Invalid TrustedKeys entry: " + err.Error())
+		}
+		keys = append(keys, ed25519.PublicKey(pub))
+	}
+
+	// uploaders trust their own signatures.
+	priv, err := signingKeyFromConf(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if priv != nil {
+		keys = append(keys, priv.Public().(ed25519.PublicKey))
+	}
+
+	return keys, nil
+}
+
+func signatureMessage(name string, r io.Reader) ([]byte, error) {
+	h := sha512.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return signatureDigest(name, h), nil
+}
+
+func signatureDigest(name string, h hash.Hash) []byte {
+	return h.Sum([]byte("distsync signature\x00" + name + "\x00"))
+}
+
+func verifySignature(keys []ed25519.PublicKey, msg []byte, sig []byte) error {
+	for _, pub := range keys {
+		if ed25519.Verify(pub, msg, sig) {
+			return nil
+		}
+	}
+
+	return errors.New("File signature failed verification.")
+}
+
+// SignFile appends a signature trailer to the encrypted file f, if
+// SigningKey is configured.
+func SignFile(c *common.Conf, name string, f io.ReadWriteSeeker) error {
+	priv, err := signingKeyFromConf(c)
+	if err != nil {
+		return err
+	}
+
+	if priv == nil {
+		return nil
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	msg, err := signatureMessage(name, f)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(ed25519.Sign(priv, msg))
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write([]byte(signatureMagic))
+	return err
+}
+
+// Returns the length of the trailer SigningWriter appends.
+func SignatureSize(c *common.Conf) (int64, error) {
+	priv, err := signingKeyFromConf(c)
+	if err != nil {
+		return 0, err
+	}
+
+	if priv == nil {
+		return 0, nil
+	}
+
+	return int64(signatureTrailerSize), nil
+}
+
+// MaxTrailerSize is the most bytes a signature trailer takes at the end
+// of an encrypted file.
+const MaxTrailerSize = int64(signatureTrailerSize)
+
+// TrailerSize returns the length of the signature trailer at the end of
+// tail, the last bytes of an encrypted file, or 0 for unsigned files.
+func TrailerSize(tail []byte) int64 {
+	if len(tail) < signatureTrailerSize || !bytes.HasSuffix(tail, []byte(signatureMagic)) {
+		return 0
+	}
+	return int64(signatureTrailerSize)
+}
+
+// SigningWriter hashes an encrypted file as it is written, and appends
+// the signature trailer on Close. Without a SigningKey, it only passes
+// writes through.
+type SigningWriter struct {
+	w    io.Writer
+	name string
+	priv ed25519.PrivateKey
+	h    hash.Hash
+}
+
+func NewSigningWriter(c *common.Conf, name string, w io.Writer) (*SigningWriter, error) {
+	priv, err := signingKeyFromConf(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningWriter{
+		w:    w,
+		name: name,
+		priv: priv,
+		h:    sha512.New(),
+	}, nil
+}
+
+func (sw *SigningWriter) Write(p []byte) (int, error) {
+	sw.h.Write(p)
+	return sw.w.Write(p)
+}
+
+// Close writes the signature trailer. It does not close the underlying writer.
+func (sw *SigningWriter) Close() error {
+	if sw.priv == nil {
+		return nil
+	}
+
+	_, err := sw.w.Write(ed25519.Sign(sw.priv, signatureDigest(sw.name, sw.h)))
+	if err != nil {
+		return err
+	}
+
+	_, err = sw.w.Write([]byte(signatureMagic))
+	return err
+}
+
+// VerifyFile checks the signature trailer of the encrypted file f, and
+// returns the length of the file without it. When TrustedKeys is
+// configured, unsigned files and files not signed by a trusted key are
+// refused.
+func VerifyFile(c *common.Conf, name string, f io.ReadSeeker) (int64, error) {
+	keys, err := trustedKeysFromConf(c)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		return 0, err
+	}
+
+	signed := false
+	trailer := make([]byte, signatureTrailerSize)
+	if size >= int64(signatureTrailerSize) {
+		_, err = f.Seek(size-int64(signatureTrailerSize), 0)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = io.ReadFull(f, trailer)
+		if err != nil {
+			return 0, err
+		}
+
+		signed = bytes.Equal(trailer[ed25519.SignatureSize:], []byte(signatureMagic))
+	}
+
+	if !signed {
+		if len(keys) > 0 {
+			return 0, errors.New("File is not signed, and TrustedKeys is configured.")
+		}
+		return size, nil
+	}
+
+	size -= int64(signatureTrailerSize)
+	if len(keys) == 0 {
+		return size, nil
+	}
+
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := signatureMessage(name, io.LimitReader(f, size))
+	if err != nil {
+		return 0, err
+	}
+
+	err = verifySignature(keys, msg, trailer[:ed25519.SignatureSize])
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// VerifyingReader reads an encrypted file, withholding its signature
+// trailer, and checks the signature once the whole file has been read.
+// It applies the same rules as VerifyFile, without needing the whole
+// file on disk.
+type VerifyingReader struct {
+	r       io.Reader
+	name    string
+	keys    []ed25519.PublicKey
+	h       hash.Hash
+	buf     []byte
+	held    []byte
+	trailer []byte
+	eof     bool
+}
+
+func NewVerifyingReader(c *common.Conf, name string, r io.Reader) (*VerifyingReader, error) {
+	keys, err := trustedKeysFromConf(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VerifyingReader{
+		r:    r,
+		name: name,
+		keys: keys,
+		h:    sha512.New(),
+		buf:  make([]byte, 32*1024),
+	}, nil
+}
+
+func (vr *VerifyingReader) Read(p []byte) (int, error) {
+	// the last signatureTrailerSize bytes may be the trailer, so they
+	// are held back until the end of the file.
+	for !vr.eof && len(vr.held) <= signatureTrailerSize {
+		n, err := vr.r.Read(vr.buf)
+		vr.held = append(vr.held, vr.buf[:n]...)
+		if err == io.EOF {
+			vr.eof = true
+			if len(vr.held) >= signatureTrailerSize && bytes.HasSuffix(vr.held, []byte(signatureMagic)) {
+				vr.trailer = vr.held[len(vr.held)-signatureTrailerSize:]
+				vr.held = vr.held[:len(vr.held)-signatureTrailerSize]
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	avail := len(vr.held)
+	if !vr.eof {
+		avail -= signatureTrailerSize
+	}
+
+	if avail == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, vr.held[:avail])
+	vr.h.Write(p[:n])
+	vr.held = vr.held[n:]
+	return n, nil
+}
+
+// Verify reads the rest of the file, and checks its signature.
+func (vr *VerifyingReader) Verify() error {
+	_, err := io.Copy(ioutil.Discard, vr)
+	if err != nil {
+		return err
+	}
+
+	if vr.trailer == nil {
+		if len(vr.keys) > 0 {
+			return errors.New("File is not signed, and TrustedKeys is configured.")
+		}
+		return nil
+	}
+
+	if len(vr.keys) == 0 {
+		return nil
+	}
+
+	return verifySignature(vr.keys, signatureDigest(vr.name, vr.h), vr.trailer[:ed25519.SignatureSize])
+}
@@ -0,0 +1,295 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testSignedFile(t *testing.T, c *common.Conf, name string, content string) *os.File {
+	f, err := ioutil.TempFile("", ".distsync-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = f.Write([]byte(content))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = SignFile(c, name, f)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return f
+}
+
+func TestSignature(t *testing.T) {
+	priv, pub, err := RandomSigningKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, otherPub, err := RandomSigningKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	uploader := common.NewConf()
+	uploader.SigningKey = priv
+
+	server := common.NewConf()
+	server.TrustedKeys = []string{otherPub, pub}
+
+	untrusting := common.NewConf()
+	untrusting.TrustedKeys = []string{otherPub}
+
+	f := testSignedFile(t, uploader, "hello.txt", "hello world")
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	size, err := VerifyFile(server, "hello.txt", f)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if size != int64(len("hello world")) {
+		t.Fatalf("unexpected size without signature: %d", size)
+	}
+
+	// servers without TrustedKeys still skip the trailer.
+	size, err = VerifyFile(common.NewConf(), "hello.txt", f)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if size != int64(len("hello world")) {
+		t.Fatalf("unexpected size without signature: %d", size)
+	}
+
+	_, err = VerifyFile(untrusting, "hello.txt", f)
+	if err == nil {
+		t.Fatal("expected error from untrusted key")
+	}
+
+	_, err = VerifyFile(server, "other.txt", f)
+	if err == nil {
+		t.Fatal("expected error from renamed file")
+	}
+
+	_, err = f.WriteAt([]byte("j"), 0)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = VerifyFile(server, "hello.txt", f)
+	if err == nil {
+		t.Fatal("expected error from modified file")
+	}
+}
+
+func TestSignatureRequired(t *testing.T) {
+	_, pub, err := RandomSigningKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	server := common.NewConf()
+	server.TrustedKeys = []string{pub}
+
+	// without a SigningKey, files are uploaded unsigned.
+	f := testSignedFile(t, common.NewConf(), "hello.txt", "hello world")
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	size, err := VerifyFile(common.NewConf(), "hello.txt", f)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if size != int64(len("hello world")) {
+		t.Fatalf("unexpected size: %d", size)
+	}
+
+	_, err = VerifyFile(server, "hello.txt", f)
+	if err == nil {
+		t.Fatal("expected error from unsigned file")
+	}
+}
+
+// reads one byte at a time, to exercise holding back the trailer.
+type testByteReader struct {
+	r io.Reader
+}
+
+func (br *testByteReader) Read(p []byte) (int, error) {
+	return br.r.Read(p[:1])
+}
+
+func TestVerifyingReader(t *testing.T) {
+	priv, pub, err := RandomSigningKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	uploader := common.NewConf()
+	uploader.SigningKey = priv
+
+	server := common.NewConf()
+	server.TrustedKeys = []string{pub}
+
+	for _, content := range []string{"", "hello world", strings.Repeat("hello world", 10000)} {
+		f := testSignedFile(t, uploader, "hello.txt", content)
+		defer func() {
+			f.Close()
+			os.Remove(f.Name())
+		}()
+
+		signed, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		for _, conf := range []*common.Conf{server, common.NewConf()} {
+			vr, err := NewVerifyingReader(conf, "hello.txt", &testByteReader{bytes.NewReader(signed)})
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+
+			out, err := ioutil.ReadAll(vr)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+
+			if string(out) != content {
+				t.Fatalf("unexpected content of %d bytes", len(out))
+			}
+
+			err = vr.Verify()
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+		}
+
+		vr, err := NewVerifyingReader(server, "other.txt", bytes.NewReader(signed))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = vr.Verify()
+		if err == nil {
+			t.Fatal("expected error from renamed file")
+		}
+
+		// unsigned content passes through untouched.
+		vr, err = NewVerifyingReader(common.NewConf(), "hello.txt", bytes.NewReader([]byte(content)))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		out, err := ioutil.ReadAll(vr)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if string(out) != content {
+			t.Fatalf("unexpected unsigned content of %d bytes", len(out))
+		}
+
+		vr, err = NewVerifyingReader(server, "hello.txt", bytes.NewReader([]byte(content)))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = vr.Verify()
+		if err == nil {
+			t.Fatal("expected error from unsigned file")
+		}
+	}
+}
+
+func TestSigningWriter(t *testing.T) {
+	priv, pub, err := RandomSigningKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	uploader := common.NewConf()
+	uploader.SigningKey = priv
+
+	server := common.NewConf()
+	server.TrustedKeys = []string{pub}
+
+	for _, c := range []*common.Conf{uploader, common.NewConf()} {
+		buf := &bytes.Buffer{}
+		sw, err := NewSigningWriter(c, "hello.txt", buf)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		_, err = sw.Write([]byte("hello world"))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = sw.Close()
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		sigSize, err := SignatureSize(c)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if int64(buf.Len()) != int64(len("hello world"))+sigSize {
+			t.Fatalf("unexpected signed length: %d", buf.Len())
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	sw, err := NewSigningWriter(uploader, "hello.txt", buf)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	sw.Write([]byte("hello world"))
+	sw.Close()
+
+	vr, err := NewVerifyingReader(server, "hello.txt", buf)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = vr.Verify()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+}
@@ -0,0 +1,411 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const streamSaltSize = 32
+
+// Additional data for each chunk: 8-byte chunk counter and a 1-byte
+// flag set on the final chunk.
+func streamAD(ad []byte, counter uint64, final bool) []byte {
+	binary.BigEndian.PutUint64(ad, counter)
+	if final {
+		ad[8] = 1
+	} else {
+		ad[8] = 0
+	}
+	return ad
+}
+
+// Encrypts r using the STREAM construction. Each file gets a random salt
+// and its own key derived from the secret. Every chunk is sealed with its
+// position and a final-chunk flag as additional data, so reordered, dropped
+// or truncated chunks fail to decrypt as soon as they are read.
+//
+// File Format:
+//
+//	Header: 10 bytes for version and cipher identification.
+//	Salt: 32 random bytes.
+//	v4 and v5: header fields, including the key ID. See headerFields.
+//	v5 only: the wrapped data key is one of the header fields.
+//	v4 and v5: the compression algorithm, if the cleartext is compressed
+//	before it is split into chunks.
+//
+// Data block(s):
+//
+//	4-bytes chunk size. (PutUint32)
+//	nonce used to seal the chunk, if the cipher needs it stored.
+//	AEAD encrypted data of up to 1 megabyte of cleartext.
+//
+// The last data block has the final flag set, and may be empty.
+func (e *EtmCryptor) encryptStream(r io.Reader, w io.Writer) error {
+	header, err := e.NewHeader("")
+	if err != nil {
+		return err
+	}
+
+	return e.EncryptWithHeader(header, r, w)
+}
+
+// NewHeader returns the start of a new STREAM file: the container header,
+// a random salt and the header fields. Files are compressed with the
+// compression algorithm before they are encrypted, unless it is "".
+func (e *EtmCryptor) NewHeader(compression string) ([]byte, error) {
+	if !e.version.stream {
+		return nil, errors.New("Only STREAM files have a reusable header.")
+	}
+
+	if !validCompression(compression) {
+		return nil, errors.New("Unknown compression: " + compression)
+	}
+
+	if compression != "" && !e.version.headerFields {
+		return nil, errors.New("Compression needs header fields, use a newer Encrypt setting.")
+	}
+
+	salt := make([]byte, streamSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, _, err := e.newFileKey(salt, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &bytes.Buffer{}
+	header.Write(e.version.header)
+	header.Write(salt)
+
+	if e.version.headerFields {
+		err = writeHeaderFields(header, fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return header.Bytes(), nil
+}
+
+// EncryptWithHeader encrypts r after a header from NewHeader. Chunk nonces
+// are derived from the file key and each chunk, so encrypting the same
+// cleartext with the same header always gives the same output. Interrupted
+// uploads can be resumed by saving the header and encrypting again.
+func (e *EtmCryptor) EncryptWithHeader(header []byte, r io.Reader, w io.Writer) error {
+	hr := bytes.NewReader(header)
+	cv, err := readContainerHeader(hr)
+	if err != nil {
+		return err
+	}
+
+	if !cv.stream {
+		return errors.New("Only STREAM files have a reusable header.")
+	}
+
+	salt := make([]byte, streamSaltSize)
+	_, err = io.ReadFull(hr, salt)
+	if err != nil {
+		return err
+	}
+
+	key, hf, err := e.fileKey(cv, hr, salt)
+	if err != nil {
+		return err
+	}
+
+	if hr.Len() != 0 {
+		return errors.New("Unexpected data after encrypted file header.")
+	}
+
+	if hf.compression != "" {
+		cr := newCompressReader(hf.compression, r)
+		defer cr.Close()
+		r = cr
+	}
+
+	c, err := cv.newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	nonceMac := hmac.New(sha256.New, deriveKey(key, "distsync chunk nonce"))
+	buf := make([]byte, v1chunkSize)
+	nonce := make([]byte, c.NonceSize())
+	enbuf := make([]byte, len(nonce)+cap(buf)+c.Overhead())
+	lbuf := make([]byte, 4)
+	ad := make([]byte, 9)
+
+	for counter := uint64(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		final := false
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+
+		streamAD(ad, counter, final)
+
+		// a synthetic nonce: it only repeats if the chunk does.
+		nonceMac.Reset()
+		nonceMac.Write(ad)
+		nonceMac.Write(buf[:n])
+		copy(nonce, nonceMac.Sum(nil))
+
+		enbuf = enbuf[0:0]
+		if cv.explicitNonce {
+			enbuf = append(enbuf, nonce...)
+		}
+
+		enbuf = c.Seal(enbuf, nonce, buf[:n], ad)
+
+		binary.BigEndian.PutUint32(lbuf, uint32(len(enbuf)))
+
+		_, err = w.Write(lbuf)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(enbuf)
+		if err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// Decrypts a STREAM file, after the header has been read. Each chunk is
+// authenticated before it is written to w.
+func (e *EtmCryptor) decryptStream(cv *containerVersion, r io.Reader, w io.Writer) error {
+	salt := make([]byte, streamSaltSize)
+	_, err := io.ReadFull(r, salt)
+	if err != nil {
+		return err
+	}
+
+	key, hf, err := e.fileKey(cv, r, salt)
+	if err != nil {
+		return err
+	}
+
+	if hf.compression == "" {
+		return decryptChunks(cv, key, r, w)
+	}
+
+	dw := newDecompressWriter(hf.compression, w)
+	err = decryptChunks(cv, key, r, dw)
+	if err != nil {
+		dw.abort(err)
+		return err
+	}
+
+	return dw.Close()
+}
+
+// Decrypts the chunks of a STREAM file, after its header.
+func decryptChunks(cv *containerVersion, key []byte, r io.Reader, w io.Writer) error {
+	c, err := cv.newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	lbuf := make([]byte, 4)
+	ad := make([]byte, 9)
+	buf := make([]byte, v1maxChunkSize)
+	clearbuf := make([]byte, 0, v1chunkSize)
+
+	for counter := uint64(0); ; counter++ {
+		_, err := io.ReadFull(r, lbuf)
+		if err == io.EOF {
+			return errors.New("Encrypted file is truncated.")
+		} else if err != nil {
+			return err
+		}
+
+		llen := binary.BigEndian.Uint32(lbuf)
+		if llen > v1maxChunkSize {
+			return errors.New("invalid size in of encrypted chunk")
+		}
+
+		enbuf := buf[:llen]
+		_, err = io.ReadFull(r, enbuf)
+		if err != nil {
+			return err
+		}
+
+		var nonce []byte
+		if cv.explicitNonce {
+			if len(enbuf) < c.NonceSize() {
+				return errors.New("invalid size in of encrypted chunk")
+			}
+			nonce = enbuf[:c.NonceSize()]
+			enbuf = enbuf[c.NonceSize():]
+		}
+
+		// try the chunk as a middle chunk first, then as the final chunk.
+		final := false
+		cleartext, err := c.Open(clearbuf[0:0], nonce, enbuf, streamAD(ad, counter, false))
+		if err != nil {
+			final = true
+			cleartext, err = c.Open(clearbuf[0:0], nonce, enbuf, streamAD(ad, counter, true))
+			if err != nil {
+				return errors.New("Encrypted chunk failed authentication.")
+			}
+		}
+
+		_, err = w.Write(cleartext)
+		if err != nil {
+			return err
+		}
+
+		if final {
+			_, err = io.ReadFull(r, lbuf[:1])
+			if err == nil {
+				return errors.New("Unexpected data after final chunk.")
+			} else if err != io.EOF {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+// EncryptedSize returns the length EncryptWithHeader writes for size bytes
+// of payload. The framing only depends on the payload length, so
+// encrypted data can be streamed to storage that needs the length first.
+// The payload is the cleartext, or its compressed form if the header
+// compresses files. See CompressedSize.
+func (e *EtmCryptor) EncryptedSize(header []byte, size int64) (int64, error) {
+	cv, err := readContainerHeader(bytes.NewReader(header))
+	if err != nil {
+		return 0, err
+	}
+
+	if !cv.stream {
+		return 0, errors.New("Encrypted size is only known for STREAM files.")
+	}
+
+	// the length of sealed data doesn't depend on the key.
+	c, err := cv.newAEAD(make([]byte, 32))
+	if err != nil {
+		return 0, err
+	}
+
+	nonce := make([]byte, c.NonceSize())
+	chunkSize := func(n int64) int64 {
+		l := int64(4 + len(c.Seal(nil, nonce, make([]byte, n), nil)))
+		if cv.explicitNonce {
+			l += int64(len(nonce))
+		}
+		return l
+	}
+
+	total := int64(len(header))
+
+	full := size / int64(v1chunkSize)
+	if full > 0 {
+		total += full * chunkSize(int64(v1chunkSize))
+	}
+
+	// the final chunk, which is empty if size is a multiple of the chunk size.
+	total += chunkSize(size % int64(v1chunkSize))
+
+	return total, nil
+}
+
+// Returns the header fields for a new file, and the key for its chunks.
+func (e *EtmCryptor) newFileKey(salt []byte, compression string) ([]byte, []byte, error) {
+	if !e.version.headerFields {
+		return nil, streamKey(e.activeSecret(), salt, nil), nil
+	}
+
+	hf := &headerFields{
+		keyId:       e.active,
+		compression: compression,
+	}
+
+	if !e.version.envelope {
+		fields := hf.marshal()
+		return fields, streamKey(e.activeSecret(), salt, fields), nil
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hf.wrappedKey, err = wrapDataKey(e.version, e.activeSecret(), salt, hf, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hf.marshal(), streamKey(dataKey, salt, nil), nil
+}
+
+// Reads the header fields of a file, if it has them, and returns the
+// key for its chunks and the fields.
+func (e *EtmCryptor) fileKey(cv *containerVersion, r io.Reader, salt []byte) ([]byte, *headerFields, error) {
+	// v3 files don't record which key encrypted them.
+	if !cv.headerFields {
+		return streamKey(e.fallbackSecret(), salt, nil), &headerFields{}, nil
+	}
+
+	hf, fields, err := readHeaderFields(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := e.secret(hf.keyId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !cv.envelope {
+		return streamKey(secret, salt, fields), hf, nil
+	}
+
+	dataKey, err := unwrapDataKey(cv, secret, salt, hf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return streamKey(dataKey, salt, nil), hf, nil
+}
+
+func streamKey(secret []byte, salt []byte, fields []byte) []byte {
+	return deriveKey(secret, "distsync stream key"+string(salt)+string(fields))
+}
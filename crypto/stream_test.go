@@ -0,0 +1,246 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+var testSecret = []byte("hellohelloworld1hellohelloworld1")
+
+func testStreamEncrypt(t *testing.T, ec Cryptor, cleartext []byte) []byte {
+	dst := &bytes.Buffer{}
+	err := ec.Encrypt(bytes.NewReader(cleartext), dst)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	return dst.Bytes()
+}
+
+// returns the offsets of each data block in a STREAM file.
+func testStreamChunks(t *testing.T, b []byte) []int {
+	cv, err := containerByHeader(b[:containerHeaderSize])
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	offsets := make([]int, 0)
+	off := containerHeaderSize + streamSaltSize
+	if cv.headerFields {
+		off += 2 + int(binary.BigEndian.Uint16(b[off:]))
+	}
+	for off < len(b) {
+		offsets = append(offsets, off)
+		off += 4 + int(binary.BigEndian.Uint32(b[off:]))
+	}
+	return offsets
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, ctor := range []func([]byte) (Cryptor, error){NewAES128SHA256, NewChacha20poly1305} {
+		ec, err := ctor(testSecret)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		for _, size := range []int{0, 11, int(v1chunkSize), int(v1chunkSize)*2 + 500} {
+			cleartext := make([]byte, size)
+			rand.Read(cleartext)
+
+			roundtrip := &bytes.Buffer{}
+			err = ec.Decrypt(bytes.NewReader(testStreamEncrypt(t, ec, cleartext)), roundtrip)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+
+			if !bytes.Equal(cleartext, roundtrip.Bytes()) {
+				t.Fatalf("Failed round trip of %d bytes.", size)
+			}
+		}
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	ec, err := NewChacha20poly1305(testSecret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b := testStreamEncrypt(t, ec, make([]byte, int(v1chunkSize)*2+500))
+	chunks := testStreamChunks(t, b)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+
+	// drop the final chunk.
+	err = ec.Decrypt(bytes.NewReader(b[:chunks[2]]), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("Missing error from truncated file")
+	}
+
+	// trailing garbage after the final chunk.
+	err = ec.Decrypt(bytes.NewReader(append(b, 0)), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("Missing error from trailing data")
+	}
+}
+
+func TestStreamReordered(t *testing.T) {
+	ec, err := NewChacha20poly1305(testSecret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b := testStreamEncrypt(t, ec, make([]byte, int(v1chunkSize)*3))
+	chunks := testStreamChunks(t, b)
+
+	// swap the first two (equal sized) chunks.
+	reordered := make([]byte, 0, len(b))
+	reordered = append(reordered, b[:chunks[0]]...)
+	reordered = append(reordered, b[chunks[1]:chunks[2]]...)
+	reordered = append(reordered, b[chunks[0]:chunks[1]]...)
+	reordered = append(reordered, b[chunks[2]:]...)
+
+	out := &bytes.Buffer{}
+	err = ec.Decrypt(bytes.NewReader(reordered), out)
+	if err == nil {
+		t.Fatal("Missing error from reordered chunks")
+	}
+
+	if out.Len() != 0 {
+		t.Fatal("Reordered chunk was written to the output")
+	}
+}
+
+func TestLegacyDecrypt(t *testing.T) {
+	current, err := NewChacha20poly1305(testSecret)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, header := range []string{"distsync01"} {
+		cv, err := containerByHeader([]byte(header))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		legacy, err := newEtmCryptorVersion(singleKeyring(testSecret), cv)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		b := testStreamEncrypt(t, legacy, []byte("hello world"))
+		if string(b[:containerHeaderSize]) != header {
+			t.Fatalf("unexpected header: %s", b[:containerHeaderSize])
+		}
+
+		roundtrip := &bytes.Buffer{}
+		err = current.Decrypt(bytes.NewReader(b), roundtrip)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if roundtrip.String() != "hello world" {
+			t.Fatal("Failed round trip.")
+		}
+	}
+}
+
+func TestStreamEncryptedSize(t *testing.T) {
+	for _, ctor := range []func([]byte) (Cryptor, error){NewAES128SHA256, NewChacha20poly1305} {
+		ec, err := ctor(testSecret)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		header, err := ec.NewHeader("")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		for _, size := range []int{0, 11, 16, int(v1chunkSize) - 1, int(v1chunkSize), int(v1chunkSize)*2 + 500} {
+			expected, err := ec.EncryptedSize(header, int64(size))
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+
+			actual := len(testStreamEncrypt(t, ec, make([]byte, size)))
+			if int64(actual) != expected {
+				t.Fatalf("EncryptedSize(%d) = %d, Encrypt wrote %d bytes", size, expected, actual)
+			}
+		}
+	}
+}
+
+func TestStreamEncryptWithHeader(t *testing.T) {
+	for _, ctor := range []func([]byte) (Cryptor, error){NewAES128SHA256, NewChacha20poly1305} {
+		ec, err := ctor(testSecret)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		header, err := ec.NewHeader("")
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		cleartext := make([]byte, int(v1chunkSize)+500)
+		rand.Read(cleartext)
+
+		encrypt := func(b []byte) []byte {
+			dst := &bytes.Buffer{}
+			err := ec.EncryptWithHeader(header, bytes.NewReader(b), dst)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			return dst.Bytes()
+		}
+
+		a := encrypt(cleartext)
+		if !bytes.Equal(a, encrypt(cleartext)) {
+			t.Fatal("expected the same output for the same header and cleartext")
+		}
+
+		if !bytes.HasPrefix(a, header) {
+			t.Fatal("expected output to start with the header")
+		}
+
+		// the second chunk changes, the first doesn't.
+		changed := append([]byte{}, cleartext...)
+		changed[len(changed)-1] ^= 0x01
+		b := encrypt(changed)
+
+		chunks := testStreamChunks(t, a)
+		if !bytes.Equal(a[:chunks[1]], b[:chunks[1]]) || bytes.Equal(a[chunks[1]:], b[chunks[1]:]) {
+			t.Fatal("expected only the changed chunk to differ")
+		}
+
+		roundtrip := &bytes.Buffer{}
+		err = ec.Decrypt(bytes.NewReader(b), roundtrip)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if !bytes.Equal(changed, roundtrip.Bytes()) {
+			t.Fatal("Failed round trip.")
+		}
+	}
+}
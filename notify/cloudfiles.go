@@ -29,16 +29,19 @@ import (
 )
 
 type cloudFilesPoll struct {
-	bucket   string
-	lastEtag string
-	creds    *common.RackspaceCreds
+	bucket    string
+	markers   []string
+	lastEtags map[string]string
+	creds     *common.RackspaceCreds
 }
 
-func NewCloudFilesPoll(conf *common.RackspaceCreds, bucketName string) (Notifier, error) {
+func NewCloudFilesPoll(conf *common.RackspaceCreds, bucketName string, channels []string) (Notifier, error) {
 	return newTimedPoller(
 		&cloudFilesPoll{
-			bucket: bucketName,
-			creds:  conf,
+			bucket:    bucketName,
+			markers:   markerNames(channels),
+			lastEtags: make(map[string]string),
+			creds:     conf,
 		}), nil
 }
 
@@ -65,17 +68,37 @@ func (cf *cloudFilesPoll) Poll() (bool, error) {
 		return false, err
 	}
 
+	changed := false
+	for _, marker := range cf.markers {
+		ok, err := cf.pollMarker(client, marker)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || ok
+	}
+
+	return changed, nil
+}
+
+func (cf *cloudFilesPoll) pollMarker(client *gophercloud.ServiceClient, marker string) (bool, error) {
+	lastEtag := cf.lastEtags[marker]
+
 	log.WithFields(log.Fields{
-		"last_etag": cf.lastEtag,
+		"last_etag": lastEtag,
 		"bucket":    cf.bucket,
-		"file":      ".distsync",
+		"file":      marker,
 	}).Debug("Checking for changed ETag")
 
-	resp := objects.Download(client, cf.bucket, ".distsync",
+	resp := objects.Download(client, cf.bucket, marker,
 		&osObjects.DownloadOpts{
-			IfNoneMatch: cf.lastEtag,
+			IfNoneMatch: lastEtag,
 		})
 	if resp.Err != nil {
+		rerr, ok := resp.Err.(*gophercloud.UnexpectedResponseCodeError)
+		if ok && rerr.Actual == 404 {
+			// nothing has been uploaded to the channel yet.
+			return false, nil
+		}
 		return false, resp.Err
 	}
 	defer resp.Body.Close()
@@ -90,13 +113,14 @@ func (cf *cloudFilesPoll) Poll() (bool, error) {
 		return false, errors.New("Empty ETag on Request")
 	}
 
-	if etag != cf.lastEtag {
+	if etag != lastEtag {
 		log.WithFields(log.Fields{
-			"last_etag": cf.lastEtag,
+			"file":      marker,
+			"last_etag": lastEtag,
 			"new_etag":  etag,
 		}).Info("ETag changed, notifying watchers.")
 
-		cf.lastEtag = etag
+		cf.lastEtags[marker] = etag
 		return true, nil
 	}
 
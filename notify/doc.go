@@ -37,10 +37,22 @@ type Notifier interface {
 func NewFromConf(c *common.Conf) (Notifier, error) {
 	switch strings.ToUpper(c.Notify) {
 	case "S3POLL":
-		return NewS3Poll(c.Aws, c.StorageBucket)
+		return NewS3Poll(c.Aws, c.StorageBucket, c.SubscribedChannels())
 	case "CLOUDFILESPOLL":
-		return NewCloudFilesPoll(c.Rackspace, c.StorageBucket)
+		return NewCloudFilesPoll(c.Rackspace, c.StorageBucket, c.SubscribedChannels())
+	case "LOCALPOLL":
+		return NewLocalPoll(c.StorageBucket, c.SubscribedChannels())
 	}
 
 	return nil, errors.New("Unknown Notify backend: " + c.Notify)
 }
+
+// Returns the .distsync marker of each channel, which uploads to the
+// channel change.
+func markerNames(channels []string) []string {
+	rv := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		rv = append(rv, common.ChannelPrefix(channel)+".distsync")
+	}
+	return rv
+}
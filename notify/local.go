@@ -0,0 +1,87 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package notify
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/mitchellh/go-homedir"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type localPoll struct {
+	dir         string
+	markers     []string
+	lastMarkers map[string]string
+}
+
+// Polls the specified directory for a changed .distsync file in each of
+// channels every 10 to 20 seconds.
+func NewLocalPoll(dir string, channels []string) (Notifier, error) {
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTimedPoller(
+		&localPoll{
+			dir:         dir,
+			markers:     markerNames(channels),
+			lastMarkers: make(map[string]string),
+		}), nil
+}
+
+func (lp *localPoll) Poll() (bool, error) {
+	changed := false
+	for _, name := range lp.markers {
+		lastMarker := lp.lastMarkers[name]
+
+		log.WithFields(log.Fields{
+			"last_marker": lastMarker,
+			"dir":         lp.dir,
+			"file":        name,
+		}).Debug("Checking for changed contents")
+
+		data, err := ioutil.ReadFile(filepath.Join(lp.dir, filepath.FromSlash(name)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// nothing has been uploaded yet.
+				continue
+			}
+			return false, err
+		}
+
+		// .distsync contains a random string written on every upload,
+		// so it is compared directly instead of an ETag.
+		marker := string(data)
+
+		if marker != lastMarker {
+			log.WithFields(log.Fields{
+				"file":        name,
+				"last_marker": lastMarker,
+				"new_marker":  marker,
+			}).Info("Contents changed, notifying watchers.")
+			lp.lastMarkers[name] = marker
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
@@ -19,7 +19,6 @@ package notify
 
 import (
 	log "github.com/Sirupsen/logrus"
-	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 	"github.com/pquerna/distsync/common"
 
@@ -27,38 +26,33 @@ import (
 )
 
 type s3Poll struct {
-	bucket   string
-	lastEtag string
-	creds    *common.AwsCreds
+	bucket    string
+	markers   []string
+	lastEtags map[string]string
+	creds     *common.AwsCreds
 }
 
-// Polls the specified S3 bucket for a new .distsync file every 10 to 20 seconds.
+// Polls the specified S3 bucket for a new .distsync file in each of
+// channels every 10 to 20 seconds.
 //
 // $0.004 per 10,000 requests.
 // 2.62974e6 seconds in a month.
 // 175,316, 15 second periods.
 // 17.5316, 10,000 requests bundles.
-// 17.5316 * $0.0044 = $0.077 per month per watcher for request charges.
+// 17.5316 * $0.0044 = $0.077 per month per watcher per channel for request charges.
 //
-func NewS3Poll(conf *common.AwsCreds, bucketName string) (Notifier, error) {
+func NewS3Poll(conf *common.AwsCreds, bucketName string, channels []string) (Notifier, error) {
 	return newTimedPoller(
 		&s3Poll{
-			bucket: bucketName,
-			creds:  conf,
+			bucket:    bucketName,
+			markers:   markerNames(channels),
+			lastEtags: make(map[string]string),
+			creds:     conf,
 		}), nil
 }
 
 func (s *s3Poll) client() (*s3.S3, error) {
-	a := aws.Auth{
-		AccessKey: s.creds.AccessKey,
-		SecretKey: s.creds.SecretKey,
-	}
-	r, ok := aws.Regions[s.creds.Region]
-	if !ok {
-		return nil, errors.New("S3: Unkonwn region: '" + s.creds.Region + "'")
-	}
-
-	return s3.New(a, r), nil
+	return s.creds.S3Client()
 }
 
 func (sp *s3Poll) Poll() (bool, error) {
@@ -69,31 +63,42 @@ func (sp *s3Poll) Poll() (bool, error) {
 
 	bucket := client.Bucket(sp.bucket)
 
-	log.WithFields(log.Fields{
-		"last_etag": sp.lastEtag,
-		"bucket":    sp.bucket,
-		"file":      ".distsync",
-	}).Debug("Checking for changed ETag")
+	changed := false
+	for _, marker := range sp.markers {
+		lastEtag := sp.lastEtags[marker]
 
-	resp, err := bucket.Head(".distsync")
+		log.WithFields(log.Fields{
+			"last_etag": lastEtag,
+			"bucket":    sp.bucket,
+			"file":      marker,
+		}).Debug("Checking for changed ETag")
 
-	if err != nil {
-		return false, err
-	}
+		resp, err := bucket.Head(marker)
 
-	etag := resp.Header.Get("ETag")
-	if etag == "" {
-		return false, errors.New("Empty ETag on HEAD")
-	}
+		if err != nil {
+			s3err, ok := err.(*s3.Error)
+			if ok && s3err.StatusCode == 404 {
+				// nothing has been uploaded to the channel yet.
+				continue
+			}
+			return false, err
+		}
 
-	if etag != sp.lastEtag {
-		log.WithFields(log.Fields{
-			"last_etag": sp.lastEtag,
-			"new_etag":  etag,
-		}).Info("ETag changed, notifying watchers.")
-		sp.lastEtag = etag
-		return true, nil
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			return false, errors.New("Empty ETag on HEAD")
+		}
+
+		if etag != lastEtag {
+			log.WithFields(log.Fields{
+				"file":      marker,
+				"last_etag": lastEtag,
+				"new_etag":  etag,
+			}).Info("ETag changed, notifying watchers.")
+			sp.lastEtags[marker] = etag
+			changed = true
+		}
 	}
 
-	return false, nil
+	return changed, nil
 }
@@ -0,0 +1,241 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package release
+
+import (
+	"github.com/klauspost/compress/zstd"
+
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Returns the tar stream in r, decompressing gzip and zstd tarballs.
+func decompress(r io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+
+	return br, func() {}, nil
+}
+
+// Extracts the tarball in r into dir. Entries can't be written outside
+// of dir, either with their names or through symlinks in the tarball.
+func extract(dir string, r io.Reader) error {
+	tr, done, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	t := tar.NewReader(tr)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err := entryPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == dir {
+			continue
+		}
+
+		err = checkParents(dir, name)
+		if err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = makeDir(name, mode)
+		case tar.TypeReg:
+			err = writeFile(name, t, mode)
+			if err == nil {
+				err = os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+			}
+		case tar.TypeSymlink:
+			err = replace(name)
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, name)
+			}
+		case tar.TypeLink:
+			err = link(dir, hdr.Linkname, name)
+		default:
+			// devices, fifos and the like aren't deployed.
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the path of a tarball entry in dir, or an error if it would
+// be outside of dir.
+func entryPath(dir string, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", errors.New("Tarball entry has an absolute path: " + name)
+	}
+
+	p := filepath.Join(dir, name)
+	if p != dir && !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+		return "", errors.New("Tarball entry is outside of the release: " + name)
+	}
+
+	return p, nil
+}
+
+// Returns an error if any directory between dir and name is a symlink,
+// which could point outside of dir. Missing directories are created.
+func checkParents(dir string, name string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(name))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	p := dir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+
+		st, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(p, 0755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if st.Mode()&os.ModeSymlink != 0 {
+			return errors.New("Tarball entry is inside a symlink: " + name)
+		}
+		if !st.IsDir() {
+			return errors.New("Tarball entry is inside a file: " + name)
+		}
+	}
+
+	return nil
+}
+
+// Removes an earlier entry with the same name, later entries in a
+// tarball replace earlier ones. Directories are kept.
+func replace(name string) error {
+	err := os.Remove(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func makeDir(name string, mode os.FileMode) error {
+	st, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(name, 0755)
+	} else if err == nil && !st.IsDir() {
+		err = errors.New("Tarball directory replaces a file: " + name)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(name, mode|0700)
+}
+
+func link(dir string, linkname string, name string) error {
+	target, err := entryPath(dir, linkname)
+	if err != nil {
+		return err
+	}
+
+	err = checkParents(dir, target)
+	if err != nil {
+		return err
+	}
+
+	err = replace(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Link(target, name)
+}
+
+// Creates the file, without following a symlink left by an earlier
+// entry with the same name.
+func writeFile(name string, r io.Reader, mode os.FileMode) error {
+	err := replace(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// the umask may have removed bits from mode.
+	return os.Chmod(name, mode)
+}
@@ -0,0 +1,422 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+// Package release installs downloaded tarballs as releases: each one is
+// extracted into OutputDir/releases/<name>-<timestamp>, and the
+// OutputDir/current symlink is switched to it. Routed tarballs use the
+// OutputDir of their route instead, see Dir.
+package release
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	releasesDir = "releases"
+	currentLink = "current"
+	pinFile     = ".distsync-pin"
+	// Sorts in the order releases were installed.
+	timeFormat = "20060102T150405Z"
+	// Used when a release of the same version was installed within the
+	// same second. time.Parse reads it with timeFormat as well.
+	nanoTimeFormat = "20060102T150405.000000000Z"
+)
+
+// Serializes ActivateDownloaded.
+var activateMtx sync.Mutex
+
+// Suffixes removed from tarball names to name their releases.
+var tarSuffixes = []string{".tar.gz", ".tgz", ".tar.zst", ".tar"}
+
+type Release struct {
+	// Directory name, in OutputDir/releases.
+	Name string
+	// Name of the tarball without its extension, see Version.
+	Version   string
+	Installed time.Time
+	// The current symlink points to this release.
+	Current bool
+}
+
+// Matches returns true if the file name is installed as a release.
+func Matches(c *common.Release, name string) bool {
+	if c == nil || c.Pattern == "" {
+		return false
+	}
+
+	ok, _ := path.Match(c.Pattern, name)
+	return ok
+}
+
+// Dir returns the output directory the releases of name, a tarball,
+// version or release name, are installed in. Releases follow the route
+// of their tarball, like other files.
+func Dir(c *common.Conf, name string) string {
+	for _, n := range []string{name, releaseVersion(name)} {
+		if Matches(c.Release, n) {
+			return c.OutputDirFor(n)
+		}
+
+		for _, suffix := range tarSuffixes {
+			if Matches(c.Release, n+suffix) {
+				return c.OutputDirFor(n + suffix)
+			}
+		}
+	}
+
+	return *c.OutputDir
+}
+
+// Dirs returns every output directory releases can be installed in:
+// OutputDir, and the OutputDir of each route.
+func Dirs(c *common.Conf) []string {
+	rv := []string{*c.OutputDir}
+	for _, r := range c.Routes {
+		if r.OutputDir == "" {
+			continue
+		}
+
+		seen := false
+		for _, dir := range rv {
+			if dir == r.OutputDir {
+				seen = true
+			}
+		}
+		if !seen {
+			rv = append(rv, r.OutputDir)
+		}
+	}
+	return rv
+}
+
+// Version returns the version of the tarball filename: its name
+// without the extension, like "app-1" for "app-1.tar.gz". Servers are
+// pinned to versions.
+func Version(filename string) string {
+	for _, suffix := range tarSuffixes {
+		if strings.HasSuffix(filename, suffix) {
+			return strings.TrimSuffix(filename, suffix)
+		}
+	}
+	return filename
+}
+
+// Returns the release name for a tarball installed at t.
+func releaseName(filename string, t time.Time) string {
+	return Version(filename) + "-" + t.UTC().Format(timeFormat)
+}
+
+// Returns the name for a new release of a tarball installed at t in
+// dir, with nanoseconds if a release already has the name.
+func newReleaseName(dir string, filename string, t time.Time) string {
+	name := releaseName(filename, t)
+	_, err := os.Lstat(filepath.Join(dir, name))
+	if err != nil {
+		return name
+	}
+
+	return Version(filename) + "-" + t.UTC().Format(nanoTimeFormat)
+}
+
+// Install extracts the tarball read from r into a new release for
+// filename, uploaded at modTime, and returns the name of the release.
+// Nothing is left behind if extraction fails.
+func Install(workDir string, filename string, modTime time.Time, r io.Reader) (string, error) {
+	dir := filepath.Join(workDir, releasesDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmpDir, err := ioutil.TempDir(dir, ".distsync")
+	if err != nil {
+		return "", err
+	}
+
+	err = extract(tmpDir, r)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	// TempDir creates directories only readable by their owner.
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	// records when the tarball was uploaded, see ActivateDownloaded.
+	err = os.Chtimes(tmpDir, modTime, modTime)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	name := newReleaseName(dir, filename, time.Now())
+	err = os.Rename(tmpDir, filepath.Join(dir, name))
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Activate atomically points the current symlink at the release: a new
+// symlink is renamed over the old one, so it always points somewhere.
+func Activate(workDir string, name string) error {
+	_, err := os.Stat(filepath.Join(workDir, releasesDir, name))
+	if err != nil {
+		return err
+	}
+
+	tmpLink := filepath.Join(workDir, ".distsync-"+currentLink)
+	os.Remove(tmpLink)
+
+	err = os.Symlink(filepath.Join(releasesDir, name), tmpLink)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpLink, filepath.Join(workDir, currentLink))
+	if err != nil {
+		os.Remove(tmpLink)
+		return err
+	}
+
+	return nil
+}
+
+// ActivateDownloaded activates a release installed by the daemon. While
+// the server is pinned, only releases of the pinned version are
+// activated. Otherwise the release is not activated if the current one
+// is from a newer tarball, since downloads can finish out of order.
+// Returns true if the release was activated.
+func ActivateDownloaded(c *common.Release, workDir string, name string) (bool, error) {
+	activateMtx.Lock()
+	defer activateMtx.Unlock()
+
+	st, err := os.Stat(filepath.Join(workDir, releasesDir, name))
+	if err != nil {
+		return false, err
+	}
+
+	pin, err := Pinned(c, workDir)
+	if err != nil {
+		return false, err
+	}
+
+	if pin != "" {
+		if releaseVersion(name) != pin {
+			return false, nil
+		}
+		return true, Activate(workDir, name)
+	}
+
+	current, err := Current(workDir)
+	if err != nil {
+		return false, err
+	}
+
+	if current != "" {
+		cst, err := os.Stat(filepath.Join(workDir, releasesDir, current))
+		if err == nil && cst.ModTime().After(st.ModTime()) {
+			return false, nil
+		}
+	}
+
+	return true, Activate(workDir, name)
+}
+
+// Current returns the name of the release the current symlink points
+// at, or "" if there is none.
+func Current(workDir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(workDir, currentLink))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if filepath.Dir(target) != releasesDir {
+		return "", errors.New("Unexpected target of " + currentLink + ": " + target)
+	}
+
+	return filepath.Base(target), nil
+}
+
+// List returns the installed releases, oldest first.
+func List(workDir string) ([]*Release, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(workDir, releasesDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	current, err := Current(workDir)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]*Release, 0, len(entries))
+	for _, st := range entries {
+		// skip releases being extracted.
+		if !st.IsDir() || strings.HasPrefix(st.Name(), ".") {
+			continue
+		}
+
+		i := strings.LastIndex(st.Name(), "-")
+		if i < 0 {
+			continue
+		}
+
+		t, err := time.Parse(timeFormat, st.Name()[i+1:])
+		if err != nil {
+			continue
+		}
+
+		rv = append(rv, &Release{
+			Name:      st.Name(),
+			Version:   st.Name()[:i],
+			Installed: t,
+			Current:   st.Name() == current,
+		})
+	}
+
+	sort.Sort(byInstalled(rv))
+
+	return rv, nil
+}
+
+// Prune deletes the oldest releases, until keep are left. The current
+// release is never deleted.
+func Prune(workDir string, keep int) error {
+	releases, err := List(workDir)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(releases)-keep; i++ {
+		if releases[i].Current {
+			continue
+		}
+
+		err = os.RemoveAll(filepath.Join(workDir, releasesDir, releases[i].Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the version of a release name, without its timestamp.
+func releaseVersion(name string) string {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return name
+	}
+	return name[:i]
+}
+
+// Find returns the newest release named name, or of version name.
+func Find(releases []*Release, name string) *Release {
+	var rv *Release
+	for _, r := range releases {
+		if r.Name == name {
+			return r
+		}
+		if r.Version == name {
+			rv = r
+		}
+	}
+	return rv
+}
+
+// Pinned returns the version the server is pinned to, or "" if it
+// isn't pinned. A pin set with SetPin overrides the one in c.
+func Pinned(c *common.Release, workDir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(workDir, pinFile))
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if c == nil {
+		return "", nil
+	}
+	return c.Pin, nil
+}
+
+// SetPin pins the server to version, until ClearPin is called.
+func SetPin(workDir string, version string) error {
+	tmpFile, err := ioutil.TempFile(workDir, ".distsync")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(version + "\n")
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), filepath.Join(workDir, pinFile))
+}
+
+// ClearPin removes a pin set with SetPin.
+func ClearPin(workDir string) error {
+	err := os.Remove(filepath.Join(workDir, pinFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+type byInstalled []*Release
+
+func (r byInstalled) Len() int      { return len(r) }
+func (r byInstalled) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byInstalled) Less(i, j int) bool {
+	if r[i].Installed.Equal(r[j].Installed) {
+		return r[i].Name < r[j].Name
+	}
+	return r[i].Installed.Before(r[j].Installed)
+}
@@ -0,0 +1,432 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package release
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testTarball(t *testing.T, entries []*tar.Header, bodies map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+
+	for _, hdr := range entries {
+		body := ""
+		if hdr.Typeflag == tar.TypeReg {
+			body = bodies[hdr.Name]
+		}
+		hdr.Size = int64(len(body))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		_, err = tw.Write([]byte(body))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func testWorkDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "distsync-release")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	c := &common.Release{Pattern: "app-*.tar.gz"}
+	if !Matches(c, "app-1.tar.gz") || Matches(c, "notes.txt") {
+		t.Fatal("unexpected match")
+	}
+
+	if Matches(&common.Release{}, "app-1.tar.gz") || Matches(nil, "app-1.tar.gz") {
+		t.Fatal("expected release mode to be off")
+	}
+}
+
+func TestDirRouted(t *testing.T) {
+	out := "/srv/out"
+	c := common.NewConf()
+	c.OutputDir = &out
+	c.Release = &common.Release{Pattern: "*.tar.gz"}
+	c.Routes = []*common.Route{
+		{Pattern: "web-*", OutputDir: "/srv/web"},
+		{Pattern: "*.json", Mode: "0644"},
+		{Pattern: "db-*", OutputDir: "/srv/web"},
+	}
+
+	for name, dir := range map[string]string{
+		"web-2.tar.gz":           "/srv/web",
+		"web-2":                  "/srv/web",
+		"web-2-20141002T150405Z": "/srv/web",
+		"app-1":                  out,
+		"app-1.tar.gz":           out,
+	} {
+		if Dir(c, name) != dir {
+			t.Fatalf("expected %s for %s, got %s", dir, name, Dir(c, name))
+		}
+	}
+
+	dirs := Dirs(c)
+	if len(dirs) != 2 || dirs[0] != out || dirs[1] != "/srv/web" {
+		t.Fatalf("unexpected release directories: %v", dirs)
+	}
+}
+
+func TestReleaseName(t *testing.T) {
+	ts := time.Date(2014, 10, 2, 15, 4, 5, 0, time.UTC)
+	for in, out := range map[string]string{
+		"app-1.tar.gz":  "app-1-20141002T150405Z",
+		"app-1.tgz":     "app-1-20141002T150405Z",
+		"app-1.tar.zst": "app-1-20141002T150405Z",
+		"app.tar":       "app-20141002T150405Z",
+		"app.bin":       "app.bin-20141002T150405Z",
+	} {
+		if releaseName(in, ts) != out {
+			t.Fatalf("expected %s for %s, got %s", out, in, releaseName(in, ts))
+		}
+	}
+}
+
+func TestInstallActivate(t *testing.T) {
+	workDir, cleanup := testWorkDir(t)
+	defer cleanup()
+
+	data := testTarball(t, []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0755},
+		{Name: "README", Typeflag: tar.TypeReg},
+		{Name: "app", Typeflag: tar.TypeSymlink, Linkname: "bin/app"},
+		{Name: "COPYING", Typeflag: tar.TypeLink, Linkname: "README"},
+	}, map[string]string{
+		"bin/app": "#!/bin/sh\n",
+		"README":  "hello",
+	})
+
+	rel, err := Install(workDir, "app-1.tar.gz", time.Now(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = Activate(workDir, rel)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	current, err := Current(workDir)
+	if err != nil || current != rel {
+		t.Fatalf("expected current release %s, got %s: %v", rel, current, err)
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(workDir, "current", "app"))
+	if err != nil || string(body) != "#!/bin/sh\n" {
+		t.Fatalf("unexpected contents %q: %v", body, err)
+	}
+
+	st, err := os.Stat(filepath.Join(workDir, "current", "bin", "app"))
+	if err != nil || st.Mode().Perm() != 0755 {
+		t.Fatalf("unexpected mode: %v", err)
+	}
+
+	body, err = ioutil.ReadFile(filepath.Join(workDir, "current", "COPYING"))
+	if err != nil || string(body) != "hello" {
+		t.Fatalf("unexpected contents %q: %v", body, err)
+	}
+
+	err = Activate(workDir, "missing")
+	if err == nil {
+		t.Fatal("expected error activating a missing release")
+	}
+}
+
+func TestInstallSameSecond(t *testing.T) {
+	workDir, cleanup := testWorkDir(t)
+	defer cleanup()
+
+	data := testTarball(t, []*tar.Header{
+		{Name: "README", Typeflag: tar.TypeReg},
+	}, map[string]string{
+		"README": "hello",
+	})
+
+	ts := time.Now()
+	name := releaseName("app-1.tar.gz", ts)
+	err := os.MkdirAll(filepath.Join(workDir, releasesDir, name), 0755)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(workDir, releasesDir, name, "README"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if newReleaseName(filepath.Join(workDir, releasesDir), "app-1.tar.gz", ts) == name {
+		t.Fatal("expected a new release name")
+	}
+
+	rel, err := Install(workDir, "app-1.tar.gz", ts, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if rel == name {
+		t.Fatal("expected a new release name")
+	}
+
+	releases, err := List(workDir)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(releases) != 2 || releases[0].Version != "app-1" || releases[1].Version != "app-1" {
+		t.Fatalf("unexpected releases: %v", releases)
+	}
+}
+
+func TestInstallRefusesEscapes(t *testing.T) {
+	workDir, cleanup := testWorkDir(t)
+	defer cleanup()
+
+	outside := filepath.Join(workDir, "outside")
+	err := os.Mkdir(outside, 0755)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	tarballs := [][]*tar.Header{
+		{{Name: "../evil", Typeflag: tar.TypeReg}},
+		{{Name: "/tmp/evil", Typeflag: tar.TypeReg}},
+		{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/evil", Typeflag: tar.TypeReg},
+		},
+		{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link", Typeflag: tar.TypeDir},
+		},
+		{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../outside"}},
+	}
+
+	for i, entries := range tarballs {
+		data := testTarball(t, entries, nil)
+		_, err = Install(workDir, "app-1.tar.gz", time.Now(), bytes.NewReader(data))
+		if err == nil {
+			t.Fatalf("expected error from tarball %d", i)
+		}
+	}
+
+	files, err := ioutil.ReadDir(outside)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("expected nothing written outside: %v %v", files, err)
+	}
+
+	releases, err := ioutil.ReadDir(filepath.Join(workDir, releasesDir))
+	if err != nil || len(releases) != 0 {
+		t.Fatalf("expected failed releases to be removed: %v %v", releases, err)
+	}
+}
+
+func TestInstallReplacesSymlink(t *testing.T) {
+	workDir, cleanup := testWorkDir(t)
+	defer cleanup()
+
+	target := filepath.Join(workDir, "target")
+	err := ioutil.WriteFile(target, []byte("original"), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	data := testTarball(t, []*tar.Header{
+		{Name: "file", Typeflag: tar.TypeSymlink, Linkname: target},
+		{Name: "file", Typeflag: tar.TypeReg},
+	}, map[string]string{
+		"file": "replaced",
+	})
+
+	rel, err := Install(workDir, "app-1.tar.gz", time.Now(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	body, err := ioutil.ReadFile(target)
+	if err != nil || string(body) != "original" {
+		t.Fatalf("expected symlink target to be untouched, got %q: %v", body, err)
+	}
+
+	body, err = ioutil.ReadFile(filepath.Join(workDir, releasesDir, rel, "file"))
+	if err != nil || string(body) != "replaced" {
+		t.Fatalf("unexpected contents %q: %v", body, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	workDir, cleanup := testWorkDir(t)
+	defer cleanup()
+
+	for _, name := range []string{
+		"app-1-20141002T150401Z",
+		"app-2-20141002T150402Z",
+		"app-3-20141002T150403Z",
+		"app-4-20141002T150404Z",
+		".distsync123",
+	} {
+		err := os.MkdirAll(filepath.Join(workDir, releasesDir, name), 0755)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	// the current release is kept even when it is old.
+	err := Activate(workDir, "app-1-20141002T150401Z")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = Prune(workDir, 2)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	releases, err := List(workDir)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	names := make([]string, 0)
+	for _, r := range releases {
+		names = append(names, r.Name)
+	}
+
+	if len(names) != 3 || names[0] != "app-1-20141002T150401Z" || !releases[0].Current ||
+		names[1] != "app-3-20141002T150403Z" || names[2] != "app-4-20141002T150404Z" {
+		t.Fatalf("unexpected releases: %v", names)
+	}
+}
+
+func TestActivateDownloaded(t *testing.T) {
+	workDir, cleanup := testWorkDir(t)
+	defer cleanup()
+
+	data := testTarball(t, []*tar.Header{
+		{Name: "README", Typeflag: tar.TypeReg},
+	}, nil)
+
+	older, err := Install(workDir, "app-1.tar.gz", time.Unix(1400000000, 0), bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	newer, err := Install(workDir, "app-2.tar.gz", time.Unix(1400000100, 0), bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c := &common.Release{Pattern: "app-*.tar.gz"}
+
+	ok, err := ActivateDownloaded(c, workDir, newer)
+	if err != nil || !ok {
+		t.Fatalf("expected %s to be activated: %v", newer, err)
+	}
+
+	ok, err = ActivateDownloaded(c, workDir, older)
+	if err != nil || ok {
+		t.Fatalf("expected %s not to be activated: %v", older, err)
+	}
+
+	// pinned servers only activate the pinned version, even if older.
+	c.Pin = "app-1"
+	ok, err = ActivateDownloaded(c, workDir, older)
+	if err != nil || !ok {
+		t.Fatalf("expected pinned %s to be activated: %v", older, err)
+	}
+
+	// a local pin overrides the configuration.
+	err = SetPin(workDir, "app-3")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	ok, err = ActivateDownloaded(c, workDir, newer)
+	if err != nil || ok {
+		t.Fatalf("expected %s not to be activated: %v", newer, err)
+	}
+
+	err = ClearPin(workDir)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	pin, err := Pinned(c, workDir)
+	if err != nil || pin != "app-1" {
+		t.Fatalf("expected pin from configuration, got %q: %v", pin, err)
+	}
+
+	c.Pin = ""
+	ok, err = ActivateDownloaded(c, workDir, newer)
+	if err != nil || !ok {
+		t.Fatalf("expected %s to be activated: %v", newer, err)
+	}
+
+	releases, err := List(workDir)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	r := Find(releases, "app-1")
+	if r == nil || r.Name != older || r.Current {
+		t.Fatalf("unexpected release: %+v", r)
+	}
+
+	r = Find(releases, newer)
+	if r == nil || r.Version != "app-2" || !r.Current {
+		t.Fatalf("unexpected release: %+v", r)
+	}
+}
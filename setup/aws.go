@@ -117,6 +117,7 @@ func AWS(ui cli.Ui) (*common.Conf, *common.Conf, error) {
 
 	clientconf := common.NewConf()
 	clientconf.SharedSecret = si.SharedSecret
+	clientconf.SigningKey = si.SigningKey
 	clientconf.StorageBucket = si.BucketName
 	clientconf.Aws = &common.AwsCreds{
 		Region:    region.Name,
@@ -134,8 +135,9 @@ func AWS(ui cli.Ui) (*common.Conf, *common.Conf, error) {
 	}).Info("Created User and AccessKey for downloading")
 
 	serverconf := common.NewConf()
-	clientconf.SharedSecret = si.SharedSecret
-	clientconf.StorageBucket = si.BucketName
+	serverconf.SharedSecret = si.SharedSecret
+	serverconf.TrustedKeys = []string{si.TrustedKey}
+	serverconf.StorageBucket = si.BucketName
 	outdir := "~/"
 	serverconf.OutputDir = &outdir
 	serverconf.Aws = &common.AwsCreds{
@@ -251,7 +253,9 @@ func policyUploader(bucket string) (string, error) {
 	return policyBuilder(
 		[]string{
 			"s3:ListBucket",
+			"s3:GetObject",
 			"s3:PutObject",
+			"s3:DeleteObject",
 		},
 		[]string{
 			"arn:aws:s3:::" + bucket + "",
@@ -271,6 +271,7 @@ func Rackspace(ui cli.Ui) (*common.Conf, *common.Conf, error) {
 	clientconf.Notify = "CloudFilesPoll"
 	clientconf.Storage = "CloudFiles"
 	clientconf.SharedSecret = si.SharedSecret
+	clientconf.SigningKey = si.SigningKey
 	clientconf.StorageBucket = si.BucketName
 	clientconf.Rackspace = &common.RackspaceCreds{
 		Region:   region,
@@ -287,6 +288,7 @@ func Rackspace(ui cli.Ui) (*common.Conf, *common.Conf, error) {
 	serverconf.Notify = "CloudFilesPoll"
 	serverconf.Storage = "CloudFiles"
 	serverconf.SharedSecret = si.SharedSecret
+	serverconf.TrustedKeys = []string{si.TrustedKey}
 	serverconf.StorageBucket = si.BucketName
 	outdir := "~/"
 	serverconf.OutputDir = &outdir
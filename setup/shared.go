@@ -26,6 +26,9 @@ type setupInfo struct {
 	Id           string
 	BucketName   string
 	SharedSecret string
+	// Ed25519 keypair, the private key is only given to the uploader.
+	SigningKey string
+	TrustedKey string
 }
 
 func newSetupInfo() (*setupInfo, error) {
@@ -36,9 +39,16 @@ func newSetupInfo() (*setupInfo, error) {
 		return nil, err
 	}
 
+	signingKey, trustedKey, err := crypto.RandomSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
 	return &setupInfo{
 		Id:           dsId,
 		BucketName:   "distsync-" + dsId,
 		SharedSecret: sharedSecret,
+		SigningKey:   signingKey,
+		TrustedKey:   trustedKey,
 	}, nil
 }
@@ -0,0 +1,90 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+package storage
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"errors"
+	"strings"
+)
+
+// Promoter copies files between channels inside the storage backend,
+// without downloading and uploading them again.
+type Promoter interface {
+	// Copies remote filename into channel, keeping its name, records the
+	// copy in the channel's index and touches the channel's .distsync.
+	Promote(filename string, channel string) error
+}
+
+// Returns the channel of an object, and its name inside the channel.
+// Objects at the root of the bucket are in the default channel.
+func splitChannel(remoteName string) (string, string) {
+	i := strings.LastIndex(remoteName, "/")
+	if i < 0 {
+		return common.DefaultChannel, remoteName
+	}
+	return remoteName[:i], remoteName[i+1:]
+}
+
+// Returns the name of an object in channel.
+func channelObject(channel string, name string) string {
+	return common.ChannelPrefix(channel) + name
+}
+
+// Returns true if key is directly in channel, and not in another
+// channel under it or at the root of the bucket.
+func inChannel(key string, channel string) bool {
+	prefix := common.ChannelPrefix(channel)
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+
+	name := key[len(prefix):]
+	return name != "" && !strings.Contains(name, "/")
+}
+
+// Returns true if name is an object at the root of the bucket or of a
+// channel, so it can't refer to anything outside of the bucket.
+func validObjectName(name string) bool {
+	channel, base := splitChannel(name)
+	if common.ValidateChannel(channel) != nil || channelObject(channel, base) != name {
+		return false
+	}
+
+	return base != "" && base != "." && base != ".." && !strings.Contains(base, "\\")
+}
+
+// Returns the name of filename once promoted to channel.
+func promotedName(filename string, channel string) (string, error) {
+	if !validObjectName(filename) || hiddenObject(filename) {
+		return "", errors.New("Invalid filename: '" + filename + "'")
+	}
+
+	err := common.ValidateChannel(channel)
+	if err != nil {
+		return "", err
+	}
+
+	_, base := splitChannel(filename)
+	dst := channelObject(channel, base)
+	if dst == filename {
+		return "", errors.New("'" + filename + "' is already in channel '" + channel + "'")
+	}
+
+	return dst, nil
+}
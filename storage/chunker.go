@@ -0,0 +1,107 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"io"
+)
+
+// Content defined chunking: chunk boundaries are found with a rolling
+// gear hash over the data, so inserting or removing bytes only changes
+// the chunks around the edit, and the rest of a file dedups against
+// the previous version.
+const (
+	minChunkSize = 256 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+	// A boundary is on average every 2^chunkBits bytes after minChunkSize.
+	chunkBits = 20
+	chunkMask = uint64(1<<chunkBits-1) << (64 - chunkBits)
+)
+
+// The gear table must never change, or files would chunk differently
+// and stop deduplicating against earlier uploads.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64, from a fixed seed.
+	x := uint64(0x6469737473796e63)
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   r,
+		buf: make([]byte, maxChunkSize),
+	}
+}
+
+// Returns the next chunk, or io.EOF after the last one.
+func (c *chunker) Next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := chunkBoundary(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+
+	// keep the rest for the next chunk.
+	c.n = copy(c.buf, c.buf[cut:c.n])
+
+	return chunk, nil
+}
+
+// Returns the length of the first chunk in b.
+func chunkBoundary(b []byte) int {
+	if len(b) <= minChunkSize {
+		return len(b)
+	}
+
+	var hash uint64
+	for i := minChunkSize; i < len(b); i++ {
+		hash = (hash << 1) + gearTable[b[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(b)
+}
@@ -18,6 +18,7 @@
 package storage
 
 import (
+	log "github.com/Sirupsen/logrus"
 	"github.com/pquerna/distsync/common"
 	"github.com/pquerna/distsync/crypto"
 	"github.com/rackspace/gophercloud"
@@ -26,7 +27,10 @@ import (
 	"github.com/rackspace/gophercloud/rackspace"
 	"github.com/rackspace/gophercloud/rackspace/objectstorage/v1/objects"
 
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
 	"time"
@@ -38,12 +42,18 @@ const (
 	swiftTimelayout = "2006-01-02T15:04:05.999999999"
 )
 
+// Segments of large objects are stored in the same container, under
+// this prefix, the object name and the upload ID.
+const segmentsPrefix = ".distsync-segments/"
+
 type CloudFilesStorage struct {
-	bucket string
-	creds  *common.RackspaceCreds
+	bucket    string
+	creds     *common.RackspaceCreds
+	multipart *common.Multipart
+	index     *bucketIndex
 }
 
-func NewCloudFiles(creds *common.RackspaceCreds, bucket string) (*CloudFilesStorage, error) {
+func NewCloudFiles(creds *common.RackspaceCreds, bucket string, mp *common.Multipart) (*CloudFilesStorage, error) {
 	if creds == nil {
 		return nil, errors.New("CloudFiles: No Rackspace credentials provided.")
 	}
@@ -53,8 +63,9 @@ func NewCloudFiles(creds *common.RackspaceCreds, bucket string) (*CloudFilesStor
 	}
 
 	return &CloudFilesStorage{
-		bucket: bucket,
-		creds:  creds,
+		bucket:    bucket,
+		creds:     creds,
+		multipart: mp.WithDefaults(),
 	}, nil
 }
 
@@ -95,20 +106,252 @@ func (cf *CloudFilesStorage) Download(filename string, writer io.Writer) error {
 	return nil
 }
 
+func (cf *CloudFilesStorage) RangeDownload(filename string, offset int64, length int64, writer io.Writer) error {
+	client, err := cf.client()
+	if err != nil {
+		return err
+	}
+
+	resp := objects.Download(client, cf.bucket, filename, &osObjects.DownloadOpts{
+		Range: rangeHeader(offset, length),
+	})
+	if resp.Err != nil {
+		return resp.Err
+	}
+	defer resp.Body.Close()
+
+	return copyRange(writer, resp.Body, length)
+}
+
+// Deleting a large object also deletes its segments.
+func (cf *CloudFilesStorage) Delete(filename string) error {
+	if hiddenObject(filename) {
+		return errors.New("CloudFiles: invalid filename: '" + filename + "'")
+	}
+
+	client, err := cf.client()
+	if err != nil {
+		return err
+	}
+
+	// objects that are not large objects are deleted as usual.
+	_, err = objects.Delete(client, cf.bucket, filename, osObjects.DeleteOpts{
+		MultipartManifest: "delete",
+	}).ExtractHeader()
+	if err != nil {
+		return err
+	}
+
+	err = cf.index.remove(cf, filename)
+	if err != nil {
+		return err
+	}
+
+	channel, _ := splitChannel(filename)
+	return cf.touchMarker(client, channel)
+}
+
+// Copies the object with a COPY request. A COPY of a large object joins
+// its segments into one object, which Swift limits to 5 GB, so large
+// objects get their own copy of each segment and a new manifest
+// instead. They don't share segments with the original.
+func (cf *CloudFilesStorage) Promote(filename string, channel string) error {
+	dst, err := promotedName(filename, channel)
+	if err != nil {
+		return err
+	}
+
+	client, err := cf.client()
+	if err != nil {
+		return err
+	}
+
+	header, err := objects.Get(client, cf.bucket, filename, nil).ExtractHeader()
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(header.Get("X-Static-Large-Object"), "true") {
+		err = cf.copySegments(client, filename, dst)
+	} else {
+		_, err = objects.Copy(client, cf.bucket, filename, osObjects.CopyOpts{
+			Destination: "/" + cf.bucket + "/" + dst,
+		}).ExtractHeader()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = cf.index.promote(cf, filename, dst)
+	if err != nil {
+		return err
+	}
+
+	return cf.touchMarker(client, channel)
+}
+
+// Touches the .distsync of channel.
+func (cf *CloudFilesStorage) touchMarker(client *gophercloud.ServiceClient, channel string) error {
+	// just a random string taht will change the etag of .distsync,
+	// so that `notify.CloudFilesPoll` look for new files.
+	tsec, err := crypto.RandomSecret()
+	if err != nil {
+		return err
+	}
+
+	sr := strings.NewReader(tsec)
+	_, err = objects.Create(client, cf.bucket, channelObject(channel, ".distsync"), sr, &osObjects.CreateOpts{
+		ContentLength: int64(sr.Len()),
+		ContentType:   "text/plain",
+	}).ExtractHeader()
+	return err
+}
+
+func (cf *CloudFilesStorage) HasChunk(id string) bool {
+	client, err := cf.client()
+	if err != nil {
+		return false
+	}
+
+	_, err = objects.Get(client, cf.bucket, chunkObject(id), nil).ExtractHeader()
+	return err == nil
+}
+
+func (cf *CloudFilesStorage) PutChunk(id string, data []byte) error {
+	return cf.putObject(chunkObject(id), data)
+}
+
+// Copies the chunk onto itself.
+func (cf *CloudFilesStorage) TouchChunk(id string) error {
+	client, err := cf.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = objects.Copy(client, cf.bucket, chunkObject(id), osObjects.CopyOpts{
+		Destination: "/" + cf.bucket + "/" + chunkObject(id),
+	}).ExtractHeader()
+	return err
+}
+
+func (cf *CloudFilesStorage) ListChunks() (map[string]time.Time, error) {
+	client, err := cf.client()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := osObjects.ListOpts{
+		Full:   true,
+		Prefix: chunkPrefix,
+	}
+
+	rv := make(map[string]time.Time)
+	err = objects.List(client, cf.bucket, opts).EachPage(func(p pagination.Page) (bool, error) {
+		objs, err := objects.ExtractInfo(p)
+		if err != nil {
+			return false, err
+		}
+		for _, obj := range objs {
+			lm, err := time.Parse(swiftTimelayout, obj.LastModified)
+			if err != nil {
+				return false, err
+			}
+
+			rv[strings.TrimPrefix(obj.Name, chunkPrefix)] = lm
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func (cf *CloudFilesStorage) DeleteChunk(id string) error {
+	client, err := cf.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = objects.Delete(client, cf.bucket, chunkObject(id), nil).ExtractHeader()
+	return err
+}
+
+// Channels are the pseudo directories of the container with a valid
+// channel name. A listing with a delimiter returns each of them once,
+// with a trailing slash, instead of every object.
+func (cf *CloudFilesStorage) ListChannels() ([]string, error) {
+	client, err := cf.client()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]string, 0)
+	err = objects.List(client, cf.bucket, osObjects.ListOpts{Delimiter: "/"}).EachPage(func(p pagination.Page) (bool, error) {
+		names, err := objects.ExtractNames(p)
+		if err != nil {
+			return false, err
+		}
+		for _, name := range names {
+			if !strings.HasSuffix(name, "/") {
+				continue
+			}
+
+			channel := strings.TrimSuffix(name, "/")
+			if common.ValidateChannel(channel) == nil {
+				rv = append(rv, channel)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rv, nil
+}
+
+func (cf *CloudFilesStorage) putObject(name string, data []byte) error {
+	client, err := cf.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = objects.Create(client, cf.bucket, name, bytes.NewReader(data), &osObjects.CreateOpts{
+		ContentLength: int64(len(data)),
+		ContentType:   "application/octet-stream",
+	}).ExtractHeader()
+	return err
+}
+
+func (cf *CloudFilesStorage) setIndex(bi *bucketIndex) {
+	cf.index = bi
+}
+
 func (cf *CloudFilesStorage) List(dc crypto.Decryptor) ([]*FileInfo, error) {
+	return cf.ListChannel(dc, common.DefaultChannel)
+}
+
+func (cf *CloudFilesStorage) ListChannel(dc crypto.Decryptor, channel string) ([]*FileInfo, error) {
 	client, err := cf.client()
 	if err != nil {
 		return nil, err
 	}
 
+	opts := osObjects.ListOpts{
+		Full:   true,
+		Prefix: common.ChannelPrefix(channel),
+	}
+
 	rv := make([]*FileInfo, 0)
-	err = objects.List(client, cf.bucket, osObjects.ListOpts{Full: true}).EachPage(func(p pagination.Page) (bool, error) {
+	err = objects.List(client, cf.bucket, opts).EachPage(func(p pagination.Page) (bool, error) {
 		objs, err := objects.ExtractInfo(p)
 		if err != nil {
 			return false, err
 		}
 		for _, obj := range objs {
-			if obj.Name == ".distsync" {
+			if !inChannel(obj.Name, channel) || hiddenObject(obj.Name) {
 				continue
 			}
 
@@ -117,64 +360,257 @@ func (cf *CloudFilesStorage) List(dc crypto.Decryptor) ([]*FileInfo, error) {
 				return false, err
 			}
 
-			rv = append(rv, &FileInfo{
-				Name:         obj.Name,
-				LastModified: lm,
-				Length:       int64(obj.Bytes),
-			})
+			rv = appendFileInfo(rv, newFileInfo(dc, obj.Name, lm, int64(obj.Bytes)))
 		}
 		return true, nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	return rv, nil
 }
 
 func (cf *CloudFilesStorage) Upload(filename string, reader io.ReadSeeker) error {
-	// just a random string taht will change the etag of .distsync,
-	// so that `notify.S3Poller` look for new files.
-	tsec, err := crypto.RandomSecret()
+	l, err := readerLength(reader)
 	if err != nil {
 		return err
 	}
 
-	l, err := reader.Seek(0, 2)
+	return cf.UploadStream(filename, reader, l, &UploadState{})
+}
 
+func (cf *CloudFilesStorage) UploadStream(filename string, reader io.Reader, l int64, state *UploadState) error {
+	client, err := cf.client()
 	if err != nil {
 		return err
 	}
 
-	_, err = reader.Seek(0, 0)
+	hr := newHashReader(reader)
+	if l > cf.multipart.PartSize {
+		err = cf.uploadSegments(client, filename, hr, l, state)
+	} else {
+		_, err = objects.Create(client, cf.bucket, filename, hr, &osObjects.CreateOpts{
+			// gophercloud API issue: https://github.com/rackspace/gophercloud/issues/308
+			ContentLength: l,
+			ContentType:   "application/octet-stream",
+		}).ExtractHeader()
+	}
+	if err != nil {
+		return err
+	}
 
+	err = cf.index.update(cf, hr.entry(filename, l, state))
 	if err != nil {
 		return err
 	}
 
-	client, err := cf.client()
+	channel, _ := splitChannel(filename)
+	return cf.touchMarker(client, channel)
+}
+
+type sloSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// Uploads a static large object: each part is a segment object, and the
+// object itself is a manifest listing the segments. Segments that were
+// already uploaded with the same contents are skipped when the upload is
+// resumed.
+func (cf *CloudFilesStorage) uploadSegments(client *gophercloud.ServiceClient, filename string, reader io.Reader, l int64, state *UploadState) error {
+	partSize := state.partSize(cf.multipart, l, maxSegments)
+
+	if state.UploadId == "" || state.PartSize != partSize {
+		id, err := crypto.RandomThing(12, false)
+		if err != nil {
+			return err
+		}
+
+		state.UploadId = id
+		state.PartSize = partSize
+		err = state.save()
+		if err != nil {
+			return err
+		}
+	}
+
+	prefix := segmentsPrefix + filename + "/" + state.UploadId + "/"
+
+	existing := make(map[string]osObjects.Object)
+	err := objects.List(client, cf.bucket, osObjects.ListOpts{Full: true, Prefix: prefix}).EachPage(func(p pagination.Page) (bool, error) {
+		objs, err := objects.ExtractInfo(p)
+		if err != nil {
+			return false, err
+		}
+		for _, obj := range objs {
+			existing[obj.Name] = obj
+		}
+		return true, nil
+	})
 	if err != nil {
 		return err
 	}
 
-	_, err = objects.Create(client, cf.bucket, filename, reader, &osObjects.CreateOpts{
-		// gophercloud API issue: https://github.com/rackspace/gophercloud/issues/308
-		ContentLength: l,
-		ContentType:   "application/octet-stream",
-	}).ExtractHeader()
+	segments := make([]sloSegment, partCount(l, partSize))
+	err = uploadParts(reader, l, partSize, cf.multipart.Parallel, func(n int, data []byte) error {
+		name := prefix + fmt.Sprintf("%08d", n)
+		sum := partMD5(data)
+
+		segments[n-1] = sloSegment{
+			Path:      "/" + cf.bucket + "/" + name,
+			Etag:      sum,
+			SizeBytes: int64(len(data)),
+		}
+
+		obj, ok := existing[name]
+		if ok && obj.Hash == sum && int64(obj.Bytes) == int64(len(data)) {
+			return nil
+		}
+
+		_, err := objects.Create(client, cf.bucket, name, bytes.NewReader(data), &osObjects.CreateOpts{
+			ContentLength: int64(len(data)),
+			ContentType:   "application/octet-stream",
+			ETag:          sum,
+		}).ExtractHeader()
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	sr := strings.NewReader(tsec)
-	_, err = objects.Create(client, cf.bucket, ".distsync", sr, &osObjects.CreateOpts{
-		ContentLength: int64(sr.Len()),
-		ContentType:   "text/plain",
+	err = cf.putManifest(client, filename, segments)
+	if err != nil {
+		return err
+	}
+
+	err = state.remove()
+	if err != nil {
+		return err
+	}
+
+	cf.removeOldSegments(client, filename, state.UploadId)
+
+	return nil
+}
+
+// Uploads the manifest of a static large object.
+func (cf *CloudFilesStorage) putManifest(client *gophercloud.ServiceClient, filename string, segments []sloSegment) error {
+	manifest, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+
+	_, err = objects.Create(client, cf.bucket, filename, bytes.NewReader(manifest), &osObjects.CreateOpts{
+		ContentLength:     int64(len(manifest)),
+		ContentType:       "application/octet-stream",
+		MultipartManifest: "put",
 	}).ExtractHeader()
+	return err
+}
+
+// A segment in the manifest of a static large object, as Swift returns
+// it with multipart-manifest=get.
+type sloListedSegment struct {
+	// "/container/object"
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Copies each segment of the large object filename with a COPY request,
+// and uploads a manifest of the copies as dst. Segments of an earlier
+// object named dst are removed.
+func (cf *CloudFilesStorage) copySegments(client *gophercloud.ServiceClient, filename string, dst string) error {
+	resp := objects.Download(client, cf.bucket, filename, &osObjects.DownloadOpts{
+		MultipartManifest: "get",
+	})
+	if resp.Err != nil {
+		return resp.Err
+	}
+
+	listed := make([]sloListedSegment, 0)
+	err := json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	id, err := crypto.RandomThing(12, false)
 	if err != nil {
 		return err
 	}
 
+	prefix := segmentsPrefix + dst + "/" + id + "/"
+
+	segments := make([]sloSegment, len(listed))
+	for i, seg := range listed {
+		parts := strings.SplitN(strings.TrimPrefix(seg.Name, "/"), "/", 2)
+		if len(parts) != 2 {
+			return errors.New("CloudFiles: invalid segment in manifest: '" + seg.Name + "'")
+		}
+
+		name := prefix + fmt.Sprintf("%08d", i+1)
+		_, err = objects.Copy(client, parts[0], parts[1], osObjects.CopyOpts{
+			Destination: "/" + cf.bucket + "/" + name,
+		}).ExtractHeader()
+		if err != nil {
+			return err
+		}
+
+		segments[i] = sloSegment{
+			Path:      "/" + cf.bucket + "/" + name,
+			Etag:      seg.Hash,
+			SizeBytes: seg.Bytes,
+		}
+	}
+
+	err = cf.putManifest(client, dst, segments)
+	if err != nil {
+		return err
+	}
+
+	cf.removeOldSegments(client, dst, id)
+
 	return nil
 }
 
+// Deletes segments of earlier uploads of filename, which are no longer
+// referenced by its manifest. Failures only leave unused segments behind.
+func (cf *CloudFilesStorage) removeOldSegments(client *gophercloud.ServiceClient, filename string, uploadId string) {
+	prefix := segmentsPrefix + filename + "/"
+	current := prefix + uploadId + "/"
+
+	old := make([]string, 0)
+	err := objects.List(client, cf.bucket, osObjects.ListOpts{Full: true, Prefix: prefix}).EachPage(func(p pagination.Page) (bool, error) {
+		objs, err := objects.ExtractInfo(p)
+		if err != nil {
+			return false, err
+		}
+		for _, obj := range objs {
+			if !strings.HasPrefix(obj.Name, current) {
+				old = append(old, obj.Name)
+			}
+		}
+		return true, nil
+	})
+
+	for _, name := range old {
+		if err != nil {
+			break
+		}
+		_, err = objects.Delete(client, cf.bucket, name, nil).ExtractHeader()
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  filename,
+			"error": err,
+		}).Warn("Failed to remove old segments")
+	}
+}
+
 func (cf *CloudFilesStorage) Start() error {
 	return nil
 }
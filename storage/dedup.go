@@ -0,0 +1,609 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deduplicated files are stored as chunk objects, named after the
+// encrypted hash of their cleartext, and a manifest listing the chunks
+// in order. The manifest is encrypted and signed like any other file,
+// and uploaded under the file name with manifestSuffix. File names
+// never contain a slash, so the two can't be confused.
+const (
+	chunkPrefix    = ".distsync-chunk-"
+	manifestSuffix = "/manifest"
+)
+
+type Manifest struct {
+	// Length of the file, the sum of the chunk lengths.
+	Length int64
+	// SHA-256 of the whole file.
+	Sha256 string
+	Chunks []*ManifestChunk
+}
+
+type ManifestChunk struct {
+	// Chunk ID, the file name encryption of Sha256 with the key that
+	// was active when the chunk was first uploaded.
+	Id string
+	// SHA-256 of the chunk cleartext, checked after it is downloaded.
+	Sha256 string
+	Length int64
+}
+
+// Returns the clear name a manifest for the file name is uploaded as.
+func ManifestName(name string) string {
+	return name + manifestSuffix
+}
+
+func chunkObject(id string) string {
+	return chunkPrefix + id
+}
+
+// UploadChunks splits r into content defined chunks, and uploads the
+// chunks that are not in storage yet, compressed with alg and encrypted.
+// Chunks uploaded with an earlier key are found through the keyring, so
+// rotating keys doesn't upload every chunk again. Returns the manifest
+// of the file, and the number of chunks uploaded.
+func UploadChunks(cs ChunkStore, ec crypto.Encryptor, alg string, r io.Reader, parallel int) (*Manifest, int, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var rv error
+	uploaded := 0
+
+	failed := func(err error) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if rv == nil {
+			rv = err
+		}
+		return rv != nil
+	}
+
+	m := &Manifest{}
+	// chunk IDs by the hex SHA-256 of their cleartext.
+	ids := make(map[string]string)
+	sem := make(chan int, parallel)
+	h := sha256.New()
+	ch := newChunker(io.TeeReader(r, h))
+
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			failed(err)
+			break
+		}
+
+		sum := sha256.Sum256(chunk)
+		hexSum := hex.EncodeToString(sum[:])
+
+		m.Length += int64(len(chunk))
+		m.Chunks = append(m.Chunks, &ManifestChunk{
+			Sha256: hexSum,
+			Length: int64(len(chunk)),
+		})
+
+		mtx.Lock()
+		_, seen := ids[hexSum]
+		ids[hexSum] = ""
+		mtx.Unlock()
+		if seen {
+			continue
+		}
+
+		candidates, err := chunkIds(ec, hexSum)
+		if err != nil {
+			failed(err)
+			break
+		}
+
+		sem <- 1
+		if failed(nil) {
+			break
+		}
+
+		wg.Add(1)
+		go func(hexSum string, candidates []string, chunk []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// a reused chunk may be old enough for CollectChunks,
+			// touch it so it is kept until the manifest is uploaded.
+			// If that fails it may just have been collected, upload
+			// it again.
+			id := ""
+			for _, c := range candidates {
+				if cs.HasChunk(c) && cs.TouchChunk(c) == nil {
+					id = c
+					break
+				}
+			}
+
+			if id == "" {
+				id = candidates[0]
+				err := putChunk(cs, ec, alg, id, chunk)
+				if err != nil {
+					failed(err)
+					return
+				}
+
+				mtx.Lock()
+				uploaded++
+				mtx.Unlock()
+			}
+
+			mtx.Lock()
+			ids[hexSum] = id
+			mtx.Unlock()
+		}(hexSum, candidates, chunk)
+	}
+
+	wg.Wait()
+
+	if rv != nil {
+		return nil, 0, rv
+	}
+
+	for _, c := range m.Chunks {
+		c.Id = ids[c.Sha256]
+	}
+
+	m.Sha256 = hex.EncodeToString(h.Sum(nil))
+
+	return m, uploaded, nil
+}
+
+// Returns the IDs a chunk can be stored under, the one for the active
+// key first.
+func chunkIds(ec crypto.Encryptor, hexSum string) ([]string, error) {
+	if nl, ok := ec.(crypto.NameLookup); ok {
+		return nl.EncryptNames(hexSum)
+	}
+
+	id, err := ec.EncryptName(hexSum)
+	if err != nil {
+		return nil, err
+	}
+	return []string{id}, nil
+}
+
+func putChunk(cs ChunkStore, ec crypto.Encryptor, alg string, id string, chunk []byte) error {
+	header, err := ec.NewHeader(alg)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	err = ec.EncryptWithHeader(header, bytes.NewReader(chunk), buf)
+	if err != nil {
+		return err
+	}
+
+	return cs.PutChunk(id, buf.Bytes())
+}
+
+// ReencryptChunks stores the chunks of the manifest in remoteName, of
+// the file name, under the active key, and returns a manifest referring
+// to them. Chunks that are already stored under the active key, by
+// this or another file, aren't uploaded again. Also returns whether any
+// chunk of the manifest changed. The old chunks are left for
+// CollectChunks.
+func ReencryptChunks(c *common.Conf, ec crypto.Cryptor, s Storage, remoteName string, name string) (*Manifest, bool, error) {
+	cs, ok := s.(ChunkStore)
+	if !ok {
+		return nil, false, errors.New("Dedup is not supported by the " + c.Storage + " storage backend.")
+	}
+
+	m, err := readManifest(c, ec, s, remoteName, name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	for _, mc := range m.Chunks {
+		id, err := ec.EncryptName(mc.Sha256)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if id == mc.Id {
+			continue
+		}
+
+		if !cs.HasChunk(id) || cs.TouchChunk(id) != nil {
+			err = reencryptChunk(c, ec, s, cs, mc, id)
+			if err != nil {
+				return nil, false, err
+			}
+		}
+
+		mc.Id = id
+		changed = true
+	}
+
+	return m, changed, nil
+}
+
+// Downloads the chunk mc, and uploads it again as the chunk id.
+func reencryptChunk(c *common.Conf, ec crypto.Cryptor, dl Downloader, cs ChunkStore, mc *ManifestChunk, id string) error {
+	data, err := downloadChunk(ec, dl, mc)
+	if err != nil {
+		return err
+	}
+
+	if !chunkMatches(mc, data) {
+		return errors.New("Chunk does not match the manifest.")
+	}
+
+	alg, err := crypto.Compression(c, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	return putChunk(cs, ec, alg, id, data)
+}
+
+// Returns the chunk IDs the object remoteName refers to, none unless it
+// is a manifest.
+func manifestChunkIds(c *common.Conf, ec crypto.Cryptor, dl Downloader, remoteName string) ([]string, error) {
+	_, name := splitChannel(remoteName)
+	if crypto.IsEncryptedName(name) {
+		var err error
+		name, err = ec.DecryptName(name)
+		if err != nil {
+			return nil, errors.New("Can't decrypt the name of " + remoteName + ", not collecting chunks: " + err.Error())
+		}
+	}
+
+	if !strings.HasSuffix(name, manifestSuffix) {
+		return nil, nil
+	}
+
+	m, err := readManifest(c, ec, dl, remoteName, strings.TrimSuffix(name, manifestSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(m.Chunks))
+	for _, chunk := range m.Chunks {
+		ids = append(ids, chunk.Id)
+	}
+	return ids, nil
+}
+
+// Downloads, verifies and decrypts the manifest of a chunked file.
+func (dq *DownloadQueue) readManifest(ec crypto.Cryptor, fd *FileDownload) (*Manifest, error) {
+	return readManifest(fd.conf, ec, dq.dl, fd.FileInfo.RemoteName, fd.FileInfo.Name)
+}
+
+// Downloads, verifies and decrypts the manifest in remoteName, of the
+// file name.
+func readManifest(c *common.Conf, ec crypto.Cryptor, dl Downloader, remoteName string, name string) (*Manifest, error) {
+	enc := &bytes.Buffer{}
+	err := dl.Download(remoteName, enc)
+	if err != nil {
+		return nil, err
+	}
+
+	vr, err := crypto.NewVerifyingReader(c, name, enc)
+	if err != nil {
+		return nil, err
+	}
+
+	clear := &bytes.Buffer{}
+	err = ec.Decrypt(vr, clear)
+	if err != nil {
+		return nil, err
+	}
+
+	err = vr.Verify()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(clear.Bytes(), m)
+	if err != nil {
+		return nil, err
+	}
+
+	total := int64(0)
+	for _, c := range m.Chunks {
+		if c.Length < 0 || c.Length > maxChunkSize {
+			return nil, errors.New("Invalid chunk length in manifest.")
+		}
+		total += c.Length
+	}
+
+	if total != m.Length {
+		return nil, errors.New("Manifest length does not match its chunks.")
+	}
+
+	return m, nil
+}
+
+// Chunks uploaded or reused within this long are never collected, their
+// manifest may not be uploaded yet.
+const chunkGracePeriod = 24 * time.Hour
+
+// CollectChunks deletes the chunks no manifest in any channel refers
+// to, and returns how many there were. With dryRun, nothing is deleted.
+// Every object name must be readable, an unknown key could hide a
+// manifest.
+func CollectChunks(c *common.Conf, ec crypto.Cryptor, s Storage, dryRun bool) (int, error) {
+	cc, ok := s.(ChunkCollector)
+	if !ok {
+		return 0, nil
+	}
+
+	chunks, err := cc.ListChunks()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(chunks) == 0 {
+		return 0, nil
+	}
+
+	channels, err := cc.ListChannels()
+	if err != nil {
+		return 0, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, channel := range append([]string{common.DefaultChannel}, channels...) {
+		// names are decrypted below, so one that can't be is an
+		// error rather than skipped.
+		objects, err := s.ListChannel(nil, channel)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, obj := range objects {
+			for _, remoteName := range append([]string{obj.RemoteName}, obj.Older...) {
+				ids, err := manifestChunkIds(c, ec, s, remoteName)
+				if err != nil {
+					return 0, err
+				}
+
+				for _, id := range ids {
+					referenced[id] = true
+				}
+			}
+		}
+	}
+
+	// chunks are listed again after the manifests, so one an upload
+	// touched while they were read is seen as recent.
+	chunks, err = cc.ListChunks()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-chunkGracePeriod)
+	count := 0
+	for id, uploaded := range chunks {
+		if referenced[id] || uploaded.After(cutoff) {
+			continue
+		}
+
+		if !dryRun {
+			err = cc.DeleteChunk(id)
+			if err != nil {
+				return count, err
+			}
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+type localChunk struct {
+	offset int64
+	length int64
+}
+
+// Chunks the previous version of a file, so chunks it already has don't
+// need to be downloaded. Returns the open file, or nil if there is none.
+func localChunks(filename string) (*os.File, map[string]localChunk) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil
+	}
+
+	chunks := make(map[string]localChunk)
+	offset := int64(0)
+	ch := newChunker(file)
+
+	for {
+		chunk, err := ch.Next()
+		if err != nil {
+			break
+		}
+
+		sum := sha256.Sum256(chunk)
+		chunks[hex.EncodeToString(sum[:])] = localChunk{
+			offset: offset,
+			length: int64(len(chunk)),
+		}
+		offset += int64(len(chunk))
+	}
+
+	return file, chunks
+}
+
+// Downloads a chunked file into tmpFile. Chunks found in the previous
+// version of the file in workDir are copied from it, the rest are
+// downloaded. Every chunk is checked against the signed manifest.
+func (dq *DownloadQueue) downloadChunked(ec crypto.Cryptor, fd *FileDownload, workDir string, tmpFile *os.File) error {
+	m, err := dq.readManifest(ec, fd)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Failed to read manifest.")
+		return err
+	}
+
+	prev, local := localChunks(path.Join(workDir, fd.FileInfo.Name))
+	if prev != nil {
+		defer prev.Close()
+	}
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var rv error
+	reused := 0
+
+	failed := func(err error) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if rv == nil {
+			rv = err
+		}
+		return rv != nil
+	}
+
+	parallel := fd.conf.Download.WithDefaults().Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	sem := make(chan int, parallel)
+	offset := int64(0)
+
+	for _, c := range m.Chunks {
+		sem <- 1
+		if failed(nil) {
+			break
+		}
+
+		loc, ok := local[c.Sha256]
+		if ok {
+			reused++
+		}
+
+		wg.Add(1)
+		go func(c *ManifestChunk, offset int64, loc localChunk, ok bool) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var data []byte
+			var err error
+			if ok {
+				data, err = readLocalChunk(prev, loc)
+			}
+
+			// fall back to downloading if the local file changed.
+			if !ok || err != nil || !chunkMatches(c, data) {
+				data, err = dq.fetchChunk(ec, c)
+				if err == nil && !chunkMatches(c, data) {
+					err = errors.New("Chunk does not match the manifest.")
+				}
+			}
+
+			if err == nil {
+				_, err = tmpFile.WriteAt(data, offset)
+			}
+
+			if err != nil {
+				failed(err)
+			}
+		}(c, offset, loc, ok)
+
+		offset += c.Length
+	}
+
+	wg.Wait()
+
+	if rv != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   rv,
+		}).Error("Chunked download failed.")
+		return rv
+	}
+
+	log.WithFields(log.Fields{
+		"file":   fd.FileInfo.Name,
+		"chunks": len(m.Chunks),
+		"reused": reused,
+	}).Info("Reused chunks of the previous version")
+
+	return tmpFile.Truncate(m.Length)
+}
+
+func readLocalChunk(file *os.File, loc localChunk) ([]byte, error) {
+	data := make([]byte, loc.length)
+	_, err := file.ReadAt(data, loc.offset)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (dq *DownloadQueue) fetchChunk(ec crypto.Cryptor, c *ManifestChunk) ([]byte, error) {
+	return downloadChunk(ec, dq.dl, c)
+}
+
+// Downloads and decrypts a chunk.
+func downloadChunk(ec crypto.Cryptor, dl Downloader, c *ManifestChunk) ([]byte, error) {
+	enc := &bytes.Buffer{}
+	err := dl.Download(chunkObject(c.Id), enc)
+	if err != nil {
+		return nil, err
+	}
+
+	clear := &bytes.Buffer{}
+	err = ec.Decrypt(enc, clear)
+	if err != nil {
+		return nil, err
+	}
+
+	return clear.Bytes(), nil
+}
+
+func chunkMatches(c *ManifestChunk, data []byte) bool {
+	sum := sha256.Sum256(data)
+	return int64(len(data)) == c.Length && hex.EncodeToString(sum[:]) == c.Sha256
+}
@@ -0,0 +1,406 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testChunks(t *testing.T, data []byte) [][]byte {
+	rv := make([][]byte, 0)
+	ch := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			return rv
+		} else if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		rv = append(rv, chunk)
+	}
+}
+
+func testDedupData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunker(t *testing.T) {
+	data := testDedupData(12*1024*1024, 1)
+	chunks := testChunks(t, data)
+
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not add up to the data")
+	}
+
+	for i, c := range chunks {
+		if len(c) > maxChunkSize || (len(c) < minChunkSize && i != len(chunks)-1) {
+			t.Fatalf("unexpected chunk size %d", len(c))
+		}
+	}
+
+	// inserting bytes only changes the chunks around them.
+	edited := append(append(append([]byte{}, data[:6*1024*1024]...), []byte("inserted")...), data[6*1024*1024:]...)
+
+	before := make(map[string]bool)
+	for _, c := range chunks {
+		before[string(c)] = true
+	}
+
+	changed := 0
+	for _, c := range testChunks(t, edited) {
+		if !before[string(c)] {
+			changed++
+		}
+	}
+
+	if changed == 0 || changed > 2 {
+		t.Fatalf("expected one or two changed chunks, got %d of %d", changed, len(chunks))
+	}
+
+	if len(testChunks(t, nil)) != 0 {
+		t.Fatal("expected no chunks for empty input")
+	}
+}
+
+func testUploadChunked(t *testing.T, ec crypto.Cryptor, s Storage, name string, data []byte) (*Manifest, int) {
+	m, uploaded, err := UploadChunks(s.(ChunkStore), ec, "", bytes.NewReader(data), 2)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	testUploadManifest(t, ec, s, name, m)
+
+	return m, uploaded
+}
+
+func testUploadManifest(t *testing.T, ec crypto.Cryptor, s Storage, name string, m *Manifest) {
+	mdata, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	enc := &bytes.Buffer{}
+	err = ec.Encrypt(bytes.NewReader(mdata), enc)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	remoteName, err := ec.EncryptName(ManifestName(name))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload(remoteName, bytes.NewReader(enc.Bytes()))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+}
+
+func testDownloadAll(t *testing.T, c *common.Conf, ec crypto.Cryptor, s Storage) {
+	files, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(files) != 1 || !files[0].Chunked || files[0].Name != "app.tar" {
+		t.Fatalf("unexpected listing: %v", files)
+	}
+
+	dl, err := NewPersistentDownloader(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	dq := NewDownloadQueue(dl)
+	err = dq.Start()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer dq.Stop()
+
+	done := make(chan *FileDownload)
+	go dq.Add(c, files[0], done)
+	fd := <-done
+	if fd.Error != nil {
+		t.Fatalf("error: %v", fd.Error)
+	}
+}
+
+func TestLocalDedup(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	v1 := testDedupData(8*1024*1024, 2)
+	m1, uploaded := testUploadChunked(t, ec, s, "app.tar", v1)
+	if uploaded != len(m1.Chunks) || m1.Length != int64(len(v1)) {
+		t.Fatalf("unexpected first upload: %d of %d chunks", uploaded, len(m1.Chunks))
+	}
+
+	testDownloadAll(t, c, ec, s)
+
+	v2 := append(append(append([]byte{}, v1[:4*1024*1024]...), []byte("build 2")...), v1[4*1024*1024:]...)
+	m2, uploaded := testUploadChunked(t, ec, s, "app.tar", v2)
+	if uploaded == 0 || uploaded > 2 {
+		t.Fatalf("expected only changed chunks to be uploaded, got %d of %d", uploaded, len(m2.Chunks))
+	}
+
+	// chunks shared with the first version must come from the local copy.
+	for _, mc := range m1.Chunks {
+		os.Remove(filepath.Join(c.StorageBucket, chunkObject(mc.Id)))
+	}
+
+	testDownloadAll(t, c, ec, s)
+
+	data, err := ioutil.ReadFile(filepath.Join(*c.OutputDir, "app.tar"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !bytes.Equal(data, v2) {
+		t.Fatal("Failed round trip of deduplicated file.")
+	}
+}
+
+func TestLocalDedupRotated(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	oldEc, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	data := testDedupData(4*1024*1024, 4)
+	m1, _ := testUploadChunked(t, oldEc, s, "app.tar", data)
+
+	key, err := crypto.RandomKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	c.Keys = []*common.Key{key}
+	c.ActiveKey = key.Id
+
+	newEc, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// chunks uploaded with the old key are found through the keyring.
+	m2, uploaded := testUploadChunked(t, newEc, s, "app.tar", data)
+	if uploaded != 0 {
+		t.Fatalf("expected no chunks uploaded after rotation, got %d of %d", uploaded, len(m2.Chunks))
+	}
+
+	for i := range m1.Chunks {
+		if m1.Chunks[i].Id != m2.Chunks[i].Id {
+			t.Fatal("expected the manifest to refer to the existing chunks")
+		}
+	}
+
+	// re-encrypting stores the chunks under the new key.
+	remoteName, err := newEc.EncryptName(ManifestName("app.tar"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	m3, changed, err := ReencryptChunks(c, newEc, s, remoteName, "app.tar")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !changed {
+		t.Fatal("expected chunks of the old key to be re-encrypted")
+	}
+
+	for i, mc := range m3.Chunks {
+		id, err := newEc.EncryptName(mc.Sha256)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		if mc.Id != id || mc.Id == m1.Chunks[i].Id || !s.(ChunkStore).HasChunk(id) {
+			t.Fatal("expected the manifest to refer to chunks of the new key")
+		}
+	}
+
+	testUploadManifest(t, newEc, s, "app.tar", m3)
+
+	_, changed, err = ReencryptChunks(c, newEc, s, remoteName, "app.tar")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if changed {
+		t.Fatal("expected re-encrypted chunks to be kept")
+	}
+
+	// only the new key is needed to download the file.
+	c.Keys = []*common.Key{key}
+	testDownloadAll(t, c, newEc, s)
+
+	out, err := ioutil.ReadFile(filepath.Join(*c.OutputDir, "app.tar"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Fatal("Failed round trip of re-encrypted chunks.")
+	}
+}
+
+func TestLocalCollectChunks(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	app := testDedupData(4*1024*1024, 5)
+	testUploadChunked(t, ec, s, "app.tar", app)
+
+	lib, _ := testUploadChunked(t, ec, s, "lib.tar", testDedupData(2*1024*1024, 6))
+	remoteName, err := ec.EncryptName(ManifestName("lib.tar"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.(Deleter).Delete(remoteName)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// chunks within the grace period are kept.
+	n, err := CollectChunks(c, ec, s, false)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if n != 0 {
+		t.Fatalf("expected new chunks to be kept, collected %d", n)
+	}
+
+	old := time.Now().Add(-2 * chunkGracePeriod)
+	for _, mc := range lib.Chunks {
+		os.Chtimes(filepath.Join(c.StorageBucket, chunkObject(mc.Id)), old, old)
+	}
+
+	n, err = CollectChunks(c, ec, s, true)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if n != len(lib.Chunks) || !s.(ChunkStore).HasChunk(lib.Chunks[0].Id) {
+		t.Fatalf("expected a dry run to count %d chunks and keep them, got %d", len(lib.Chunks), n)
+	}
+
+	n, err = CollectChunks(c, ec, s, false)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if n != len(lib.Chunks) || s.(ChunkStore).HasChunk(lib.Chunks[0].Id) {
+		t.Fatalf("expected %d chunks to be collected, got %d", len(lib.Chunks), n)
+	}
+
+	testDownloadAll(t, c, ec, s)
+
+	// old chunks reused by an upload are kept, even before its
+	// manifest is uploaded.
+	appRemote, err := ec.EncryptName(ManifestName("app.tar"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.(Deleter).Delete(appRemote)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	chunks, err := s.(ChunkCollector).ListChunks()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for id := range chunks {
+		os.Chtimes(filepath.Join(c.StorageBucket, chunkObject(id)), old, old)
+	}
+
+	m, uploaded, err := UploadChunks(s.(ChunkStore), ec, "", bytes.NewReader(app), 2)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if uploaded != 0 {
+		t.Fatalf("expected the chunks to be reused, uploaded %d of %d", uploaded, len(m.Chunks))
+	}
+
+	n, err = CollectChunks(c, ec, s, false)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if n != 0 || !s.(ChunkStore).HasChunk(m.Chunks[0].Id) {
+		t.Fatalf("expected reused chunks to be kept, collected %d", n)
+	}
+
+	// a name no key can decrypt could be a manifest.
+	err = ioutil.WriteFile(filepath.Join(c.StorageBucket, "dsn1-AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="), []byte("x"), 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = CollectChunks(c, ec, s, false)
+	if err == nil {
+		t.Fatal("expected error from an unreadable name")
+	}
+}
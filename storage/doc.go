@@ -18,6 +18,7 @@
 package storage
 
 import (
+	log "github.com/Sirupsen/logrus"
 	"github.com/pquerna/distsync/common"
 	"github.com/pquerna/distsync/crypto"
 
@@ -33,6 +34,25 @@ type Uploader interface {
 	// of sized / length'ed readers -- this uses .Seek to calcualte
 	// the file size.
 	Upload(filename string, reader io.ReadSeeker) error
+	// Upload exactly length bytes from reader, without seeking, so
+	// encrypted data can be streamed straight to storage. Large files
+	// are uploaded in parts, and resumed from state when possible.
+	UploadStream(filename string, reader io.Reader, length int64, state *UploadState) error
+}
+
+// Returns the length of reader, and seeks back to its start.
+func readerLength(reader io.ReadSeeker) (int64, error) {
+	l, err := reader.Seek(0, 2)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = reader.Seek(0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return l, nil
 }
 
 type Downloader interface {
@@ -40,21 +60,125 @@ type Downloader interface {
 	Download(filename string, writer io.Writer) error
 }
 
+type RangeDownloader interface {
+	// Downloads length bytes of remote filename, starting at offset.
+	RangeDownload(filename string, offset int64, length int64, writer io.Writer) error
+}
+
+// ChunkStore stores the chunks of deduplicated files. See UploadChunks.
+type ChunkStore interface {
+	// Returns true if the chunk has already been uploaded. Errors count
+	// as a missing chunk, uploading it again is harmless.
+	HasChunk(id string) bool
+	// Uploads an encrypted chunk, without notifying servers of a change.
+	PutChunk(id string, data []byte) error
+	// Sets the upload time of an existing chunk to now, so
+	// CollectChunks keeps it until the manifest reusing it is uploaded.
+	TouchChunk(id string) error
+}
+
+// ChunkCollector lists and deletes chunks, see CollectChunks.
+type ChunkCollector interface {
+	// Returns the ID of every chunk, with the time it was uploaded.
+	ListChunks() (map[string]time.Time, error)
+	// Deletes a chunk, without notifying servers.
+	DeleteChunk(id string) error
+	// Returns the channels objects have been uploaded to, other than
+	// the default channel.
+	ListChannels() ([]string, error)
+}
+
+// Deleter removes files from storage.
+type Deleter interface {
+	// Deletes remote filename, removes it from the bucket index and
+	// touches .distsync so servers notice. The chunks of a deduplicated
+	// file can be shared with other files, and are kept.
+	Delete(filename string) error
+}
+
 type DownloadTorrenter interface {
 	DownloadTorrent(filename string, writer io.Writer) error
 }
 
-// TODO: hash of file? Other attributes?
+// TODO: Other attributes?
 type FileInfo struct {
-	Name         string
+	// Cleartext name of the file.
+	Name string
+	// Name of the object in the storage backend, usually encrypted.
+	RemoteName string
+	// Channel the object is in.
+	Channel      string
 	LastModified time.Time
 	Length       int64
+	// The object is the manifest of a deduplicated file.
+	Chunked bool
+	// Hex SHA-256 of the cleartext, empty if unknown.
+	Sha256 string
+	// Remote names of older objects with the same name, like a copy
+	// encrypted with an earlier key, which are hidden by this one.
+	Older []string
+}
+
+// Creates a FileInfo for a remote object, decrypting its name with dc.
+// Objects uploaded before file names were encrypted keep their
+// clear name. Returns nil if the name can't be decrypted.
+func newFileInfo(dc crypto.Decryptor, remoteName string, lm time.Time, length int64) *FileInfo {
+	channel, name := splitChannel(remoteName)
+
+	if dc != nil && crypto.IsEncryptedName(name) {
+		var err error
+		name, err = dc.DecryptName(name)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"remote_name": remoteName,
+				"error":       err,
+			}).Warn("Failed to decrypt file name, skipping.")
+			return nil
+		}
+	}
+
+	chunked := strings.HasSuffix(name, manifestSuffix)
+
+	return &FileInfo{
+		Name:         strings.TrimSuffix(name, manifestSuffix),
+		RemoteName:   remoteName,
+		Channel:      channel,
+		LastModified: lm,
+		Length:       length,
+		Chunked:      chunked,
+	}
+}
+
+// Appends fi to files, unless a newer file with the same name is
+// already present. During migration a bucket can hold both a clear
+// named and an encrypted copy of a file. The hidden copy is recorded in
+// Older of the one that is kept.
+func appendFileInfo(files []*FileInfo, fi *FileInfo) []*FileInfo {
+	if fi == nil {
+		return files
+	}
+
+	for i, f := range files {
+		if f.Name == fi.Name {
+			if fi.LastModified.After(f.LastModified) {
+				fi.Older = append(append(fi.Older, f.Older...), f.RemoteName)
+				files[i] = fi
+			} else {
+				f.Older = append(append(f.Older, fi.Older...), fi.RemoteName)
+			}
+			return files
+		}
+	}
+
+	return append(files, fi)
 }
 
 type Lister interface {
 	// Returns a list of available files to download. dc will
 	// optionally decrypt filenames if requested.
 	List(dc crypto.Decryptor) ([]*FileInfo, error)
+	// Like List, for the files in channel.
+	ListChannel(dc crypto.Decryptor, channel string) ([]*FileInfo, error)
 }
 
 type Storage interface {
@@ -71,20 +195,51 @@ type SizeReader interface {
 }
 
 func NewFromConf(c *common.Conf) (Storage, error) {
+	s, err := newIndexedStorage(c)
+	if err != nil {
+		return nil, err
+	}
+
+	// create a Cryptor after storage, the passphrase key needs the
+	// salt in the bucket.
+	if crypto.UsesPassphrase(c) && c.PassphraseKey == nil {
+		err = loadPassphraseKey(c, s, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.setIndex(newBucketIndex(c))
+
+	return s, nil
+}
+
+func newIndexedStorage(c *common.Conf) (indexedStorage, error) {
 	switch strings.ToUpper(c.Storage) {
 	case "S3":
-		return NewS3(c.Aws, c.StorageBucket)
+		return NewS3(c.Aws, c.StorageBucket, c.Multipart)
 	case "CLOUDFILES":
-		return NewCloudFiles(c.Rackspace, c.StorageBucket)
+		return NewCloudFiles(c.Rackspace, c.StorageBucket, c.Multipart)
+	case "LOCAL":
+		return NewLocal(c.StorageBucket)
 	case "disabled-S3+BITTORRENT":
-		return NewS3(c.Aws, c.StorageBucket)
+		return NewS3(c.Aws, c.StorageBucket, c.Multipart)
 	case "disabled-S3+P2P":
-		return NewS3(c.Aws, c.StorageBucket)
+		return NewS3(c.Aws, c.StorageBucket, c.Multipart)
 	}
 
 	return nil, errors.New("Unknown storage backend: " + c.Storage)
 }
 
+// Returns true for objects distsync keeps in the bucket for itself,
+// which are not listed as files. Each channel has its own .distsync
+// and index.
+func hiddenObject(name string) bool {
+	_, base := splitChannel(name)
+	return base == ".distsync" || base == indexName || name == saltName ||
+		strings.HasPrefix(name, segmentsPrefix) || strings.HasPrefix(name, chunkPrefix)
+}
+
 type PersistentDownloader interface {
 	Downloader
 	Start() error
@@ -94,9 +249,11 @@ type PersistentDownloader interface {
 func NewPersistentDownloader(c *common.Conf) (PersistentDownloader, error) {
 	switch strings.ToUpper(c.Storage) {
 	case "S3":
-		return NewS3(c.Aws, c.StorageBucket)
+		return NewS3(c.Aws, c.StorageBucket, c.Multipart)
 	case "CLOUDFILES":
-		return NewCloudFiles(c.Rackspace, c.StorageBucket)
+		return NewCloudFiles(c.Rackspace, c.StorageBucket, c.Multipart)
+	case "LOCAL":
+		return NewLocal(c.StorageBucket)
 	case "disabled-S3+BITTORRENT":
 		return NewTorrentDownloader(c)
 	case "disabled-S3+P2P":
@@ -22,7 +22,10 @@ import (
 	"github.com/mitchellh/go-homedir"
 	"github.com/pquerna/distsync/common"
 	"github.com/pquerna/distsync/crypto"
+	"github.com/pquerna/distsync/release"
 
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -109,9 +112,10 @@ func (dq *DownloadQueue) Add(conf *common.Conf, fi *FileInfo, dchan chan *FileDo
 	return fd
 }
 
-func (dq *DownloadQueue) download(fd *FileDownload) error {
-	var err error
-	defer fd.Done(err)
+func (dq *DownloadQueue) download(fd *FileDownload) (err error) {
+	defer func() {
+		fd.Done(err)
+	}()
 
 	ec, err := crypto.NewFromConf(fd.conf)
 
@@ -123,41 +127,31 @@ func (dq *DownloadQueue) download(fd *FileDownload) error {
 		return err
 	}
 
-	workDir, err := homedir.Expand(*fd.conf.OutputDir)
+	route := fd.conf.RouteFor(fd.FileInfo.Name)
+	outputDir := fd.conf.OutputDirFor(fd.FileInfo.Name)
+
+	workDir, err := homedir.Expand(outputDir)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
-			"path":  *fd.conf.OutputDir,
+			"path":  outputDir,
 		}).Error("Home directory expansion failed")
 		return err
 	}
 
-	finalName := path.Join(workDir, fd.FileInfo.Name)
-
-	tmpFileEnc, err := ioutil.TempFile(workDir, ".distsync-e")
-	if err != nil {
-		log.WithFields(log.Fields{
-			"file":    fd.FileInfo.Name,
-			"workdir": workDir,
-			"error":   err,
-		}).Error("Failed to create temp file")
-		return err
+	if route != nil && route.OutputDir != "" {
+		err = os.MkdirAll(workDir, 0755)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":    fd.FileInfo.Name,
+				"workdir": workDir,
+				"error":   err,
+			}).Error("Failed to create output directory")
+			return err
+		}
 	}
 
-	defer func() {
-		tmpFileEnc.Close()
-		os.Remove(tmpFileEnc.Name())
-	}()
-
-	err = dq.dl.Download(fd.FileInfo.Name, tmpFileEnc)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"file":    fd.FileInfo.Name,
-			"workdir": workDir,
-			"error":   err,
-		}).Error("Download failed")
-		return err
-	}
+	finalName := path.Join(workDir, fd.FileInfo.Name)
 
 	tmpFile, err := ioutil.TempFile(workDir, ".distsync")
 	if err != nil {
@@ -173,24 +167,29 @@ func (dq *DownloadQueue) download(fd *FileDownload) error {
 		os.Remove(tmpFile.Name())
 	}()
 
-	_, err = tmpFileEnc.Seek(0, 0)
+	rd, ok := dq.dl.(RangeDownloader)
+	if fd.FileInfo.Chunked {
+		err = dq.downloadChunked(ec, fd, workDir, tmpFile)
+	} else if ok && useRanges(fd.conf, fd.FileInfo.Length) {
+		err = downloadRanges(rd, ec, fd, workDir, tmpFile)
+	} else {
+		err = dq.downloadStream(ec, fd, workDir, tmpFile)
+	}
 	if err != nil {
-		log.WithFields(log.Fields{
-			"file":    fd.FileInfo.Name,
-			"workdir": workDir,
-			"error":   err,
-		}).Error("Failed seek to 0 on temp file")
 		return err
 	}
 
-	err = ec.Decrypt(tmpFileEnc, tmpFile)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"file":    fd.FileInfo.Name,
-			"workdir": workDir,
-			"error":   err,
-		}).Error("Decryption failed.")
-		return err
+	if fd.FileInfo.Sha256 != "" {
+		err = verifyContent(tmpFile, fd.FileInfo.Sha256)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":    fd.FileInfo.Name,
+				"workdir": workDir,
+				"sha256":  fd.FileInfo.Sha256,
+				"error":   err,
+			}).Error("Content verification failed.")
+			return err
+		}
 	}
 
 	err = tmpFile.Sync()
@@ -214,6 +213,30 @@ func (dq *DownloadQueue) download(fd *FileDownload) error {
 		return err
 	}
 
+	if route != nil {
+		err = applyRoute(route, tmpFile)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":    fd.FileInfo.Name,
+				"workdir": workDir,
+				"mode":    route.Mode,
+				"owner":   route.Owner,
+				"error":   err,
+			}).Error("Failed to set mode or owner of file.")
+			return err
+		}
+	}
+
+	// extracted before the tarball is renamed into place, so a failed
+	// extraction is tried again on the next change.
+	var rel string
+	if release.Matches(fd.conf.Release, fd.FileInfo.Name) {
+		rel, err = installRelease(fd, workDir, tmpFile)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = os.Rename(tmpFile.Name(), finalName)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -241,6 +264,175 @@ func (dq *DownloadQueue) download(fd *FileDownload) error {
 		return err
 	}
 
+	if rel != "" {
+		return activateRelease(fd, workDir, rel)
+	}
+
+	return nil
+}
+
+// Sets the mode and owner a route gives its files, before the file is
+// renamed into place.
+func applyRoute(route *common.Route, tmpFile *os.File) error {
+	mode, err := route.FileMode()
+	if err != nil {
+		return err
+	}
+
+	if mode != 0 {
+		err = tmpFile.Chmod(mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	uid, gid, err := route.Ownership()
+	if err != nil {
+		return err
+	}
+
+	if uid != -1 || gid != -1 {
+		return tmpFile.Chown(uid, gid)
+	}
+
+	return nil
+}
+
+// Extracts the downloaded tarball in tmpFile as a new release.
+func installRelease(fd *FileDownload, workDir string, tmpFile *os.File) (string, error) {
+	_, err := tmpFile.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := release.Install(workDir, fd.FileInfo.Name, fd.FileInfo.LastModified, tmpFile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Failed to extract release.")
+		return "", err
+	}
+
+	return rel, nil
+}
+
+// Switches the current symlink to rel, unless a newer release is
+// active or the server is pinned, and removes old releases.
+func activateRelease(fd *FileDownload, workDir string, rel string) error {
+	activated, err := release.ActivateDownloaded(fd.conf.Release, workDir, rel)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"release": rel,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Failed to activate release.")
+		return err
+	}
+
+	if activated {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"release": rel,
+		}).Info("Activated release")
+	} else {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"release": rel,
+		}).Info("Newer release already active or pinned, not activating")
+	}
+
+	keep := fd.conf.Release.WithDefaults().Keep
+	if keep > 0 {
+		err = release.Prune(workDir, keep)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"workdir": workDir,
+				"error":   err,
+			}).Warn("Failed to remove old releases.")
+		}
+	}
+
+	return nil
+}
+
+// Decrypts while downloading, the cleartext is only renamed into place
+// once decryption and the signature have been verified.
+func (dq *DownloadQueue) downloadStream(ec crypto.Cryptor, fd *FileDownload, workDir string, tmpFile *os.File) error {
+	pr, pw := io.Pipe()
+	vr, err := crypto.NewVerifyingReader(fd.conf, fd.FileInfo.Name, pr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  fd.FileInfo.Name,
+			"error": err,
+		}).Error("Signature setup failed")
+		return err
+	}
+
+	dlerr := make(chan error, 1)
+	go func() {
+		err := dq.dl.Download(fd.FileInfo.RemoteName, pw)
+		pw.CloseWithError(err)
+		dlerr <- err
+	}()
+
+	var verr error
+	err = ec.Decrypt(vr, tmpFile)
+	if err == nil {
+		verr = vr.Verify()
+	}
+
+	// stops the download if decryption gave up early.
+	pr.Close()
+	derr := <-dlerr
+
+	if derr != nil && derr != io.ErrClosedPipe {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   derr,
+		}).Error("Download failed")
+		return derr
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Decryption failed.")
+		return err
+	}
+
+	if verr != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   verr,
+		}).Error("Signature verification failed.")
+		return verr
+	}
+
+	return nil
+}
+
+// Checks the cleartext in f against the SHA-256 from the bucket index.
+func verifyContent(f *os.File, expected string) error {
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	sum, err := ContentSha256(f)
+	if err != nil {
+		return err
+	}
+
+	if sum != expected {
+		return errors.New("Downloaded file does not match its SHA-256.")
+	}
+
 	return nil
 }
 
@@ -0,0 +1,448 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+	"github.com/rackspace/gophercloud"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The bucket index lists every file in the bucket, so servers read one
+// object instead of listing the whole bucket on every change. It is
+// encrypted and signed like any other file. Each channel has its own.
+const indexName = ".distsync-index"
+
+// ErrNoIndex is returned by ReadIndex when the bucket has no index yet.
+// Other errors, like a bad signature, mean the index can't be trusted.
+var ErrNoIndex = errors.New("The bucket has no index.")
+
+type Index struct {
+	// Increases with every change, so servers can refuse an older index.
+	Seq   uint64
+	Files []*IndexEntry
+}
+
+type IndexEntry struct {
+	RemoteName   string
+	Length       int64
+	LastModified time.Time
+	// SHA-256 of the stored object. Empty for files added from a listing.
+	Sha256 string
+	// SHA-256 of the cleartext, if the uploader recorded it.
+	ContentSha256 string
+}
+
+// Adds or replaces the entry for an object.
+func (idx *Index) add(entry *IndexEntry) {
+	for i, e := range idx.Files {
+		if e.RemoteName == entry.RemoteName {
+			idx.Files[i] = entry
+			return
+		}
+	}
+
+	idx.Files = append(idx.Files, entry)
+}
+
+// Returns the entry for an object, or nil.
+func (idx *Index) find(remoteName string) *IndexEntry {
+	for _, e := range idx.Files {
+		if e.RemoteName == remoteName {
+			return e
+		}
+	}
+	return nil
+}
+
+// Removes the entry for an object, if there is one.
+func (idx *Index) remove(remoteName string) {
+	for i, e := range idx.Files {
+		if e.RemoteName == remoteName {
+			idx.Files = append(idx.Files[:i], idx.Files[i+1:]...)
+			return
+		}
+	}
+}
+
+// FileInfos returns the files in the index, like Lister.List.
+func (idx *Index) FileInfos(dc crypto.Decryptor) []*FileInfo {
+	rv := make([]*FileInfo, 0, len(idx.Files))
+	for _, e := range idx.Files {
+		fi := newFileInfo(dc, e.RemoteName, e.LastModified, e.Length)
+		if fi != nil {
+			fi.Sha256 = e.ContentSha256
+		}
+		rv = appendFileInfo(rv, fi)
+	}
+	return rv
+}
+
+// ReadIndex downloads, verifies and decrypts the bucket index.
+func ReadIndex(c *common.Conf, dc crypto.Decryptor, dl Downloader) (*Index, error) {
+	return ReadChannelIndex(c, dc, dl, common.DefaultChannel)
+}
+
+// ReadChannelIndex is ReadIndex for the index of channel.
+func ReadChannelIndex(c *common.Conf, dc crypto.Decryptor, dl Downloader, channel string) (*Index, error) {
+	name := channelObject(channel, indexName)
+
+	enc := &bytes.Buffer{}
+	err := dl.Download(name, enc)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrNoIndex
+		}
+		return nil, err
+	}
+
+	vr, err := crypto.NewVerifyingReader(c, name, enc)
+	if err != nil {
+		return nil, err
+	}
+
+	clear := &bytes.Buffer{}
+	err = dc.Decrypt(vr, clear)
+	if err != nil {
+		return nil, err
+	}
+
+	err = vr.Verify()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{}
+	err = json.Unmarshal(clear.Bytes(), idx)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// Builds an index from a full listing of channel.
+func indexFromList(l Lister, channel string) (*Index, error) {
+	files, err := l.ListChannel(nil, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{}
+	for _, fi := range files {
+		idx.add(&IndexEntry{
+			RemoteName:   fi.RemoteName,
+			Length:       fi.Length,
+			LastModified: fi.LastModified,
+		})
+	}
+
+	return idx, nil
+}
+
+// Returns a sequence number after seq. Based on the time, so an index
+// rebuilt from a listing still sorts after the one it replaces.
+func nextSeq(seq uint64) uint64 {
+	now := uint64(time.Now().UnixNano())
+	if now > seq {
+		return now
+	}
+	return seq + 1
+}
+
+// indexedStorage is a storage backend that keeps a bucket index.
+type indexedStorage interface {
+	Storage
+	setIndex(bi *bucketIndex)
+	// Writes an object without updating the index or notifying servers.
+	putObject(name string, data []byte) error
+}
+
+// Serializes index updates from every storage instance in the process,
+// uploading several files creates one for each of them.
+var indexMtx sync.Mutex
+
+const maxIndexAttempts = 5
+
+// How long a writer waits before reading back an object uploaders on
+// other machines may write at the same time, like the index, so one
+// that read it first has time to write its own copy.
+var settleDelay = time.Second
+
+// bucketIndex updates the index of a bucket after each upload or
+// deletion. Changes from one process are serialized. Uploaders on
+// different machines each read the index back after writing it, and
+// write their change again while it is missing. An uploader that read
+// the index before another one wrote it, and writes after that one
+// read it back, can still drop its entry, servers find such files with
+// the listing they merge in from time to time, see MergeListing.
+type bucketIndex struct {
+	conf *common.Conf
+}
+
+func newBucketIndex(c *common.Conf) *bucketIndex {
+	return &bucketIndex{
+		conf: c,
+	}
+}
+
+// Records an uploaded object in the index of its channel. A nil index
+// does nothing.
+func (bi *bucketIndex) update(s indexedStorage, entry *IndexEntry) error {
+	channel, _ := splitChannel(entry.RemoteName)
+	return bi.modify(s, channel, func(idx *Index) {
+		idx.add(entry)
+	}, func(idx *Index) bool {
+		e := idx.find(entry.RemoteName)
+		return e != nil && e.LastModified.Equal(entry.LastModified)
+	})
+}
+
+// Drops a deleted object from the index of its channel. A nil index
+// does nothing.
+func (bi *bucketIndex) remove(s indexedStorage, remoteName string) error {
+	channel, _ := splitChannel(remoteName)
+	return bi.modify(s, channel, func(idx *Index) {
+		idx.remove(remoteName)
+	}, func(idx *Index) bool {
+		return idx.find(remoteName) == nil
+	})
+}
+
+// Records dst, a copy of src made by Promote, in the index of its
+// channel, with the hashes src has in its own index. A nil index does
+// nothing.
+func (bi *bucketIndex) promote(s indexedStorage, src string, dst string) error {
+	if bi == nil {
+		return nil
+	}
+
+	ec, err := crypto.NewFromConf(bi.conf)
+	if err != nil {
+		return err
+	}
+
+	channel, _ := splitChannel(src)
+	idx, err := bi.read(ec, s, channel)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range idx.Files {
+		if e.RemoteName == src {
+			entry := *e
+			entry.RemoteName = dst
+			entry.LastModified = time.Now().UTC()
+			return bi.update(s, &entry)
+		}
+	}
+
+	return errors.New("'" + src + "' is not in the bucket index.")
+}
+
+// Reads the index of channel, or builds it from a listing if there is
+// none yet. An index that fails to verify is never replaced, so it can't
+// be used to reset the sequence number.
+func (bi *bucketIndex) read(dc crypto.Decryptor, s indexedStorage, channel string) (*Index, error) {
+	idx, err := ReadChannelIndex(bi.conf, dc, s, channel)
+	if err != ErrNoIndex {
+		return idx, err
+	}
+
+	log.WithFields(log.Fields{
+		"channel": channel,
+	}).Warn("Building bucket index from a full listing.")
+
+	return indexFromList(s, channel)
+}
+
+// Returns true if err means a downloaded object doesn't exist.
+func isNotFound(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+
+	switch e := err.(type) {
+	case *s3.Error:
+		return e.StatusCode == 404
+	case *gophercloud.UnexpectedResponseCodeError:
+		return e.Actual == 404
+	}
+
+	return false
+}
+
+// Reads the index of channel, applies change and writes it back with
+// the next sequence number. The index is then read back, and written
+// again while applied returns false for it, in case another uploader
+// wrote an index without the change.
+func (bi *bucketIndex) modify(s indexedStorage, channel string, change func(idx *Index), applied func(idx *Index) bool) error {
+	if bi == nil {
+		return nil
+	}
+
+	indexMtx.Lock()
+	defer indexMtx.Unlock()
+
+	ec, err := crypto.NewFromConf(bi.conf)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= maxIndexAttempts; attempt++ {
+		err = bi.write(ec, s, channel, change)
+		if err != nil {
+			return err
+		}
+
+		time.Sleep(settleDelay)
+
+		idx, err := ReadChannelIndex(bi.conf, ec, s, channel)
+		if err != nil {
+			return err
+		}
+
+		if applied(idx) {
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"channel": channel,
+			"attempt": attempt,
+		}).Warn("Bucket index was overwritten by another uploader, updating it again.")
+	}
+
+	return errors.New("The bucket index kept being overwritten by other uploaders.")
+}
+
+// Reads the index of channel, applies change and writes it with the
+// next sequence number.
+func (bi *bucketIndex) write(ec crypto.Cryptor, s indexedStorage, channel string, change func(idx *Index)) error {
+	idx, err := bi.read(ec, s, channel)
+	if err != nil {
+		return err
+	}
+
+	change(idx)
+	idx.Seq = nextSeq(idx.Seq)
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	name := channelObject(channel, indexName)
+
+	enc := &bytes.Buffer{}
+	sw, err := crypto.NewSigningWriter(bi.conf, name, enc)
+	if err != nil {
+		return err
+	}
+
+	err = ec.Encrypt(bytes.NewReader(data), sw)
+	if err != nil {
+		return err
+	}
+
+	err = sw.Close()
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(name, enc.Bytes())
+}
+
+// MergeListing adds the files of a channel listing to the files of its
+// index that are missing from the index, or newer than their entry.
+// An uploader can drop another one's entry from the index, this finds
+// those files.
+func MergeListing(indexed []*FileInfo, listed []*FileInfo) []*FileInfo {
+	rv := append([]*FileInfo{}, indexed...)
+	for _, fi := range listed {
+		found := false
+		for i, f := range rv {
+			if f.RemoteName != fi.RemoteName {
+				continue
+			}
+
+			found = true
+			if fi.LastModified.After(f.LastModified) {
+				rv[i] = fi
+			}
+			break
+		}
+
+		if !found {
+			rv = appendFileInfo(rv, fi)
+		}
+	}
+	return rv
+}
+
+// hashReader hashes what is read through it, so the index can record
+// the hash of a streamed upload.
+type hashReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func newHashReader(r io.Reader) *hashReader {
+	return &hashReader{
+		r: r,
+		h: sha256.New(),
+	}
+}
+
+func (hr *hashReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
+
+func (hr *hashReader) entry(filename string, length int64, state *UploadState) *IndexEntry {
+	return &IndexEntry{
+		RemoteName:    filename,
+		Length:        length,
+		LastModified:  time.Now().UTC(),
+		Sha256:        hex.EncodeToString(hr.h.Sum(nil)),
+		ContentSha256: state.Sha256,
+	}
+}
+
+// ContentSha256 returns the hex SHA-256 of everything read from r.
+func ContentSha256(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
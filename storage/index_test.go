@@ -0,0 +1,288 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/pquerna/distsync/crypto"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalIndex(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// uploaded without an index, and picked up when the index is built.
+	plain, err := NewLocal(c.StorageBucket)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = plain.Upload("old.txt", bytes.NewReader([]byte("old")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = ReadIndex(c, ec, plain)
+	if err != ErrNoIndex {
+		t.Fatalf("expected ErrNoIndex reading a missing index, got %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload("hello.txt", bytes.NewReader([]byte("hello world")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	idx, err := ReadIndex(c, ec, s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	files := idx.FileInfos(ec)
+	if len(files) != 2 {
+		t.Fatalf("unexpected index: %v", files)
+	}
+
+	sum := sha256.Sum256([]byte("hello world"))
+	for _, e := range idx.Files {
+		if e.RemoteName == "hello.txt" && (e.Length != 11 || e.Sha256 != hex.EncodeToString(sum[:])) {
+			t.Fatalf("unexpected index entry: %+v", e)
+		}
+	}
+
+	err = s.Upload("hello.txt", bytes.NewReader([]byte("hello again")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	next, err := ReadIndex(c, ec, s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if next.Seq <= idx.Seq || len(next.Files) != 2 {
+		t.Fatalf("expected a newer index with the same files: %d <= %d", next.Seq, idx.Seq)
+	}
+
+	// the index itself isn't a file.
+	listed, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(listed) != 2 {
+		t.Fatalf("unexpected listing: %v", listed)
+	}
+
+	path := filepath.Join(c.StorageBucket, indexName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	data[len(data)/2] ^= 0x01
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = ReadIndex(c, ec, s)
+	if err == nil || err == ErrNoIndex {
+		t.Fatalf("expected error from tampered index, got %v", err)
+	}
+
+	// a tampered index is not rebuilt from a listing, which would
+	// reset its sequence number.
+	err = s.Upload("third.txt", bytes.NewReader([]byte("third")))
+	if err == nil {
+		t.Fatal("expected upload to refuse a tampered index")
+	}
+
+	tampered, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !bytes.Equal(tampered, data) {
+		t.Fatal("expected tampered index to be left alone")
+	}
+}
+
+func TestLocalDownloadQueueSha256(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	dl, err := NewPersistentDownloader(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	dq := NewDownloadQueue(dl)
+	err = dq.Start()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer dq.Stop()
+
+	sum := sha256.Sum256([]byte("hello world"))
+	for _, tc := range []struct {
+		sha256 string
+		ok     bool
+	}{
+		{hex.EncodeToString(sum[:]), true},
+		{hex.EncodeToString(make([]byte, 32)), false},
+	} {
+		enc := &bytes.Buffer{}
+		err = ec.Encrypt(bytes.NewReader([]byte("hello world")), enc)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		err = s.UploadStream("hello.txt", enc, int64(enc.Len()), &UploadState{Sha256: tc.sha256})
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		idx, err := ReadIndex(c, ec, s)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+
+		files := idx.FileInfos(ec)
+		if len(files) != 1 || files[0].Sha256 != tc.sha256 {
+			t.Fatalf("unexpected index: %v", files)
+		}
+
+		done := make(chan *FileDownload)
+		go dq.Add(c, files[0], done)
+		fd := <-done
+		if tc.ok && fd.Error != nil {
+			t.Fatalf("error: %v", fd.Error)
+		}
+		if !tc.ok && fd.Error == nil {
+			t.Fatal("expected error from mismatched SHA-256")
+		}
+	}
+}
+
+// Overwrites the index with the copy it replaced once, like an uploader
+// on another machine that read the index before this one wrote it.
+type testRacingStorage struct {
+	*LocalStorage
+	raced bool
+	puts  int
+}
+
+func (rs *testRacingStorage) putObject(name string, data []byte) error {
+	if name != indexName {
+		return rs.LocalStorage.putObject(name, data)
+	}
+
+	rs.puts++
+	old, err := ioutil.ReadFile(filepath.Join(rs.dir, indexName))
+	if err != nil {
+		return err
+	}
+
+	err = rs.LocalStorage.putObject(name, data)
+	if err != nil || rs.raced {
+		return err
+	}
+
+	rs.raced = true
+	return rs.LocalStorage.putObject(name, old)
+}
+
+func TestIndexLostUpdate(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload("a.txt", bytes.NewReader([]byte("a")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	rs := &testRacingStorage{LocalStorage: s.(*LocalStorage)}
+	err = newBucketIndex(c).update(rs, &IndexEntry{RemoteName: "b.txt", LastModified: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	idx, err := ReadIndex(c, ec, s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if rs.puts != 2 || idx.find("a.txt") == nil || idx.find("b.txt") == nil {
+		t.Fatalf("expected the overwritten entry to be written again, %d writes: %+v", rs.puts, idx.Files)
+	}
+}
+
+func TestMergeListing(t *testing.T) {
+	now := time.Now()
+	indexed := []*FileInfo{
+		{Name: "a.txt", RemoteName: "a.txt", LastModified: now, Sha256: "aa"},
+		{Name: "b.txt", RemoteName: "b.txt", LastModified: now.Add(-time.Hour), Sha256: "bb"},
+	}
+	listed := []*FileInfo{
+		{Name: "a.txt", RemoteName: "a.txt", LastModified: now.Add(-time.Second)},
+		{Name: "b.txt", RemoteName: "b.txt", LastModified: now},
+		{Name: "c.txt", RemoteName: "c.txt", LastModified: now},
+	}
+
+	files := MergeListing(indexed, listed)
+	if len(files) != 3 || files[0].Sha256 != "aa" || files[1].Sha256 != "" || files[2].Name != "c.txt" {
+		t.Fatalf("unexpected merge: %+v", files)
+	}
+}
@@ -0,0 +1,373 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/mitchellh/go-homedir"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStorage stores files in a local directory, for example an NFS
+// mount or a volume shared between machines.
+type LocalStorage struct {
+	dir   string
+	index *bucketIndex
+}
+
+func NewLocal(dir string) (*LocalStorage, error) {
+	if dir == "" {
+		return nil, errors.New("Local: empty StorageBucket")
+	}
+
+	dir, err := homedir.Expand(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !st.IsDir() {
+		return nil, errors.New("Local: StorageBucket is not a directory: '" + dir + "'")
+	}
+
+	return &LocalStorage{
+		dir: dir,
+	}, nil
+}
+
+// writes the contents of reader to a temp file in the storage directory,
+// and then renames it to filename, so readers never see a partial file.
+// The directory of a channel is created on its first file.
+func (l *LocalStorage) writeFile(filename string, reader io.Reader, length int64) error {
+	target := filepath.Join(l.dir, filepath.FromSlash(filename))
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(l.dir, ".distsync-u")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	n, err := io.Copy(tmpFile, io.LimitReader(reader, length))
+	if err != nil {
+		return err
+	}
+
+	if n != length {
+		return errors.New("Local: expected " + strconv.FormatInt(length, 10) +
+			" bytes for '" + filename + "', got " + strconv.FormatInt(n, 10))
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Chmod(0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), target)
+}
+
+// Returns the path of an object in the storage directory.
+func (l *LocalStorage) path(filename string) (string, error) {
+	if !validObjectName(filename) {
+		return "", errors.New("Local: invalid filename: '" + filename + "'")
+	}
+
+	return filepath.Join(l.dir, filepath.FromSlash(filename)), nil
+}
+
+// Copies the file into the storage directory, and touches .distsync on success.
+// which `notify.LocalPoll` uses to find changes.
+func (l *LocalStorage) Upload(filename string, reader io.ReadSeeker) error {
+	length, err := readerLength(reader)
+	if err != nil {
+		return err
+	}
+
+	return l.UploadStream(filename, reader, length, &UploadState{})
+}
+
+// Local files are always written in one piece, so state is unused.
+func (l *LocalStorage) UploadStream(filename string, reader io.Reader, length int64, state *UploadState) error {
+	_, err := l.path(filename)
+	if err != nil {
+		return err
+	}
+
+	hr := newHashReader(reader)
+	err = l.writeFile(filename, hr, length)
+	if err != nil {
+		return err
+	}
+
+	err = l.index.update(l, hr.entry(filename, length, state))
+	if err != nil {
+		return err
+	}
+
+	channel, _ := splitChannel(filename)
+	return l.touchMarker(channel)
+}
+
+// Touches the .distsync of channel.
+func (l *LocalStorage) touchMarker(channel string) error {
+	// just a random string that will change the contents of .distsync,
+	// so that `notify.LocalPoll` look for new files.
+	tsec, err := crypto.RandomSecret()
+	if err != nil {
+		return err
+	}
+
+	return l.writeFile(channelObject(channel, ".distsync"), strings.NewReader(tsec), int64(len(tsec)))
+}
+
+func (l *LocalStorage) Delete(filename string) error {
+	fpath, err := l.path(filename)
+	if err != nil {
+		return err
+	}
+
+	if hiddenObject(filename) {
+		return errors.New("Local: invalid filename: '" + filename + "'")
+	}
+
+	err = os.Remove(fpath)
+	if err != nil {
+		return err
+	}
+
+	err = l.index.remove(l, filename)
+	if err != nil {
+		return err
+	}
+
+	channel, _ := splitChannel(filename)
+	return l.touchMarker(channel)
+}
+
+// Local files are copied through a temp file, like uploads.
+func (l *LocalStorage) Promote(filename string, channel string) error {
+	dst, err := promotedName(filename, channel)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(filename)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = l.writeFile(dst, file, st.Size())
+	if err != nil {
+		return err
+	}
+
+	err = l.index.promote(l, filename, dst)
+	if err != nil {
+		return err
+	}
+
+	return l.touchMarker(channel)
+}
+
+func (l *LocalStorage) Download(filename string, writer io.Writer) error {
+	fpath, err := l.path(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(writer, file)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (l *LocalStorage) RangeDownload(filename string, offset int64, length int64, writer io.Writer) error {
+	fpath, err := l.path(filename)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, 0)
+	if err != nil {
+		return err
+	}
+
+	return copyRange(writer, file, length)
+}
+
+func (l *LocalStorage) HasChunk(id string) bool {
+	if chunkObject(id) != filepath.Base(chunkObject(id)) {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(l.dir, chunkObject(id)))
+	return err == nil
+}
+
+func (l *LocalStorage) PutChunk(id string, data []byte) error {
+	if chunkObject(id) != filepath.Base(chunkObject(id)) {
+		return errors.New("Local: invalid chunk ID: '" + id + "'")
+	}
+
+	return l.putObject(chunkObject(id), data)
+}
+
+func (l *LocalStorage) TouchChunk(id string) error {
+	if chunkObject(id) != filepath.Base(chunkObject(id)) {
+		return errors.New("Local: invalid chunk ID: '" + id + "'")
+	}
+
+	now := time.Now()
+	return os.Chtimes(filepath.Join(l.dir, chunkObject(id)), now, now)
+}
+
+func (l *LocalStorage) ListChunks() (map[string]time.Time, error) {
+	entries, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make(map[string]time.Time)
+	for _, st := range entries {
+		if !st.IsDir() && strings.HasPrefix(st.Name(), chunkPrefix) {
+			rv[strings.TrimPrefix(st.Name(), chunkPrefix)] = st.ModTime().UTC()
+		}
+	}
+
+	return rv, nil
+}
+
+func (l *LocalStorage) DeleteChunk(id string) error {
+	if chunkObject(id) != filepath.Base(chunkObject(id)) {
+		return errors.New("Local: invalid chunk ID: '" + id + "'")
+	}
+
+	return os.Remove(filepath.Join(l.dir, chunkObject(id)))
+}
+
+// Channels are the subdirectories with a valid channel name.
+func (l *LocalStorage) ListChannels() ([]string, error) {
+	entries, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]string, 0)
+	for _, st := range entries {
+		if st.IsDir() && common.ValidateChannel(st.Name()) == nil {
+			rv = append(rv, st.Name())
+		}
+	}
+
+	return rv, nil
+}
+
+func (l *LocalStorage) putObject(name string, data []byte) error {
+	return l.writeFile(name, bytes.NewReader(data), int64(len(data)))
+}
+
+func (l *LocalStorage) setIndex(bi *bucketIndex) {
+	l.index = bi
+}
+
+func (l *LocalStorage) List(dc crypto.Decryptor) ([]*FileInfo, error) {
+	return l.ListChannel(dc, common.DefaultChannel)
+}
+
+// Channels other than the default one are subdirectories.
+func (l *LocalStorage) ListChannel(dc crypto.Decryptor, channel string) ([]*FileInfo, error) {
+	err := common.ValidateChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := common.ChannelPrefix(channel)
+	entries, err := ioutil.ReadDir(filepath.Join(l.dir, prefix))
+	if err != nil {
+		if os.IsNotExist(err) && prefix != "" {
+			// nothing has been uploaded to the channel yet.
+			return []*FileInfo{}, nil
+		}
+		return nil, err
+	}
+
+	rv := make([]*FileInfo, 0, len(entries))
+	for _, st := range entries {
+		// skip the .distsync marker and any in-progress uploads.
+		if st.IsDir() || strings.HasPrefix(st.Name(), ".distsync") {
+			continue
+		}
+
+		rv = appendFileInfo(rv, newFileInfo(dc, prefix+st.Name(), st.ModTime().UTC(), st.Size()))
+	}
+
+	return rv, nil
+}
+
+func (l *LocalStorage) Start() error {
+	return nil
+}
+
+func (l *LocalStorage) Stop() error {
+	return nil
+}
@@ -0,0 +1,583 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testLocalConf(t *testing.T) (*common.Conf, func()) {
+	// only one uploader writes the index or salt in tests.
+	settleDelay = 0
+
+	bucket, err := ioutil.TempDir("", "distsync-bucket")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	outdir, err := ioutil.TempDir("", "distsync-out")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	sec, err := crypto.RandomSecret()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	c := common.NewConf()
+	c.Storage = "Local"
+	c.Notify = "LocalPoll"
+	c.StorageBucket = bucket
+	c.SharedSecret = sec
+	c.OutputDir = &outdir
+
+	return c, func() {
+		os.RemoveAll(bucket)
+		os.RemoveAll(outdir)
+	}
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload("hello.txt", bytes.NewReader([]byte("hello world")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(c.StorageBucket, ".distsync"))
+	if err != nil {
+		t.Fatalf("expected .distsync marker: %v", err)
+	}
+
+	files, err := s.List(nil)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(files) != 1 || files[0].Name != "hello.txt" || files[0].Length != 11 {
+		t.Fatalf("unexpected listing: %v", files)
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.Download("hello.txt", buf)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Fatal("Failed round trip.")
+	}
+
+	err = s.Upload("../escape.txt", bytes.NewReader([]byte("hello world")))
+	if err == nil {
+		t.Fatal("expected error from invalid filename")
+	}
+
+	err = s.UploadStream("short.txt", bytes.NewReader([]byte("hello")), 11, &UploadState{})
+	if err == nil {
+		t.Fatal("expected error from short stream")
+	}
+}
+
+func TestLocalDownloadQueue(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	enc := &bytes.Buffer{}
+	err = ec.Encrypt(bytes.NewReader([]byte("hello world")), enc)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	remoteName, err := ec.EncryptName("hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload(remoteName, bytes.NewReader(enc.Bytes()))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	files, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(files) != 1 || files[0].Name != "hello.txt" || files[0].RemoteName != remoteName {
+		t.Fatalf("unexpected listing: %v", files)
+	}
+
+	dl, err := NewPersistentDownloader(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	dq := NewDownloadQueue(dl)
+	err = dq.Start()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer dq.Stop()
+
+	done := make(chan *FileDownload)
+	go dq.Add(c, files[0], done)
+	fd := <-done
+	if fd.Error != nil {
+		t.Fatalf("error: %v", fd.Error)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(*c.OutputDir, "hello.txt"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if string(data) != "hello world" {
+		t.Fatal("Failed round trip through DownloadQueue.")
+	}
+}
+
+func TestLocalDownloadQueueSigned(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	priv, _, err := crypto.RandomSigningKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, otherPub, err := crypto.RandomSigningKey()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	enc, err := ioutil.TempFile("", ".distsync-test")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer func() {
+		enc.Close()
+		os.Remove(enc.Name())
+	}()
+
+	err = ec.Encrypt(bytes.NewReader([]byte("hello world")), enc)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	uploader := *c
+	uploader.SigningKey = priv
+	err = crypto.SignFile(&uploader, "hello.txt", enc)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = enc.Seek(0, 0)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	remoteName, err := ec.EncryptName("hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload(remoteName, enc)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	files, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// the server trusts a different uploader.
+	c.TrustedKeys = []string{otherPub}
+
+	dl, err := NewPersistentDownloader(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	dq := NewDownloadQueue(dl)
+	err = dq.Start()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer dq.Stop()
+
+	done := make(chan *FileDownload)
+	go dq.Add(c, files[0], done)
+	fd := <-done
+	if fd.Error == nil {
+		t.Fatal("expected error from untrusted signature")
+	}
+
+	entries, err := ioutil.ReadDir(*c.OutputDir)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("expected no files in output directory, found %d", len(entries))
+	}
+}
+
+func TestLocalDelete(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		err = s.Upload(name, bytes.NewReader([]byte(name)))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	marker, err := ioutil.ReadFile(filepath.Join(c.StorageBucket, ".distsync"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.(Deleter).Delete("a.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	listed, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(listed) != 1 || listed[0].Name != "b.txt" {
+		t.Fatalf("unexpected listing: %v", listed)
+	}
+
+	idx, err := ReadIndex(c, ec, s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(idx.Files) != 1 || idx.Files[0].RemoteName != "b.txt" {
+		t.Fatalf("unexpected index: %v", idx.Files)
+	}
+
+	after, err := ioutil.ReadFile(filepath.Join(c.StorageBucket, ".distsync"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if bytes.Equal(marker, after) {
+		t.Fatal("expected .distsync to change")
+	}
+
+	err = s.(Deleter).Delete("a.txt")
+	if err == nil {
+		t.Fatal("expected error deleting a missing file")
+	}
+
+	err = s.(Deleter).Delete(indexName)
+	if err == nil {
+		t.Fatal("expected error deleting the index")
+	}
+}
+
+func TestLocalChannels(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload("root.txt", bytes.NewReader([]byte("root")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload("staging/app.txt", bytes.NewReader([]byte("app")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(c.StorageBucket, "staging", ".distsync"))
+	if err != nil {
+		t.Fatalf("expected staging .distsync marker: %v", err)
+	}
+
+	listed, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(listed) != 1 || listed[0].Name != "root.txt" || listed[0].Channel != common.DefaultChannel {
+		t.Fatalf("unexpected default listing: %v", listed)
+	}
+
+	listed, err = s.ListChannel(ec, "staging")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(listed) != 1 || listed[0].Name != "app.txt" || listed[0].RemoteName != "staging/app.txt" {
+		t.Fatalf("unexpected staging listing: %v", listed)
+	}
+
+	listed, err = s.ListChannel(ec, "production")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(listed) != 0 {
+		t.Fatalf("unexpected production listing: %v", listed)
+	}
+
+	err = s.(Promoter).Promote("staging/app.txt", "production")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(c.StorageBucket, "production", ".distsync"))
+	if err != nil {
+		t.Fatalf("expected production .distsync marker: %v", err)
+	}
+
+	staging, err := ReadChannelIndex(c, ec, s, "staging")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	production, err := ReadChannelIndex(c, ec, s, "production")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(production.Files) != 1 || production.Files[0].RemoteName != "production/app.txt" ||
+		production.Files[0].Sha256 != staging.Files[0].Sha256 {
+		t.Fatalf("unexpected production index: %v", production.Files)
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.Download("production/app.txt", buf)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if buf.String() != "app" {
+		t.Fatal("Failed to promote contents.")
+	}
+
+	root, err := ReadIndex(c, ec, s)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(root.Files) != 1 || root.Files[0].RemoteName != "root.txt" {
+		t.Fatalf("unexpected default index: %v", root.Files)
+	}
+
+	err = s.(Promoter).Promote("production/app.txt", "production")
+	if err == nil {
+		t.Fatal("expected error promoting into the same channel")
+	}
+
+	for _, name := range []string{"a/b/c.txt", "../c.txt", "default/c.txt", "staging/.."} {
+		err = s.Upload(name, bytes.NewReader([]byte("bad")))
+		if err == nil {
+			t.Fatalf("expected error from invalid filename %q", name)
+		}
+	}
+}
+
+func TestLocalListOlderCopies(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	remoteName, err := ec.EncryptName("hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// a copy from before names were encrypted, and the current one.
+	for _, name := range []string{"hello.txt", remoteName} {
+		err = s.Upload(name, bytes.NewReader([]byte("hello")))
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+
+	files, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(files) != 1 || len(files[0].Older) != 1 {
+		t.Fatalf("unexpected listing: %+v", files)
+	}
+
+	names := map[string]bool{files[0].RemoteName: true, files[0].Older[0]: true}
+	if !names["hello.txt"] || !names[remoteName] {
+		t.Fatalf("expected both copies, got %v", names)
+	}
+
+	// clear names can start with the prefix of encrypted ones.
+	err = s.Upload("dsn1-app-1.tar.gz", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	files, err = s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("unexpected listing: %+v", files)
+	}
+}
+
+func TestLocalPassphraseSalt(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	c.SharedSecret = ""
+	c.Passphrase = "correct horse battery staple"
+
+	// servers wait for the first upload to create the salt.
+	_, err := NewFromConf(c)
+	if err == nil {
+		t.Fatal("expected error without a salt in the bucket")
+	}
+
+	err = LoadPassphraseKey(c, true)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	server := *c
+	server.PassphraseKey = nil
+
+	s, err := NewFromConf(&server)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !bytes.Equal(server.PassphraseKey, c.PassphraseKey) {
+		t.Fatal("expected the same key from the stored salt")
+	}
+
+	files, err := s.List(nil)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(files) != 0 {
+		t.Fatalf("expected the salt to be hidden: %v", files)
+	}
+
+	wrong := server
+	wrong.PassphraseKey = nil
+	wrong.Passphrase = "incorrect horse battery staple"
+	_, err = NewFromConf(&wrong)
+	if err == nil {
+		t.Fatal("expected error from a passphrase the salt wasn't made with")
+	}
+
+	// a lost salt is not replaced while the bucket has files.
+	err = s.Upload("hello.txt", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = os.Remove(filepath.Join(c.StorageBucket, saltName))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	server.PassphraseKey = nil
+	err = LoadPassphraseKey(&server, true)
+	if err == nil {
+		t.Fatal("expected error creating a salt in a bucket with files")
+	}
+
+	if _, err := os.Stat(filepath.Join(c.StorageBucket, saltName)); err == nil {
+		t.Fatal("expected no new salt")
+	}
+}
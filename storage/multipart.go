@@ -0,0 +1,239 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pquerna/distsync/common"
+
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	// S3 parts, other than the last, must be at least 5 MB.
+	minPartSize = 5 * 1024 * 1024
+	maxS3Parts  = 10000
+	// Default limit of segments in a Cloud Files static large object.
+	maxSegments = 1000
+	// S3 copies objects up to 5 GB in one request, larger objects are
+	// copied in parts.
+	maxS3CopySize  = 5 * 1024 * 1024 * 1024
+	s3CopyPartSize = 1024 * 1024 * 1024
+)
+
+// UploadState is saved while a file is uploaded in parts, so running
+// `distsync upload` again resumes the parts that were not finished.
+type UploadState struct {
+	path string
+	// The encrypted file header, so the file encrypts to the same bytes
+	// when the upload is resumed. Set by the caller.
+	Header []byte
+	// The S3 multipart upload ID, or Cloud Files segment prefix.
+	UploadId string
+	PartSize int64
+	// SHA-256 of the cleartext, recorded in the bucket index. Set by
+	// the caller.
+	Sha256 string
+}
+
+// Loads the saved state of an interrupted upload of filename, or an
+// empty state if there isn't one.
+func LoadUploadState(c *common.Conf, filename string) (*UploadState, error) {
+	dir, err := homedir.Expand(c.Multipart.WithDefaults().StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(c.Storage + "/" + c.StorageBucket + "/" + filename))
+	us := &UploadState{
+		path: filepath.Join(dir, hex.EncodeToString(sum[:])),
+	}
+
+	data, err := ioutil.ReadFile(us.path)
+	if os.IsNotExist(err) {
+		return us, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, us)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  us.path,
+			"error": err,
+		}).Warn("Ignoring invalid upload state")
+		return &UploadState{path: us.path}, nil
+	}
+
+	return us, nil
+}
+
+func (us *UploadState) save() error {
+	if us.path == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(us.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(us)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(us.path, data, 0600)
+}
+
+func (us *UploadState) remove() error {
+	if us.path == "" {
+		return nil
+	}
+
+	err := os.Remove(us.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Returns the part size for an upload of length bytes. Resumed uploads
+// keep their part size, so finished parts line up.
+func (us *UploadState) partSize(mp *common.Multipart, length int64, maxParts int64) int64 {
+	if us.PartSize > 0 && length <= us.PartSize*maxParts {
+		return us.PartSize
+	}
+
+	size := mp.PartSize
+	if size < minPartSize {
+		size = minPartSize
+	}
+
+	if length > size*maxParts {
+		size = (length + maxParts - 1) / maxParts
+	}
+
+	return size
+}
+
+func partMD5(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Reads length bytes from r in parts of partSize, and calls put with each
+// part, numbered from 1. Up to parallel parts are held in memory and
+// uploaded at the same time. Returns the first error from put.
+func uploadParts(r io.Reader, length int64, partSize int64, parallel int, put func(n int, data []byte) error) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var rv error
+
+	failed := func(err error) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if rv == nil {
+			rv = err
+		}
+		return rv != nil
+	}
+
+	// buffers are reused, and limit the parts in flight.
+	bufs := make(chan []byte, parallel)
+	for i := 0; i < parallel; i++ {
+		bufs <- nil
+	}
+
+	n := 0
+	for off := int64(0); off < length; off += partSize {
+		n++
+		size := partSize
+		if length-off < size {
+			size = length - off
+		}
+
+		buf := <-bufs
+		if failed(nil) {
+			break
+		}
+
+		if int64(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			failed(err)
+			break
+		}
+
+		wg.Add(1)
+		go func(n int, buf []byte) {
+			defer wg.Done()
+			err := put(n, buf)
+			if err != nil {
+				failed(err)
+			}
+			bufs <- buf
+		}(n, buf)
+	}
+
+	wg.Wait()
+
+	return rv
+}
+
+// Returns the number of parts uploadParts uses.
+// Returns the byte ranges of the parts an object of length bytes is
+// copied in, as used by the x-amz-copy-source-range header.
+func copyRanges(length int64) []string {
+	partSize := int64(s3CopyPartSize)
+	if partCount(length, partSize) > maxS3Parts {
+		partSize = (length + maxS3Parts - 1) / maxS3Parts
+	}
+
+	rv := make([]string, 0, partCount(length, partSize))
+	for offset := int64(0); offset < length; offset += partSize {
+		end := offset + partSize
+		if end > length {
+			end = length
+		}
+		rv = append(rv, "bytes="+strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(end-1, 10))
+	}
+	return rv
+}
+
+func partCount(length int64, partSize int64) int {
+	return int((length + partSize - 1) / partSize)
+}
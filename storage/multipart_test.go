@@ -0,0 +1,174 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/pquerna/distsync/common"
+
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestUploadParts(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	var mtx sync.Mutex
+	parts := make(map[int][]byte)
+
+	err := uploadParts(bytes.NewReader(data), int64(len(data)), 300, 3, func(n int, part []byte) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		parts[n] = append([]byte{}, part...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(parts) != partCount(int64(len(data)), 300) || len(parts) != 4 {
+		t.Fatalf("unexpected number of parts: %d", len(parts))
+	}
+
+	joined := make([]byte, 0)
+	for n := 1; n <= len(parts); n++ {
+		joined = append(joined, parts[n]...)
+	}
+
+	if !bytes.Equal(data, joined) {
+		t.Fatal("parts don't match the data")
+	}
+
+	err = uploadParts(bytes.NewReader(data), int64(len(data)), 300, 2, func(n int, part []byte) error {
+		if n == 2 {
+			return errors.New("part failed")
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected error from failed part")
+	}
+
+	err = uploadParts(bytes.NewReader(data[:500]), int64(len(data)), 300, 2, func(n int, part []byte) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected error from short reader")
+	}
+}
+
+func TestUploadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distsync-state")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := common.NewConf()
+	c.StorageBucket = "distsync-test"
+	c.Multipart = &common.Multipart{StateDir: dir}
+
+	us, err := LoadUploadState(c, "hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if us.UploadId != "" || us.Header != nil {
+		t.Fatalf("expected empty state: %+v", us)
+	}
+
+	us.Header = []byte("header")
+	us.UploadId = "upload-id"
+	us.PartSize = minPartSize
+	err = us.save()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	loaded, err := LoadUploadState(c, "hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if string(loaded.Header) != "header" || loaded.UploadId != "upload-id" {
+		t.Fatalf("unexpected state: %+v", loaded)
+	}
+
+	other, err := LoadUploadState(c, "other.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if other.UploadId != "" {
+		t.Fatal("expected separate state per file")
+	}
+
+	err = loaded.remove()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	loaded, err = LoadUploadState(c, "hello.txt")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if loaded.UploadId != "" {
+		t.Fatal("expected state to be removed")
+	}
+}
+
+func TestUploadStatePartSize(t *testing.T) {
+	mp := common.NewMultipart()
+
+	us := &UploadState{}
+	if us.partSize(mp, 100*1024*1024, maxS3Parts) != mp.PartSize {
+		t.Fatal("expected the configured part size")
+	}
+
+	huge := mp.PartSize*maxSegments + 1
+	size := us.partSize(mp, huge, maxSegments)
+	if int64(partCount(huge, size)) > maxSegments {
+		t.Fatalf("part size %d gives too many segments", size)
+	}
+
+	// resumed uploads keep their part size.
+	us.PartSize = minPartSize * 2
+	if us.partSize(mp, 100*1024*1024, maxS3Parts) != minPartSize*2 {
+		t.Fatal("expected the saved part size")
+	}
+}
+
+func TestCopyRanges(t *testing.T) {
+	gb := int64(1024 * 1024 * 1024)
+
+	ranges := copyRanges(2*gb + 1)
+	if len(ranges) != 3 || ranges[0] != "bytes=0-1073741823" || ranges[2] != "bytes=2147483648-2147483648" {
+		t.Fatalf("unexpected ranges: %v", ranges)
+	}
+
+	// very large objects use larger parts, to stay under the limit.
+	if len(copyRanges(20000*gb)) > maxS3Parts {
+		t.Fatal("expected at most maxS3Parts ranges")
+	}
+}
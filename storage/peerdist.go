@@ -45,13 +45,13 @@ func NewPeerDownloader(conf *common.Conf) (PersistentDownloader, error) {
 		return nil, err
 	}
 
-	ec, err := crypto.NewFromConf(conf)
+	// TODO: better separation? different interface for download?
+	st, err := NewFromConf(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: better separation? different interface for download?
-	st, err := NewFromConf(conf)
+	ec, err := crypto.NewFromConf(conf)
 	if err != nil {
 		return nil, err
 	}
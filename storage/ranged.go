@@ -0,0 +1,320 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Attempts for each range before the download is given up, and resumed
+// by the next attempt to download the file.
+const rangeRetries = 3
+
+// rangeCheckpoint is saved next to a partially downloaded file, and
+// records which ranges have been written to it.
+type rangeCheckpoint struct {
+	path         string
+	RemoteName   string
+	LastModified time.Time
+	Length       int64
+	RangeSize    int64
+	Done         []bool
+}
+
+// Returns the names of the partial file and its checkpoint for a
+// ranged download of remoteName into workDir.
+func partialNames(workDir string, remoteName string) (string, string) {
+	sum := sha256.Sum256([]byte(remoteName))
+	id := hex.EncodeToString(sum[:8])
+	return path.Join(workDir, ".distsync-e-"+id), path.Join(workDir, ".distsync-c-"+id)
+}
+
+// Loads the checkpoint at cpPath, if it belongs to the same version of
+// fi and range size. Otherwise returns a checkpoint with no ranges done.
+func loadCheckpoint(cpPath string, fi *FileInfo, rangeSize int64) *rangeCheckpoint {
+	fresh := &rangeCheckpoint{
+		path:         cpPath,
+		RemoteName:   fi.RemoteName,
+		LastModified: fi.LastModified,
+		Length:       fi.Length,
+		RangeSize:    rangeSize,
+		Done:         make([]bool, partCount(fi.Length, rangeSize)),
+	}
+
+	data, err := ioutil.ReadFile(cpPath)
+	if err != nil {
+		return fresh
+	}
+
+	cp := &rangeCheckpoint{}
+	err = json.Unmarshal(data, cp)
+	if err != nil ||
+		cp.RemoteName != fresh.RemoteName ||
+		!cp.LastModified.Equal(fresh.LastModified) ||
+		cp.Length != fresh.Length ||
+		cp.RangeSize != fresh.RangeSize ||
+		len(cp.Done) != len(fresh.Done) {
+		return fresh
+	}
+
+	cp.path = cpPath
+	return cp
+}
+
+// Writes the checkpoint to a temporary file first, so a crash never
+// leaves a truncated checkpoint behind.
+func (cp *rangeCheckpoint) save() error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(cp.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(cp.path+".tmp", cp.path)
+}
+
+// Returns true if nothing has been downloaded yet.
+func (cp *rangeCheckpoint) empty() bool {
+	for _, done := range cp.Done {
+		if done {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if a file of length bytes should be downloaded in ranges.
+func useRanges(c *common.Conf, length int64) bool {
+	dc := c.Download.WithDefaults()
+	return dc.RangeSize > 0 && length > dc.RangeSize
+}
+
+// Returns an HTTP Range header value for length bytes from offset.
+func rangeHeader(offset int64, length int64) string {
+	return "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)
+}
+
+// Copies exactly length bytes of a range from r to w.
+func copyRange(w io.Writer, r io.Reader, length int64) error {
+	_, err := io.CopyN(w, r, length)
+	if err == io.EOF {
+		return errors.New("Short read in ranged download.")
+	}
+	return err
+}
+
+// Writes to a file from offset, so ranges can be written out of order.
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.file.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
+
+// Downloads the ranges of cp that are not done yet into part, in
+// parallel. The checkpoint is saved after each range is synced to disk,
+// so an interrupted download loses at most the ranges in flight.
+func fetchRanges(rd RangeDownloader, part *os.File, cp *rangeCheckpoint, parallel int) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var rv error
+
+	failed := func(err error) bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if rv == nil {
+			rv = err
+		}
+		return rv != nil
+	}
+
+	work := make(chan int)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				err := fetchRange(rd, part, cp, n)
+				if err != nil {
+					failed(err)
+					continue
+				}
+
+				mtx.Lock()
+				cp.Done[n] = true
+				err = part.Sync()
+				if err == nil {
+					err = cp.save()
+				}
+				mtx.Unlock()
+
+				if err != nil {
+					failed(err)
+				}
+			}
+		}()
+	}
+
+	for n, done := range cp.Done {
+		if done {
+			continue
+		}
+		if failed(nil) {
+			break
+		}
+		work <- n
+	}
+
+	close(work)
+	wg.Wait()
+
+	return rv
+}
+
+// Downloads range n of cp into part, retrying a few times.
+func fetchRange(rd RangeDownloader, part *os.File, cp *rangeCheckpoint, n int) error {
+	offset := int64(n) * cp.RangeSize
+	length := cp.RangeSize
+	if cp.Length-offset < length {
+		length = cp.Length - offset
+	}
+
+	for i := 1; ; i++ {
+		err := rd.RangeDownload(cp.RemoteName, offset, length, &offsetWriter{file: part, offset: offset})
+		if err == nil || i >= rangeRetries {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"file":   cp.RemoteName,
+			"offset": offset,
+			"length": length,
+			"error":  err,
+		}).Warn("Range download failed, retrying.")
+	}
+}
+
+// Downloads fd in parallel ranges into a partial file in workDir, then
+// decrypts it into tmpFile once the signature has been verified. The
+// partial file is kept when the download fails, and resumed next time.
+func downloadRanges(rd RangeDownloader, ec crypto.Cryptor, fd *FileDownload, workDir string, tmpFile *os.File) error {
+	dc := fd.conf.Download.WithDefaults()
+	partName, cpName := partialNames(workDir, fd.FileInfo.RemoteName)
+	cp := loadCheckpoint(cpName, fd.FileInfo, dc.RangeSize)
+
+	part, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":    partName,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Failed to open partial file")
+		return err
+	}
+	defer part.Close()
+
+	if cp.empty() {
+		err = part.Truncate(cp.Length)
+	} else {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+		}).Info("Resuming download")
+	}
+
+	if err == nil {
+		err = fetchRanges(rd, part, cp, dc.Parallel)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Download failed")
+		return err
+	}
+
+	// the partial file is only kept to resume the download.
+	defer func() {
+		os.Remove(partName)
+		os.Remove(cpName)
+	}()
+
+	_, err = part.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	vr, err := crypto.NewVerifyingReader(fd.conf, fd.FileInfo.Name, part)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":  fd.FileInfo.Name,
+			"error": err,
+		}).Error("Signature setup failed")
+		return err
+	}
+
+	err = ec.Decrypt(vr, tmpFile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Decryption failed.")
+		return err
+	}
+
+	err = vr.Verify()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file":    fd.FileInfo.Name,
+			"workdir": workDir,
+			"error":   err,
+		}).Error("Signature verification failed.")
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves ranges from data, failing any range starting at fail.
+type testRangeDownloader struct {
+	mtx     sync.Mutex
+	data    []byte
+	fail    int64
+	offsets []int64
+}
+
+func (trd *testRangeDownloader) RangeDownload(filename string, offset int64, length int64, writer io.Writer) error {
+	trd.mtx.Lock()
+	trd.offsets = append(trd.offsets, offset)
+	trd.mtx.Unlock()
+
+	if offset == trd.fail {
+		return errors.New("test failure")
+	}
+
+	return copyRange(writer, bytes.NewReader(trd.data[offset:]), length)
+}
+
+func TestRangeHeader(t *testing.T) {
+	if h := rangeHeader(0, 10); h != "bytes=0-9" {
+		t.Fatalf("unexpected range header: %s", h)
+	}
+
+	if h := rangeHeader(100, 1); h != "bytes=100-100" {
+		t.Fatalf("unexpected range header: %s", h)
+	}
+}
+
+func TestFetchRangesResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distsync-ranged")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789"), 105)
+	fi := &FileInfo{
+		RemoteName:   "remote",
+		LastModified: time.Now().UTC(),
+		Length:       int64(len(data)),
+	}
+
+	partName, cpName := partialNames(dir, fi.RemoteName)
+	part, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer part.Close()
+
+	cp := loadCheckpoint(cpName, fi, 100)
+	if len(cp.Done) != 11 || !cp.empty() {
+		t.Fatalf("unexpected checkpoint: %+v", cp)
+	}
+
+	trd := &testRangeDownloader{data: data, fail: 500}
+	err = fetchRanges(trd, part, cp, 3)
+	if err == nil {
+		t.Fatal("expected error from failed range")
+	}
+
+	cp = loadCheckpoint(cpName, fi, 100)
+	if cp.empty() || cp.Done[5] {
+		t.Fatalf("unexpected checkpoint after failure: %+v", cp)
+	}
+
+	trd = &testRangeDownloader{data: data, fail: -1}
+	err = fetchRanges(trd, part, cp, 3)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	for _, done := range loadCheckpoint(cpName, fi, 100).Done {
+		if !done {
+			t.Fatal("expected all ranges to be done")
+		}
+	}
+
+	if len(trd.offsets) >= len(cp.Done) {
+		t.Fatalf("expected resume to skip finished ranges, fetched %d", len(trd.offsets))
+	}
+
+	got, err := ioutil.ReadFile(partName)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("partial file does not match after resume")
+	}
+
+	// a different version of the file starts again.
+	fi.LastModified = fi.LastModified.Add(time.Second)
+	if !loadCheckpoint(cpName, fi, 100).empty() {
+		t.Fatal("expected checkpoint of another version to be ignored")
+	}
+}
+
+func TestLocalDownloadQueueRanged(t *testing.T) {
+	c, cleanup := testLocalConf(t)
+	defer cleanup()
+
+	c.Download = &common.Download{RangeSize: 1000, Parallel: 3}
+
+	ec, err := crypto.NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	clear := bytes.Repeat([]byte("hello world "), 1000)
+	enc := &bytes.Buffer{}
+	err = ec.Encrypt(bytes.NewReader(clear), enc)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	s, err := NewFromConf(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	err = s.Upload("hello.txt", bytes.NewReader(enc.Bytes()))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	files, err := s.List(ec)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !useRanges(c, files[0].Length) {
+		t.Fatal("expected a ranged download")
+	}
+
+	dl, err := NewPersistentDownloader(c)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	dq := NewDownloadQueue(dl)
+	err = dq.Start()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	defer dq.Stop()
+
+	done := make(chan *FileDownload)
+	go dq.Add(c, files[0], done)
+	fd := <-done
+	if fd.Error != nil {
+		t.Fatalf("error: %v", fd.Error)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(*c.OutputDir, "hello.txt"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !bytes.Equal(data, clear) {
+		t.Fatal("Failed round trip through ranged download.")
+	}
+
+	entries, err := ioutil.ReadDir(*c.OutputDir)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("expected partial files to be removed, found %d files", len(entries))
+	}
+}
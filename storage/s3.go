@@ -18,23 +18,27 @@
 package storage
 
 import (
-	"github.com/mitchellh/goamz/aws"
+	log "github.com/Sirupsen/logrus"
 	"github.com/mitchellh/goamz/s3"
 	"github.com/pquerna/distsync/common"
 	"github.com/pquerna/distsync/crypto"
 
+	"bytes"
 	"errors"
 	"io"
+	"net/http"
 	"strings"
 	"time"
 )
 
 type S3Storage struct {
-	bucket string
-	creds  *common.AwsCreds
+	bucket    string
+	creds     *common.AwsCreds
+	multipart *common.Multipart
+	index     *bucketIndex
 }
 
-func NewS3(creds *common.AwsCreds, bucket string) (*S3Storage, error) {
+func NewS3(creds *common.AwsCreds, bucket string, mp *common.Multipart) (*S3Storage, error) {
 	if creds == nil {
 		return nil, errors.New("S3: No AwsCreds provided.")
 	}
@@ -44,22 +48,14 @@ func NewS3(creds *common.AwsCreds, bucket string) (*S3Storage, error) {
 	}
 
 	return &S3Storage{
-		bucket: bucket,
-		creds:  creds,
+		bucket:    bucket,
+		creds:     creds,
+		multipart: mp.WithDefaults(),
 	}, nil
 }
 
 func (s *S3Storage) client() (*s3.S3, error) {
-	a := aws.Auth{
-		AccessKey: s.creds.AccessKey,
-		SecretKey: s.creds.SecretKey,
-	}
-	r, ok := aws.Regions[s.creds.Region]
-	if !ok {
-		return nil, errors.New("S3: Unkonwn region: '" + s.creds.Region + "'")
-	}
-
-	return s3.New(a, r), nil
+	return s.creds.S3Client()
 }
 
 var dsyncCt = "application/distsync-encrypted"
@@ -67,44 +63,52 @@ var dsyncCt = "application/distsync-encrypted"
 // Uploads to S3, and touches .distsync on success.
 // which `notify.S3Poller` uses to find changes.
 func (s *S3Storage) Upload(filename string, reader io.ReadSeeker) error {
-	// just a random string taht will change the etag of .distsync,
-	// so that `notify.S3Poller` look for new files.
-	tsec, err := crypto.RandomSecret()
+	l, err := readerLength(reader)
 	if err != nil {
 		return err
 	}
 
-	l, err := reader.Seek(0, 2)
+	return s.UploadStream(filename, reader, l, &UploadState{})
+}
 
+func (s *S3Storage) UploadStream(filename string, reader io.Reader, l int64, state *UploadState) error {
+	client, err := s.client()
 	if err != nil {
 		return err
 	}
 
-	_, err = reader.Seek(0, 0)
+	bucket := client.Bucket(s.bucket)
 
+	hr := newHashReader(reader)
+	if l > s.multipart.PartSize {
+		err = s.uploadMulti(bucket, filename, hr, l, state)
+	} else {
+		err = bucket.PutReader(filename, hr, l, dsyncCt, "")
+	}
 	if err != nil {
 		return err
 	}
 
-	client, err := s.client()
+	err = s.index.update(s, hr.entry(filename, l, state))
 	if err != nil {
 		return err
 	}
 
-	bucket := client.Bucket(s.bucket)
+	channel, _ := splitChannel(filename)
+	return s.touchMarker(bucket, channel)
+}
 
-	err = bucket.PutReader(filename, reader, l, dsyncCt, "")
+// Touches the .distsync of channel.
+func (s *S3Storage) touchMarker(bucket *s3.Bucket, channel string) error {
+	// just a random string taht will change the etag of .distsync,
+	// so that `notify.S3Poller` look for new files.
+	tsec, err := crypto.RandomSecret()
 	if err != nil {
 		return err
 	}
 
 	sr := strings.NewReader(tsec)
-	err = bucket.PutReader(".distsync", sr, int64(sr.Len()), "text/plain", "")
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return bucket.PutReader(channelObject(channel, ".distsync"), sr, int64(sr.Len()), "text/plain", "")
 }
 
 func (s *S3Storage) DownloadTorrent(filename string, writer io.Writer) error {
@@ -127,6 +131,74 @@ func (s *S3Storage) DownloadTorrent(filename string, writer io.Writer) error {
 	return nil
 }
 
+// Uploads in parts with S3 multipart upload. The upload ID is saved in
+// state, and parts that were already uploaded with the same contents
+// are skipped when the upload is resumed.
+func (s *S3Storage) uploadMulti(bucket *s3.Bucket, filename string, reader io.Reader, l int64, state *UploadState) error {
+	partSize := state.partSize(s.multipart, l, maxS3Parts)
+
+	var multi *s3.Multi
+	existing := make(map[int]s3.Part)
+	if state.UploadId != "" && state.PartSize == partSize {
+		multi = &s3.Multi{Bucket: bucket, Key: filename, UploadId: state.UploadId}
+		parts, err := multi.ListParts()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"file":     filename,
+				"uploadId": state.UploadId,
+				"error":    err,
+			}).Warn("Unable to resume multipart upload, starting again")
+			multi = nil
+		}
+
+		for _, p := range parts {
+			existing[p.N] = p
+		}
+	}
+
+	if multi == nil {
+		var err error
+		multi, err = bucket.InitMulti(filename, dsyncCt, "")
+		if err != nil {
+			return err
+		}
+
+		state.UploadId = multi.UploadId
+		state.PartSize = partSize
+		err = state.save()
+		if err != nil {
+			return err
+		}
+	}
+
+	parts := make([]s3.Part, partCount(l, partSize))
+	err := uploadParts(reader, l, partSize, s.multipart.Parallel, func(n int, data []byte) error {
+		p, ok := existing[n]
+		if ok && p.Size == int64(len(data)) && strings.Trim(p.ETag, `"`) == partMD5(data) {
+			parts[n-1] = p
+			return nil
+		}
+
+		p, err := multi.PutPart(n, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		parts[n-1] = p
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = multi.Complete(parts)
+	if err != nil {
+		return err
+	}
+
+	return state.remove()
+}
+
 func (s *S3Storage) Download(filename string, writer io.Writer) error {
 	client, err := s.client()
 	if err != nil {
@@ -148,38 +220,309 @@ func (s *S3Storage) Download(filename string, writer io.Writer) error {
 	return nil
 }
 
-func (s *S3Storage) List(dc crypto.Decryptor) ([]*FileInfo, error) {
+// goamz can't send a Range header, so the object is fetched with a
+// signed URL instead.
+func (s *S3Storage) RangeDownload(filename string, offset int64, length int64, writer io.Writer) error {
 	client, err := s.client()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	bucket := client.Bucket(s.bucket)
+
+	req, err := http.NewRequest("GET", bucket.SignedURL(filename, time.Now().Add(time.Hour)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", rangeHeader(offset, length))
+
+	resp, err := client.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return errors.New("S3: ranged download failed: " + resp.Status)
+	}
+
+	return copyRange(writer, resp.Body, length)
+}
+
+func (s *S3Storage) Delete(filename string) error {
+	if hiddenObject(filename) {
+		return errors.New("S3: invalid filename: '" + filename + "'")
+	}
+
+	client, err := s.client()
+	if err != nil {
+		return err
 	}
 
 	bucket := client.Bucket(s.bucket)
 
-	contents, err := bucket.GetBucketContents()
+	err = bucket.Del(filename)
+	if err != nil {
+		return err
+	}
+
+	err = s.index.remove(s, filename)
+	if err != nil {
+		return err
+	}
+
+	channel, _ := splitChannel(filename)
+	return s.touchMarker(bucket, channel)
+}
+
+// Copies the object with a PUT copy request, which S3 supports for
+// objects of up to 5 GB.
+func (s *S3Storage) Promote(filename string, channel string) error {
+	dst, err := promotedName(filename, channel)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	bucket := client.Bucket(s.bucket)
+
+	resp, err := bucket.Head(filename)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	source := s.bucket + "/" + filename
+	if resp.ContentLength > maxS3CopySize {
+		err = copyMulti(bucket, dst, source, resp.ContentLength)
+	} else {
+		_, err = bucket.PutCopy(dst, "", s3.CopyOptions{}, source)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = s.index.promote(s, filename, dst)
+	if err != nil {
+		return err
+	}
+
+	return s.touchMarker(bucket, channel)
+}
+
+// Copies source to dst with a multipart upload of copied byte ranges,
+// for objects too large for a single copy.
+func copyMulti(bucket *s3.Bucket, dst string, source string, length int64) error {
+	multi, err := bucket.InitMulti(dst, dsyncCt, "")
+	if err != nil {
+		return err
+	}
+
+	ranges := copyRanges(length)
+	parts := make([]s3.Part, len(ranges))
+	for i, r := range ranges {
+		_, parts[i], err = multi.PutPartCopy(i+1, s3.CopyOptions{CopySourceOptions: r}, source)
+		if err != nil {
+			multi.Abort()
+			return err
+		}
+	}
+
+	err = multi.Complete(parts)
+	if err != nil {
+		multi.Abort()
+		return err
+	}
+
+	return nil
+}
+
+func (s *S3Storage) HasChunk(id string) bool {
+	client, err := s.client()
+	if err != nil {
+		return false
+	}
+
+	resp, err := client.Bucket(s.bucket).Head(chunkObject(id))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return true
+}
+
+func (s *S3Storage) PutChunk(id string, data []byte) error {
+	return s.putObject(chunkObject(id), data)
+}
+
+// Copies the chunk onto itself, S3 only allows that when replacing its
+// metadata.
+func (s *S3Storage) TouchChunk(id string) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Bucket(s.bucket).PutCopy(chunkObject(id), "", s3.CopyOptions{
+		MetadataDirective: "REPLACE",
+		ContentType:       dsyncCt,
+	}, s.bucket+"/"+chunkObject(id))
+	return err
+}
+
+func (s *S3Storage) ListChunks() (map[string]time.Time, error) {
+	client, err := s.client()
 	if err != nil {
 		return nil, err
 	}
 
-	rv := make([]*FileInfo, 0, len(*contents))
-	for _, key := range *contents {
-		if key.Key == ".distsync" {
-			continue
+	bucket := client.Bucket(s.bucket)
+
+	rv := make(map[string]time.Time)
+	marker := ""
+	for {
+		resp, err := bucket.List(chunkPrefix, "", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range resp.Contents {
+			lm, err := time.Parse(time.RFC3339Nano, key.LastModified)
+			if err != nil {
+				return nil, err
+			}
+
+			rv[strings.TrimPrefix(key.Key, chunkPrefix)] = lm
 		}
 
-		lm, err := time.Parse(time.RFC3339Nano, key.LastModified)
+		if !resp.IsTruncated {
+			return rv, nil
+		}
+
+		if len(resp.Contents) == 0 {
+			return nil, errors.New("S3: truncated chunk listing without a marker.")
+		}
+		marker = resp.Contents[len(resp.Contents)-1].Key
+	}
+}
+
+func (s *S3Storage) DeleteChunk(id string) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	return client.Bucket(s.bucket).Del(chunkObject(id))
+}
+
+// Channels are the common prefixes of the bucket with a valid channel
+// name.
+func (s *S3Storage) ListChannels() ([]string, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := client.Bucket(s.bucket)
+
+	rv := make([]string, 0)
+	marker := ""
+	for {
+		resp, err := bucket.List("", "/", marker, 1000)
 		if err != nil {
 			return nil, err
 		}
 
-		rv = append(rv, &FileInfo{
-			Name:         key.Key,
-			LastModified: lm,
-			Length:       key.Size,
-		})
+		for _, prefix := range resp.CommonPrefixes {
+			channel := strings.TrimSuffix(prefix, "/")
+			if common.ValidateChannel(channel) == nil {
+				rv = append(rv, channel)
+			}
+		}
+
+		if !resp.IsTruncated {
+			return rv, nil
+		}
+
+		marker = resp.NextMarker
+		if marker == "" && len(resp.Contents) > 0 {
+			marker = resp.Contents[len(resp.Contents)-1].Key
+		}
+		if marker == "" {
+			return nil, errors.New("S3: truncated listing without a marker.")
+		}
+	}
+}
+
+func (s *S3Storage) putObject(name string, data []byte) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+
+	bucket := client.Bucket(s.bucket)
+
+	return bucket.PutReader(name, bytes.NewReader(data), int64(len(data)), dsyncCt, "")
+}
+
+func (s *S3Storage) setIndex(bi *bucketIndex) {
+	s.index = bi
+}
+
+func (s *S3Storage) List(dc crypto.Decryptor) ([]*FileInfo, error) {
+	return s.ListChannel(dc, common.DefaultChannel)
+}
+
+// Lists only the objects of the channel: the delimiter leaves out the
+// objects of other channels, returned as common prefixes instead.
+func (s *S3Storage) ListChannel(dc crypto.Decryptor, channel string) ([]*FileInfo, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
 	}
 
-	return rv, nil
+	bucket := client.Bucket(s.bucket)
+	prefix := common.ChannelPrefix(channel)
+
+	rv := make([]*FileInfo, 0)
+	marker := ""
+	for {
+		resp, err := bucket.List(prefix, "/", marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range resp.Contents {
+			if !inChannel(key.Key, channel) || hiddenObject(key.Key) {
+				continue
+			}
+
+			lm, err := time.Parse(time.RFC3339Nano, key.LastModified)
+			if err != nil {
+				return nil, err
+			}
+
+			rv = appendFileInfo(rv, newFileInfo(dc, key.Key, lm, key.Size))
+		}
+
+		if !resp.IsTruncated {
+			return rv, nil
+		}
+
+		// NextMarker can be a common prefix, after the last key.
+		marker = resp.NextMarker
+		if marker == "" && len(resp.Contents) > 0 {
+			marker = resp.Contents[len(resp.Contents)-1].Key
+		}
+		if marker == "" {
+			return nil, errors.New("S3 listing is truncated, without a marker to continue from.")
+		}
+	}
 }
 
 func (s *S3Storage) Start() error {
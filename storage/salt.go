@@ -0,0 +1,163 @@
+/**
+ *  Copyright 2014 Paul Querna
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"github.com/pquerna/distsync/common"
+	"github.com/pquerna/distsync/crypto"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
+// Object holding the random salt a Passphrase is stretched with, and an
+// HMAC of the salt with the derived key, so a replaced salt or a wrong
+// passphrase are detected. It is not secret, and is the same for every
+// channel.
+const saltName = ".distsync-salt"
+
+const saltSize = 32
+
+// LoadPassphraseKey derives the shared secret from Passphrase or
+// PassphraseFile and the salt stored in the bucket, see
+// crypto.DerivePassphraseKey. Uploaders pass create to write a new salt
+// when the bucket doesn't have one yet. Does nothing without a
+// passphrase, or once the key is derived.
+func LoadPassphraseKey(c *common.Conf, create bool) error {
+	if !crypto.UsesPassphrase(c) || c.PassphraseKey != nil {
+		return nil
+	}
+
+	s, err := newIndexedStorage(c)
+	if err != nil {
+		return err
+	}
+
+	return loadPassphraseKey(c, s, create)
+}
+
+func loadPassphraseKey(c *common.Conf, s indexedStorage, create bool) error {
+	buf := &bytes.Buffer{}
+	err := s.Download(saltName, buf)
+	if err != nil && isNotFound(err) && create {
+		err = createSalt(c, s, buf)
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return errors.New("The bucket has no passphrase salt yet, it is created by the first upload.")
+		}
+		return err
+	}
+
+	data := buf.Bytes()
+	if len(data) != saltSize+sha256.Size {
+		return errors.New("Invalid passphrase salt in the bucket.")
+	}
+
+	err = crypto.DerivePassphraseKey(c, data[:saltSize])
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(data[saltSize:], saltMAC(c.PassphraseKey, data[:saltSize])) {
+		c.PassphraseKey = nil
+		return errors.New("The passphrase salt in the bucket doesn't match the passphrase, check the passphrase or restore the salt.")
+	}
+
+	return nil
+}
+
+func saltMAC(key []byte, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(saltName))
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// Writes a new random salt, and reads it back into buf, the key is only
+// derived from what was read back in case another uploader wrote one at
+// the same time. A bucket that already has objects had a salt, which a
+// new one would make unreadable, so no salt is created for it.
+func createSalt(c *common.Conf, s indexedStorage, buf *bytes.Buffer) error {
+	empty, err := bucketEmpty(s)
+	if err != nil {
+		return err
+	}
+
+	if !empty {
+		return errors.New("The passphrase salt is missing from a bucket that has files, they can't be decrypted without it. Restore " + saltName + " instead of uploading.")
+	}
+
+	salt := make([]byte, saltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return err
+	}
+
+	err = crypto.DerivePassphraseKey(c, salt)
+	if err != nil {
+		return err
+	}
+
+	err = s.putObject(saltName, append(salt, saltMAC(c.PassphraseKey, salt)...))
+	c.PassphraseKey = nil
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(settleDelay)
+
+	buf.Reset()
+	return s.Download(saltName, buf)
+}
+
+// Returns true if the bucket has no files, index or chunks in any
+// channel.
+func bucketEmpty(s indexedStorage) (bool, error) {
+	files, err := s.ListChannel(nil, common.DefaultChannel)
+	if err != nil || len(files) > 0 {
+		return false, err
+	}
+
+	err = s.Download(indexName, ioutil.Discard)
+	if err == nil || !isNotFound(err) {
+		return false, err
+	}
+
+	cc, ok := s.(ChunkCollector)
+	if !ok {
+		return true, nil
+	}
+
+	chunks, err := cc.ListChunks()
+	if err != nil || len(chunks) > 0 {
+		return false, err
+	}
+
+	channels, err := cc.ListChannels()
+	if err != nil {
+		return false, err
+	}
+
+	return len(channels) == 0, nil
+}
@@ -58,13 +58,13 @@ func NewTorrentDownloader(conf *common.Conf) (*TorrentDownloader, error) {
 		return nil, err
 	}
 
-	ec, err := crypto.NewFromConf(conf)
+	// TODO: better separation? different interface for download?
+	st, err := NewFromConf(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: better separation? different interface for download?
-	st, err := NewFromConf(conf)
+	ec, err := crypto.NewFromConf(conf)
 	if err != nil {
 		return nil, err
 	}